@@ -23,7 +23,6 @@ misrepresented as being the original software.
 package lua
 
 import "io"
-import "io/ioutil"
 import "fmt"
 import "os"
 import "os/exec"
@@ -34,8 +33,9 @@ import "github.com/milochristiansen/lua/luautil"
 // Stack
 
 // Push pushes the given value onto the stack.
-// If the value is not one of nil, float32, float64, int, int32, int64, string, bool, or
-// NativeFunction it is converted to a userdata value before being pushed.
+// If the value is not one of nil, float32, float64, int, int32, int64, string, bool, NativeFunction,
+// or *State (a thread) it is converted to a userdata value before being pushed. If the value's type was
+// registered with RegisterType the new userdata value is given that type's metatable.
 func (l *State) Push(v interface{}) {
 	switch v2 := v.(type) {
 	case nil:
@@ -49,41 +49,35 @@ func (l *State) Push(v interface{}) {
 	case int64:
 	case string:
 	case bool:
-	case *table: // These three are needed for when the internal API uses these functions for some reason.
+	case *table: // These four are needed for when the internal API uses these functions for some reason.
 	case *function:
 	case *userData:
+	case *State:
 	case func(l *State) int:
-		v = &function{
-			native: v2,
-			up: []*upValue{{
-				name:   "_ENV",
-				index:  -1,
-				closed: true,
-				val:    l.global,
-				absIdx: -1,
-			},
-			},
-		}
+		v = l.nativeFunc(v2)
 	case NativeFunction:
-		v = &function{
-			native: v2,
-			up: []*upValue{{
-				name:   "_ENV",
-				index:  -1,
-				closed: true,
-				val:    l.global,
-				absIdx: -1,
-			},
-			},
-		}
+		v = l.nativeFunc(v2)
 	default:
-		v = &userData{
-			data: v2,
-		}
+		v = l.newUserData(v2)
 	}
 	l.stack.Push(v)
 }
 
+// nativeFunc wraps a native function, giving it the usual _ENV upvalue.
+func (l *State) nativeFunc(f NativeFunction) *function {
+	return &function{
+		native: f,
+		up: []*upValue{{
+			name:   "_ENV",
+			index:  -1,
+			closed: true,
+			val:    tv(l.global),
+			absIdx: -1,
+		},
+		},
+	}
+}
+
 // PushClosure pushes a native function as a closure.
 // All native functions always have at least a single upval, _ENV, but this allows you to set more of them if you wish.
 func (l *State) PushClosure(f NativeFunction, v ...int) {
@@ -105,7 +99,7 @@ func (l *State) PushClosure(f NativeFunction, v ...int) {
 		name:   "_ENV",
 		index:  -1,
 		closed: true,
-		val:    l.global,
+		val:    tv(l.global),
 		absIdx: -1,
 	}
 
@@ -114,7 +108,7 @@ func (l *State) PushClosure(f NativeFunction, v ...int) {
 			name:   "(native upvalue)",
 			index:  -1,
 			closed: true,
-			val:    l.get(v[i-1]),
+			val:    tv(l.get(v[i-1])),
 			absIdx: -1,
 		}
 	}
@@ -124,7 +118,7 @@ func (l *State) PushClosure(f NativeFunction, v ...int) {
 
 // PushIndex pushes a copy of the value at the given index onto the stack.
 func (l *State) PushIndex(i int) {
-	l.stack.Push(l.get(i))
+	l.stack.PushT(l.getT(i))
 }
 
 // Insert takes the item from the TOS and inserts it at the given stack index.
@@ -182,26 +176,31 @@ func (l *State) AbsIndex(i int) int {
 
 // Helper
 func (l *State) get(i int) value {
+	return l.getT(i).value()
+}
+
+// getT is get without converting the result to a plain value.
+func (l *State) getT(i int) tvalue {
 	switch {
 	case i == RegistryIndex:
-		return l.registry
+		return tv(l.registry)
 	case i == GlobalsIndex:
-		return l.global
+		return tv(l.global)
 	case i <= FirstUpVal:
-		return l.stack.cFrame().getUp(FirstUpVal - i)
+		return l.stack.cFrame().getUpT(FirstUpVal - i)
 	case i > 0:
-		return l.stack.Get(i - 1)
+		return l.stack.GetT(i - 1)
 	case i < 0:
-		return l.stack.Get(i)
+		return l.stack.GetT(i)
 	default:
-		return nil
+		return tvalue{}
 	}
 }
 
 // TypeOf returns the type of the value at the given index.
 // Negative indexes are relative to TOS, positive indexes are absolute.
 func (l *State) TypeOf(i int) TypeID {
-	return typeOf(l.get(i))
+	return l.getT(i).typeOf()
 }
 
 // SubTypeOf returns the sub-type of the value at the given index.
@@ -213,45 +212,45 @@ func (l *State) SubTypeOf(i int) STypeID {
 // TryFloat attempts to read the value at the given index as a floating point number.
 // Negative indexes are relative to TOS, positive indexes are absolute.
 func (l *State) TryFloat(i int) (float64, bool) {
-	return tryFloat(l.get(i))
+	return l.getT(i).tryFloat()
 }
 
 // ToFloat reads a floating point value from the stack at the given index.
 // Negative indexes are relative to TOS, positive indexes are absolute.
 // If the value is not an float and cannot be converted to one this may panic.
 func (l *State) ToFloat(i int) float64 {
-	return toFloat(l.get(i))
+	return l.getT(i).toFloat()
 }
 
 // OptFloat is the same as ToFloat, except the given default is returned if the value is nil or non-existent.
+// For function arguments that should raise a proper error if they are not numbers see CheckOptNumber.
 func (l *State) OptFloat(i int, d float64) float64 {
-	v := l.get(i)
-	if v == nil {
+	if l.IsNil(i) {
 		return d
 	}
-	return toFloat(v)
+	return l.ToFloat(i)
 }
 
 // TryInt attempts to read the value at the given index as a integer number.
 // Negative indexes are relative to TOS, positive indexes are absolute.
 func (l *State) TryInt(i int) (int64, bool) {
-	return tryInt(l.get(i))
+	return l.getT(i).tryInt()
 }
 
 // ToInt reads an integer value from the stack at the given index.
 // Negative indexes are relative to TOS, positive indexes are absolute.
 // If the value is not an integer and cannot be converted to one this may panic.
 func (l *State) ToInt(i int) int64 {
-	return toInt(l.get(i))
+	return l.getT(i).toInt()
 }
 
 // OptInt is the same as ToInt, except the given default is returned if the value is nil or non-existent.
+// For function arguments that should raise a proper error if they are not integers see CheckOptInt.
 func (l *State) OptInt(i int, d int64) int64 {
-	v := l.get(i)
-	if v == nil {
+	if l.IsNil(i) {
 		return d
 	}
-	return toInt(v)
+	return l.ToInt(i)
 }
 
 // ToString reads a value from the stack at the given index and formats it as a string.
@@ -275,6 +274,7 @@ func (l *State) ToString(i int) string {
 }
 
 // OptString is the same as ToString, except the given default is returned if the value is nil or non-existent.
+// For function arguments that should raise a proper error if they are not strings see CheckOptString.
 func (l *State) OptString(i int, d string) string {
 	if l.IsNil(i) {
 		return d
@@ -285,13 +285,13 @@ func (l *State) OptString(i int, d string) string {
 // ToBool reads a value from the stack at the given index and interprets it as a boolean.
 // Negative indexes are relative to TOS, positive indexes are absolute.
 func (l *State) ToBool(i int) bool {
-	return toBool(l.get(i))
+	return l.getT(i).truthy()
 }
 
 // IsNil check if the value at the given index is nil. Nonexistent values are always nil.
 // Negative indexes are relative to TOS, positive indexes are absolute.
 func (l *State) IsNil(i int) bool {
-	return l.get(i) == nil
+	return l.getT(i).isNil()
 }
 
 // ToUser reads an userdata value from the stack at the given index.
@@ -314,6 +314,7 @@ func (l *State) ToUser(i int) interface{} {
 //	table -> string: "table <pointer as hexadecimal>"
 //	function -> string: "function <pointer as hexadecimal>"
 //	userdata -> The raw user data value
+//	thread -> string: "thread <pointer as hexadecimal>"
 func (l *State) GetRaw(i int) interface{} {
 	v := l.get(i)
 	switch v2 := v.(type) {
@@ -338,14 +339,33 @@ func (l *State) GetRaw(i int) interface{} {
 //
 // This may raise an error if they values are not appropriate for the given operator.
 func (l *State) Arith(op opCode) {
-	a := l.stack.Get(-2)
+	a := l.stack.GetT(-2)
 	b := a
 	if op != OpUMinus && op != OpBinNot {
-		b = l.stack.Get(-1)
+		b = l.stack.GetT(-1)
 	}
 
 	l.stack.Pop(2)
-	l.stack.Push(l.arith(op, a, b))
+	l.stack.PushT(l.arithT(op, a, b))
+}
+
+// Concat concatenates the top n values on the stack, pops them, and pushes the result. Strings and numbers are
+// joined as usual, other values need a __concat meta method. If n is 1 the value is left as it is, if n is 0 an
+// empty string is pushed. See "lua_concat" in the Lua 5.3 Reference Manual.
+//
+// This may raise an error if the values cannot be concatenated.
+func (l *State) Concat(n int) {
+	if n < 0 || n > l.stack.TopIndex()+1 {
+		luautil.Raise("Invalid value count for Concat.", luautil.ErrTypGenRuntime)
+	}
+
+	vals := make([]value, n)
+	for i := range vals {
+		vals[i] = l.stack.Get(i - n)
+	}
+	rtn := l.concat(vals)
+	l.stack.Pop(n)
+	l.stack.Push(rtn)
 }
 
 // Compare performs the specified the comparison operator with the items at the given stack indexes.
@@ -353,18 +373,12 @@ func (l *State) Arith(op opCode) {
 //
 // This may raise an error if they values are not appropriate for the given operator.
 func (l *State) Compare(i1, i2 int, op opCode) bool {
-	a := l.get(i1)
-	b := l.get(i2)
-
-	return l.compare(op, a, b, false)
+	return l.compareT(op, l.getT(i1), l.getT(i2), false)
 }
 
 // CompareRaw is exactly like Compare, but without meta-methods.
 func (l *State) CompareRaw(i1, i2 int, op opCode) bool {
-	a := l.get(i1)
-	b := l.get(i2)
-
-	return l.compare(op, a, b, true)
+	return l.compareT(op, l.getT(i1), l.getT(i2), true)
 }
 
 // Table Access
@@ -440,10 +454,10 @@ func (l *State) SetTableFunctions(i int, funcs map[string]NativeFunction) {
 // Next is a basic table iterator.
 //
 // Pass in the index of a table, Next will pop a key from the stack and push the next key and it's value.
-// This function is not reentrant! Iteration order changes with each iteration, so trying to
-// do two separate iterations of a single table at the same time will result in all kinds of weirdness.
-// If you use this iterator in production code you need your head examined, it is here strictly to power
-// the standard library function `next` (which you also should not use).
+// Push nil to start a traversal, a nil key is pushed when there are no more items. Next does not keep any
+// state of its own, so you may run as many traversals of a single table at once as you like. As with the
+// reference implementation you may change or clear existing fields during a traversal, but adding new
+// keys may cause items to be skipped or repeated.
 //
 // If the given value is not a table this will raise an error.
 //
@@ -613,7 +627,7 @@ func (l *State) SetUpVal(f, i, v int) bool {
 	if !def.closed {
 		return false
 	}
-	def.val = l.get(v)
+	def.val = tv(l.get(v))
 	return true
 }
 
@@ -666,11 +680,44 @@ func (l *State) DumpFunction(i int, strip bool) []byte {
 	return dumpBin(&f.proto)
 }
 
-// Error pops a value off the top of the stack, converts it to a string, and raises it as a (general runtime) error.
+// Error pops a value off the top of the stack and raises it as a (general runtime) error. The error message is
+// the value converted to a string, but the value itself is kept as well (see PushError), so any value may be used
+// as an error.
 func (l *State) Error() {
+	v := l.stack.Get(-1)
 	msg := l.ToString(-1)
 	l.stack.Pop(1)
-	luautil.Raise(msg, luautil.ErrTypGenRuntime)
+	panic(luautil.Error{Msg: msg, Type: luautil.ErrTypGenRuntime, Value: v, HasValue: true})
+}
+
+// PushError pushes the value an error was raised with onto the stack. If the error was not raised with Error (or
+// error from Lua) the error message is pushed instead (without any stack trace).
+func (l *State) PushError(err error) {
+	if e, ok := err.(luautil.Error); ok {
+		if e.HasValue {
+			l.stack.Push(e.Value)
+			return
+		}
+		e.Frames = nil
+		e.Trace = ""
+		l.stack.Push(e.Error())
+		return
+	}
+	l.stack.Push(err.Error())
+}
+
+// Where returns a string identifying the current position of the function at the given level of the call stack,
+// in the form "chunkname:currentline: ". Level 0 is the running function (usually a native function, in which case
+// this returns ""), level 1 is the function that called it, and so on. If the position is not known this returns
+// "".
+//
+// This is generally used to add position information to error messages.
+func (l *State) Where(level int) string {
+	ar, ok := l.StackInfo(level)
+	if !ok || ar.CurrentLine <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("%v:%v: ", ar.Source, ar.CurrentLine)
 }
 
 // GetMetaField pushes the meta method with the given name for the item at the given index onto the stack, then
@@ -698,6 +745,10 @@ func (l *State) GetMetaTable(i int) bool {
 // SetMetaTable pops a table from the stack and sets it as the meta table of the value at the given index.
 // If the value is not a userdata or table then the meta table is set for ALL values of that type!
 //
+// If the value is a userdata or table and the meta table has a __gc field the value is marked for finalization,
+// see RunFinalizers. If the value is a table the meta table's __mode field is used to decide if the table has weak
+// keys and/or values (changing __mode later has no effect).
+//
 // If you try to set a metatable that is not a table or try to pass an invalid type this will raise an error.
 func (l *State) SetMetaTable(i int) {
 	v := l.get(i)
@@ -720,10 +771,15 @@ func (l *State) SetMetaTable(i int) {
 		l.metaTbls[TypBool] = tbl
 	case *table:
 		v2.meta = tbl
+		v2.setMode(tbl)
+		l.markForFinalize(v2, tbl)
 	case *function:
 		l.metaTbls[TypFunction] = tbl
 	case *userData:
 		v2.meta = tbl
+		l.markForFinalize(v2, tbl)
+	case *State:
+		l.metaTbls[TypThread] = tbl
 	default:
 		luautil.Raise("Invalid type passed to SetMetaTable.", luautil.ErrTypMajorInternal)
 	}
@@ -886,7 +942,7 @@ func (l *State) asFunc(proto *funcProto, env *table) *function {
 			luautil.Raise("Top level function without _ENV or _ENV in improper position.", luautil.ErrTypGenRuntime)
 		}
 
-		f.up[0].val = env
+		f.up[0].val = tv(env)
 	}
 
 	return f
@@ -900,18 +956,7 @@ func (l *State) LoadBinary(in io.Reader, name string, env int) error {
 	if err != nil {
 		return err
 	}
-
-	envv := l.global
-	if env != 0 {
-		ok := false
-		envv, ok = l.get(env).(*table)
-		if !ok {
-			return luautil.Error{Msg: "Value used as environment is not a table.", Type: luautil.ErrTypGenRuntime}
-		}
-	}
-
-	l.stack.Push(l.asFunc(proto, envv))
-	return nil
+	return l.PushChunk(&Chunk{proto: proto}, env)
 }
 
 // LoadText loads a text chunk into memory and pushes the result onto the stack.
@@ -920,27 +965,24 @@ func (l *State) LoadBinary(in io.Reader, name string, env int) error {
 //
 // This version uses my own compiler. This compiler does not produce code identical to the standard Lua
 // compiler for all syntax constructs, sometimes it is a little worse, rarely a little better.
+//
+// If you need to load the same code into more than one State, use Compile and PushChunk instead.
 func (l *State) LoadText(in io.Reader, name string, env int) error {
-	source, err := ioutil.ReadAll(in)
+	c, err := CompileOptions(in, name, l.Options)
 	if err != nil {
 		return err
 	}
-	proto, err := compSource(string(source), name, 1)
+	return l.PushChunk(c, env)
+}
+
+// LoadTextOptions is LoadText with some extra options, see Options. The options given here are used instead of
+// State.Options.
+func (l *State) LoadTextOptions(in io.Reader, name string, env int, opts Options) error {
+	c, err := CompileOptions(in, name, opts)
 	if err != nil {
 		return err
 	}
-
-	envv := l.global
-	if env != 0 {
-		ok := false
-		envv, ok = l.get(env).(*table)
-		if !ok {
-			return luautil.Error{Msg: "Value used as environment is not a table.", Type: luautil.ErrTypGenRuntime}
-		}
-	}
-
-	l.stack.Push(l.asFunc(proto, envv))
-	return nil
+	return l.PushChunk(c, env)
 }
 
 // LoadTextExternal loads a text chunk into memory and pushes the result onto the stack.
@@ -971,25 +1013,12 @@ func (l *State) LoadTextExternal(in io.Reader, name string, env int) error {
 	}
 	defer file.Close()
 
-	envv := l.global
-	if env != 0 {
-		ok := false
-		envv, ok = l.get(env).(*table)
-		if !ok {
-			return luautil.Error{Msg: "Value used as environment is not a table.", Type: luautil.ErrTypGenRuntime}
-		}
-	}
-
-	proto, err := loadBin(file, name)
-	if err != nil {
-		return err
-	}
-	l.stack.Push(l.asFunc(proto, envv))
-	return nil
+	return l.LoadBinary(file, name, env)
 }
 
 // Call runs a function with the given number of arguments and results.
 // The function must be on the stack just before the first argument.
+// Any pending finalizers (see RunFinalizers) are run before the function is called.
 // If this raises an error the stack is NOT unwound! Call this only from
 // code that is below a call to PCall unless you want your State to be
 // permanently trashed!
@@ -998,6 +1027,8 @@ func (l *State) Call(args, rtns int) {
 		luautil.Raise("Cannot use Call if arg count is unknown.", luautil.ErrTypGenRuntime)
 	}
 
+	l.maybeRunFinalizers()
+
 	fi := -(args + 1) // Generate a relative index for the function
 	l.call(fi, args, rtns, false)
 }
@@ -1047,71 +1078,117 @@ func (l *State) Protect(f func()) (err error) {
 // Recover is the error handler and cleanup function powering PCall and Protect. Those functions simply wrap this
 // one for easier use.
 func (l *State) Recover(onStk int, trace bool) func(*error) {
-	frames := len(l.stack.frames)
+	return l.recover(onStk, trace, nil)
+}
+
+// XPCall is exactly like PCall, except if there is an error the message handler at index handler is called
+// before the stack is unwound. The handler is called with the error value (see PushError) and whatever it returns
+// is used as the new error value.
+//
+// Since the failing function is still on the stack when the handler is called, the handler may use StackInfo
+// or Traceback to find out where the error happened. If the handler itself raises an error the returned error
+// will have the message "error in error handling".
+//
+// Instruction and memory limit errors do not call the handler.
+func (l *State) XPCall(args, rtns, handler int) (err error) {
+	h := l.get(handler)
+	if _, ok := h.(*function); !ok {
+		luautil.Raise("Message handler is not a function.", luautil.ErrTypGenRuntime)
+	}
+
+	defer l.recover(args+1, false, h)(&err)
+
+	l.Call(args, rtns)
+	return nil
+}
+
+// recover is Recover with optional support for a message handler (see XPCall).
+func (l *State) recover(onStk int, trace bool, handler value) func(*error) {
+	base := len(l.stack.frames)
 	top := len(l.stack.data) - onStk
 
 	return func(err *error) {
 		e := recover()
+		if e == (threadClosed{}) {
+			// The thread is being stopped by Close, clean up and keep going.
+			l.stack.frames[len(l.stack.frames)-1].closeUpAbs(top)
+			l.stack.frames = l.stack.frames[:base]
+			l.stack.data = l.stack.data[:top]
+			panic(e)
+		}
 		if e != nil {
-			// Compile a stack trace.
+			// Gather a stack trace.
+			var frames []luautil.Frame
 			traceS := ""
 			if trace {
-				// TODO: The produced trace is terrible, do this properly.
-				sources := []string{}
-				lines := []int{}
-				for i := len(l.stack.frames) - 1; i >= frames; i-- {
-					frame := l.stack.frames[i]
-					if frame.fn.native == nil {
-						sources = append(sources, frame.fn.proto.source)
-						if int(frame.pc) < len(frame.fn.proto.lineInfo) {
-							lines = append(lines, frame.fn.proto.lineInfo[frame.pc])
-						} else if len(frame.fn.proto.lineInfo) > 0 {
-							lines = append(lines, frame.fn.proto.lineInfo[len(frame.fn.proto.lineInfo)-1])
-						} else {
-							lines = append(lines, -1)
-						}
-					} else {
-						sources = append(sources, "(native code)")
-						lines = append(lines, -1)
-					}
-				}
-
-				for i := range sources {
-					if lines[i] == -1 {
-						traceS += fmt.Sprintf("\n    \"%v\"", sources[i])
-						continue
-					}
-					traceS += fmt.Sprintf("\n    \"%v\": <line: %v>", sources[i], lines[i])
+				for i := len(l.stack.frames) - 1; i >= base; i-- {
+					frames = append(frames, l.luaFrame(i))
 				}
 
 				if l.NativeTrace {
 					buf := make([]byte, 4096)
 					buf = buf[:runtime.Stack(buf, true)]
-					traceS = fmt.Sprintf("%v\n\nNative Trace:\n%s\n", traceS, buf)
+					traceS = fmt.Sprintf("Native Trace:\n%s\n", buf)
 				}
 			}
 
+			// Attach the stack trace to the error
+			var lerr luautil.Error
+			switch e2 := e.(type) {
+			case luautil.Error:
+				e2.Frames = frames
+				e2.Trace = traceS
+				lerr = e2
+			case error:
+				lerr = luautil.Error{Type: luautil.ErrTypWrapped, Err: e2, Frames: frames, Trace: traceS}
+			default:
+				lerr = luautil.Error{Type: luautil.ErrTypEvil, Err: fmt.Errorf("%v", e), Frames: frames, Trace: traceS}
+			}
+
+			// The message handler needs to run before anything is removed from the stack.
+			if handler != nil {
+				lerr = l.handleError(handler, lerr)
+			}
+			*err = lerr
+
 			// Before we strip the stack we need to close all upvalues in the section we will be stripping, just in
 			// case a closure was assigned to another upvalue.
 			l.stack.frames[len(l.stack.frames)-1].closeUpAbs(top)
 
 			// Make sure the stack is back to the way we found it, minus the function and it's arguments.
-			l.stack.frames = l.stack.frames[:frames]
+			l.stack.frames = l.stack.frames[:base]
 			for i := len(l.stack.data) - 1; i >= top; i-- {
-				l.stack.data[i] = nil
+				l.stack.data[i] = tvalue{}
 			}
 			l.stack.data = l.stack.data[:top]
-
-			// Attach the stack trace to the error
-			switch e2 := e.(type) {
-			case luautil.Error:
-				e2.Trace = traceS
-				*err = e2
-			case error:
-				*err = luautil.Error{Type: luautil.ErrTypWrapped, Err: e2, Trace: traceS}
-			default:
-				*err = luautil.Error{Type: luautil.ErrTypEvil, Err: fmt.Errorf("%v", e), Trace: traceS}
-			}
 		}
 	}
 }
+
+// handleError calls an XPCall message handler for the given error, and returns the error that should be
+// returned in its place.
+func (l *State) handleError(handler value, err luautil.Error) luautil.Error {
+	if err.Type == luautil.ErrTypInterrupted || err.Type == luautil.ErrTypMemory {
+		return err
+	}
+
+	// Give the handler some room to work with, in case the error was a stack overflow.
+	extra := l.stack.extra
+	l.stack.extra = true
+	defer func() { l.stack.extra = extra }()
+
+	var rtn value
+	msg := ""
+	herr := l.Protect(func() {
+		l.Push(handler)
+		l.PushError(err)
+		l.Call(1, 1)
+		rtn = l.stack.Get(-1)
+		msg = l.ToString(-1)
+		l.Pop(1)
+	})
+	if herr != nil {
+		return luautil.Error{Type: err.Type, Msg: "error in error handling", Err: herr}
+	}
+	return luautil.Error{Type: err.Type, Msg: msg, Value: rtn, HasValue: true}
+}
@@ -257,3 +257,117 @@ func TestTable(t *testing.T) {
 
 	assert(t, l.AbsIndex(-1) == 0, "Items remain on stack after all values popped.")
 }
+
+func TestOpt(t *testing.T) {
+	l := NewState()
+
+	// The Opt functions convert values the same way the To functions do.
+	l.Push("5")
+	l.NewTable(0, 0)
+	l.NewTable(0, 1)
+	l.Push("__tostring")
+	l.Push(func(l *State) int {
+		l.Push("tbl")
+		return 1
+	})
+	l.SetTableRaw(-3)
+	l.SetMetaTable(-2)
+
+	assert(t, l.OptInt(1, 0) == 5, "OptInt did not convert a string.")
+	assert(t, l.OptFloat(1, 0) == 5, "OptFloat did not convert a string.")
+	assert(t, l.OptString(2, "") == "tbl", "OptString did not use __tostring.")
+
+	// Nil and missing values give the default.
+	l.Push(nil)
+	assert(t, l.OptInt(3, 2) == 2 && l.OptInt(4, 3) == 3, "OptInt did not return the default.")
+	assert(t, l.OptFloat(3, 2.5) == 2.5 && l.OptFloat(4, 3.5) == 3.5, "OptFloat did not return the default.")
+	assert(t, l.OptString(3, "a") == "a" && l.OptString(4, "b") == "b", "OptString did not return the default.")
+	assert(t, l.CheckOptInt(3, 2) == 2 && l.CheckOptNumber(4, 3.5) == 3.5, "CheckOpt did not return the default.")
+	assert(t, l.CheckOptString(4, "b") == "b", "CheckOptString did not return the default.")
+
+	l.Pop(3)
+	assert(t, l.AbsIndex(-1) == 0, "Items remain on stack after all values popped.")
+}
+
+func TestConcat(t *testing.T) {
+	l := NewState()
+
+	l.Push("a")
+	l.Push(1)
+	l.Push(2.5)
+	l.Concat(3)
+	assert(t, l.AbsIndex(-1) == 1 && l.ToString(-1) == "a12.5", "Strings and numbers not concatenated.")
+
+	l.Concat(1)
+	assert(t, l.AbsIndex(-1) == 1 && l.ToString(-1) == "a12.5", "Single value changed.")
+	l.Concat(0)
+	assert(t, l.AbsIndex(-1) == 2 && l.ToString(-1) == "", "Empty concatenation did not push an empty string.")
+	l.Pop(2)
+
+	// The meta method result is used as is, even if it is not a string.
+	l.NewTable(0, 0)
+	l.NewTable(0, 1)
+	l.Push("__concat")
+	l.Push(func(l *State) int {
+		l.Push(true)
+		return 1
+	})
+	l.SetTableRaw(-3)
+	l.SetMetaTable(-2)
+	l.Push("x")
+	l.Concat(2)
+	assertTyp(t, l, TypBool, STypNone, -1)
+	l.Pop(1)
+
+	err := l.Protect(func() {
+		l.Push(nil)
+		l.Push("x")
+		l.Concat(2)
+	})
+	assert(t, err != nil, "Concatenating nil did not raise an error.")
+	assert(t, l.AbsIndex(-1) == 0, "Items remain on stack after all values popped.")
+}
+
+func TestThreadClose(t *testing.T) {
+	l := NewState()
+
+	// A thread that never finishes.
+	yield := func(l *State) int {
+		for {
+			l.Yield(0)
+		}
+	}
+	cos := []*State{}
+	for i := 0; i < 3; i++ {
+		co := l.NewThread()
+		co.Push(yield)
+		_, err := co.Resume(l, 0)
+		assert(t, err == nil, "Unexpected error: ", err)
+		assert(t, co.Status() == ThreadSuspended, "Thread not suspended.")
+		cos = append(cos, co)
+	}
+	l.NewThread() // Never started, so there is nothing to stop.
+	l.Pop(4)
+
+	// Close can't be called from a running thread.
+	var cerr error
+	co := l.NewThread()
+	l.Pop(1)
+	co.Push(func(l *State) int {
+		cerr = l.Protect(l.Close)
+		return 0
+	})
+	_, err := co.Resume(l, 0)
+	assert(t, err == nil, "Unexpected error: ", err)
+	assert(t, cerr != nil, "Close from inside a running thread did not raise an error.")
+	assert(t, cos[0].Status() == ThreadSuspended, "Thread stopped by failed Close.")
+
+	l.Close()
+	for _, co := range cos {
+		assert(t, co.Status() == ThreadDead, "Thread not stopped.")
+	}
+	assert(t, len(l.threads) == 0, "Stopped threads still tracked.")
+
+	_, err = cos[0].Resume(l, 0)
+	assert(t, err != nil, "Resuming a stopped thread did not return an error.")
+}
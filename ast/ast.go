@@ -322,7 +322,9 @@ func Walk(v Visitor, n Node) {
 			Walk(v, nnn)
 		}
 	case *Operator:
-		Walk(v, nn.Left)
+		if nn.Left != nil {
+			Walk(v, nn.Left) // nil for unary operators
+		}
 		Walk(v, nn.Right)
 	case *FuncCall:
 		if nn.Receiver != nil {
@@ -338,7 +340,9 @@ func Walk(v Visitor, n Node) {
 		}
 	case *TableConstructor:
 		for _, nnn := range nn.Keys {
-			Walk(v, nnn)
+			if nnn != nil {
+				Walk(v, nnn) // nil for items without a key
+			}
 		}
 		for _, nnn := range nn.Vals {
 			Walk(v, nnn)
@@ -355,6 +359,7 @@ func Walk(v Visitor, n Node) {
 	case *ConstBool:
 	case *ConstNil:
 	case *ConstVariadic:
+	case *Comment:
 	default:
 		panic("IMPOSSIBLE")
 	}
@@ -57,7 +57,7 @@ const (
 	tknTrue
 	tknFalse
 	tknNil
-	tknContinue // Not used by the default parser.
+	tknContinue // Only a keyword if ParseOptions.Continue is set.
 
 	// Operators
 	tknAdd         // +
@@ -158,6 +158,8 @@ type lexer struct {
 
 	strdepth int
 	objdepth int
+
+	continueKw bool // If false `continue` is a name.
 }
 
 // Returns a new Lua lexer.
@@ -391,7 +393,11 @@ func (lex *lexer) advance() {
 			}
 
 			ident := string(lex.lexeme)
-			lex.exlook = &token{ident, keyword(ident), lex.tokenline, lex.tokencol}
+			typ := keyword(ident)
+			if typ == tknContinue && !lex.continueKw {
+				typ = tknName
+			}
+			lex.exlook = &token{ident, typ, lex.tokenline, lex.tokencol}
 		} else if lex.matchNumeric() {
 			lex.matchNumber()
 		} else {
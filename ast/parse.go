@@ -31,11 +31,24 @@ type parser struct {
 	l *lexer
 }
 
+// ParseOptions selects the language extensions Parse should accept. The zero value is plain Lua 5.3.
+type ParseOptions struct {
+	// Make `continue` a keyword. A continue statement jumps to the end of the innermost loop, like a `goto` to a
+	// label at the end of the loop body. Without this `continue` is a normal name.
+	Continue bool
+}
+
 // Parse reads Lua source into an AST using the types in this package.
 func Parse(source string, line int) (block []Stmt, err error) {
+	return ParseWithOptions(source, line, ParseOptions{})
+}
+
+// ParseWithOptions is Parse with support for some language extensions.
+func ParseWithOptions(source string, line int, opts ParseOptions) (block []Stmt, err error) {
 	p := &parser{
 		l: newLexer(source, line),
 	}
+	p.l.continueKw = opts.Continue
 
 	defer func() {
 		if x := recover(); x != nil {
@@ -289,7 +302,7 @@ func (p *parser) statement() Stmt {
 		p.l.getCurrent(tknDblColon)
 		line := p.l.current.Line
 		col := p.l.current.Col
-		p.l.getCurrent(tknName)
+		p.l.getCurrent(tknName, tknContinue) // So `goto continue` works with the continue extension.
 		lbl := p.l.current.Lexeme
 		p.l.getCurrent(tknDblColon)
 		return stmtInfo(&Label{Label: lbl}, line, col)
@@ -316,7 +329,7 @@ func (p *parser) statement() Stmt {
 		p.l.getCurrent(tknGoto)
 		line := p.l.current.Line
 		col := p.l.current.Col
-		p.l.getCurrent(tknName)
+		p.l.getCurrent(tknName, tknContinue)
 		return stmtInfo(&Goto{Label: p.l.current.Lexeme}, line, col)
 	case tknOParen:
 		p.l.getCurrent(tknOParen)
@@ -347,5 +360,4 @@ func (p *parser) statement() Stmt {
 			Values:  vals,
 		}, line, col)
 	}
-	panic("UNREACHABLE")
 }
@@ -98,8 +98,8 @@ type Goto struct {
 	stmtBase
 
 	// True if this Goto is actually a break statement. There is no matching label.
-	// If Label is not "break" then this is actually a continue statement (a custom
-	// extension that the default lexer/parser does not use).
+	// IsContinue is the same thing for continue statements (an extension that is only
+	// parsed if ParseOptions.Continue is set).
 	IsBreak    bool   `json:"is_break"`
 	IsContinue bool   `json:"is_continue"`
 	Label      string `json:"label"`
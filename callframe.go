@@ -28,7 +28,10 @@ type callFrame struct {
 	fn  *function
 	stk *stack
 
-	pc int32
+	pc    int32
+	oldpc int32 // The last pc a line hook was checked for, see debug.go
+
+	tailCall bool // Was this frame reused for a tail call?
 
 	base int // The index of the last item from the previous frame (-1 if this is the first frame)
 
@@ -87,13 +90,18 @@ func (cf *callFrame) reqNxtOp(op opCode) instruction {
 }
 
 func (cf *callFrame) getUp(i int) value {
+	return cf.getUpT(i).value()
+}
+
+// getUpT is getUp without converting the result to a plain value.
+func (cf *callFrame) getUpT(i int) tvalue {
 	if i < 0 || i >= len(cf.fn.up) {
 		luautil.Raise("Attempt to get out of range upvalue!", luautil.ErrTypMajorInternal)
 	}
 
 	def := cf.fn.up[i]
 	if def.isLocal && !def.closed {
-		return cf.stk.GetAbs(def.absIdx)
+		return def.stk.GetAbsT(def.absIdx)
 	}
 	if !def.closed {
 		panic("IMPOSSIBLE")
@@ -102,13 +110,18 @@ func (cf *callFrame) getUp(i int) value {
 }
 
 func (cf *callFrame) setUp(i int, v value) {
+	cf.setUpT(i, tv(v))
+}
+
+// setUpT is setUp for tvalues.
+func (cf *callFrame) setUpT(i int, v tvalue) {
 	if i < 0 || i >= len(cf.fn.up) {
 		luautil.Raise("Attempt to set out of range upvalue!", luautil.ErrTypMajorInternal)
 		return
 	}
 	def := cf.fn.up[i]
 	if def.isLocal && !def.closed {
-		cf.stk.SetAbs(def.absIdx, v)
+		def.stk.SetAbsT(def.absIdx, v)
 		return
 	}
 	if !def.closed {
@@ -137,7 +150,7 @@ func (cf *callFrame) closeUpAbs(a int) {
 		}
 		//println(">   closing", nxt.absIdx)
 
-		nxt.val = cf.stk.GetAbs(nxt.absIdx)
+		nxt.val = cf.stk.GetAbsT(nxt.absIdx)
 		nxt.closed = true
 		nxt = nxt.next
 	}
@@ -168,6 +181,7 @@ func (cf *callFrame) findUp(def upDef) *upValue {
 			// This can only happen on the very first iteration, so check it last.
 			up := def.makeUp()
 			up.absIdx = idx
+			up.stk = cf.stk
 
 			cf.stk.unclosed = up
 			return up
@@ -178,6 +192,7 @@ func (cf *callFrame) findUp(def upDef) *upValue {
 			// New item should be inserted just before this item
 			up := def.makeUp()
 			up.absIdx = idx
+			up.stk = cf.stk
 
 			if pnode == nil {
 				up.next = node
@@ -191,6 +206,7 @@ func (cf *callFrame) findUp(def upDef) *upValue {
 			// If item should be added to the end of the list
 			up := def.makeUp()
 			up.absIdx = idx
+			up.stk = cf.stk
 
 			node.next = up
 			return up
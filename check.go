@@ -0,0 +1,184 @@
+/*
+Copyright 2016-2017 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua
+
+import "fmt"
+
+import "github.com/milochristiansen/lua/luautil"
+
+// Helpers for native functions that need to check their arguments.
+//
+// All of these functions take an argument number (the index of the argument on the stack) and raise an error with
+// the same message the reference implementation would use if the argument is not acceptable, for example:
+//	bad argument #2 to 'sub' (number expected, got table)
+// The function name is found by looking at how the running function was called, so it is only available if it
+// was called from Lua code (otherwise it is '?').
+
+// ArgError raises an error about the n'th argument of the running native function, formatted the same way the
+// reference implementation does it:
+//
+//	bad argument #n to 'name' (msg)
+//
+// If the function was called as a method the self argument is not counted.
+func (l *State) ArgError(n int, msg string) {
+	if n < 0 && n > RegistryIndex {
+		n = l.AbsIndex(n)
+	}
+
+	name, what := l.funcName(len(l.stack.frames) - 1)
+	if what == "method" {
+		n--
+		if n == 0 {
+			luautil.Raise(fmt.Sprintf("calling '%v' on bad self (%v)", name, msg), luautil.ErrTypGenRuntime)
+		}
+	}
+	if name == "" {
+		name = "?"
+	}
+	luautil.Raise(fmt.Sprintf("bad argument #%v to '%v' (%v)", n, name, msg), luautil.ErrTypGenRuntime)
+}
+
+// typeError raises an ArgError for the n'th argument saying that a value of the type named by expected was
+// required.
+func (l *State) typeError(n int, expected string) {
+	l.ArgError(n, fmt.Sprintf("%v expected, got %v", expected, l.typeName(n)))
+}
+
+// typeName returns the name of the type of the value at the given index for use in error messages. Values with a
+// metatable that has a string __name field use that name, and missing arguments are "no value".
+func (l *State) typeName(i int) string {
+	if i > 0 && i > l.AbsIndex(-1) {
+		return "no value"
+	}
+
+	v := l.get(i)
+	if meta := l.getMetaTable(v); meta != nil {
+		if name, ok := meta.GetRaw("__name").(string); ok {
+			return name
+		}
+	}
+	return typeOf(v).String()
+}
+
+// CheckAny raises an error if the n'th argument does not exist. nil is a perfectly good value, the argument
+// just has to be there.
+func (l *State) CheckAny(n int) {
+	if n > l.AbsIndex(-1) {
+		l.ArgError(n, "value expected")
+	}
+}
+
+// CheckType raises an error if the n'th argument is not of the given type.
+func (l *State) CheckType(n int, typ TypeID) {
+	if l.TypeOf(n) != typ {
+		l.typeError(n, typ.String())
+	}
+}
+
+// CheckTable raises an error if the n'th argument is not a table.
+func (l *State) CheckTable(n int) {
+	l.CheckType(n, TypTable)
+}
+
+// CheckNumber returns the n'th argument as a float. Strings that can be converted to numbers are accepted,
+// anything else raises an error.
+func (l *State) CheckNumber(n int) float64 {
+	f, ok := tryFloat(l.get(n))
+	if !ok {
+		l.typeError(n, "number")
+	}
+	return f
+}
+
+// CheckInt returns the n'th argument as an integer. Floats with an exact integer representation and strings that
+// can be converted to such numbers are accepted, anything else raises an error.
+func (l *State) CheckInt(n int) int64 {
+	v := l.get(n)
+	if i, ok := tryInt(v); ok {
+		return i
+	}
+	if f, ok := tryFloat(v); ok {
+		if i := int64(f); float64(i) == f {
+			return i
+		}
+		l.ArgError(n, "number has no integer representation")
+	}
+	l.typeError(n, "number")
+	return 0
+}
+
+// CheckString returns the n'th argument as a string. Numbers are converted to strings, anything else raises an
+// error (__tostring meta methods are not used).
+func (l *State) CheckString(n int) string {
+	switch v := l.get(n).(type) {
+	case string:
+		return v
+	case int64, float64:
+		return toString(v)
+	}
+	l.typeError(n, "string")
+	return ""
+}
+
+// CheckOptNumber is the same as CheckNumber, except the given default is returned if the n'th argument is nil or
+// missing.
+func (l *State) CheckOptNumber(n int, d float64) float64 {
+	if l.IsNil(n) {
+		return d
+	}
+	return l.CheckNumber(n)
+}
+
+// CheckOptInt is the same as CheckInt, except the given default is returned if the n'th argument is nil or missing.
+func (l *State) CheckOptInt(n int, d int64) int64 {
+	if l.IsNil(n) {
+		return d
+	}
+	return l.CheckInt(n)
+}
+
+// CheckOptString is the same as CheckString, except the given default is returned if the n'th argument is nil or
+// missing.
+func (l *State) CheckOptString(n int, d string) string {
+	if l.IsNil(n) {
+		return d
+	}
+	return l.CheckString(n)
+}
+
+// CheckOption reads the n'th argument as a string and returns its index in opts. If the argument is nil or missing
+// and def is not empty def is used instead. If the string is not in opts an error is raised.
+func (l *State) CheckOption(n int, def string, opts []string) int {
+	name := def
+	if def == "" || !l.IsNil(n) {
+		name = l.CheckString(n)
+	}
+
+	for i, opt := range opts {
+		if opt == name {
+			return i
+		}
+	}
+	l.ArgError(n, fmt.Sprintf("invalid option '%v'", name))
+	return -1
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2016-2017 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua
+
+import "io"
+import "io/ioutil"
+
+import "github.com/milochristiansen/lua/luautil"
+
+// Chunk is a compiled chunk of Lua code that is not tied to any particular State.
+//
+// Compiling a chunk is by far the most expensive part of loading it, so if you need to run the same
+// code in lots of States you should compile it once with Compile and then use State.PushChunk to
+// load it into each State.
+//
+// A Chunk is never modified after it is created, so it is safe to use a single Chunk from as many
+// goroutines as you like.
+type Chunk struct {
+	proto *funcProto
+}
+
+// Options controls how source code is compiled, see CompileOptions and State.LoadTextOptions. The zero value
+// gives you the same thing as Compile and State.LoadText.
+type Options struct {
+	// Run a peephole optimizer over the generated code. This removes jumps to jumps, jumps to the next instruction,
+	// dead code, and redundant MOVE and LOADNIL instructions, and sets the stack size of each function to what it
+	// actually uses. The debug info is kept correct, so error messages and hooks work just the same.
+	//
+	// The optimizer is off by default simply because it makes compiling a little slower. Use State.ListFunc to see
+	// what it does to your code.
+	Optimize bool
+
+	// Allow `continue` statements in loops. This makes `continue` a keyword, so code that uses it as a name will not
+	// compile! Only set this for your own scripts, third-party code expects plain Lua 5.3.
+	Continue bool
+
+	// Leave out the debug info (line numbers and the names of locals and upvalues), like `luac -s`. This saves some
+	// memory, but error messages and stack traces will be much less helpful.
+	StripDebug bool
+}
+
+// Compile compiles Lua source code into a Chunk.
+//
+// This uses the same compiler as State.LoadText.
+func Compile(in io.Reader, name string) (*Chunk, error) {
+	return CompileOptions(in, name, Options{})
+}
+
+// CompileOptions is Compile with some extra options.
+func CompileOptions(in io.Reader, name string, opts Options) (*Chunk, error) {
+	source, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+	proto, err := compSource(string(source), name, 1, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Chunk{proto: proto}, nil
+}
+
+// Name returns the name the chunk was compiled with.
+func (c *Chunk) Name() string {
+	return c.proto.source
+}
+
+// PushChunk creates a new function from a compiled chunk and pushes it onto the stack.
+// If there is an error it is returned and nothing is pushed.
+// Set env to 0 to use the default environment.
+func (l *State) PushChunk(c *Chunk, env int) error {
+	envv := l.global
+	if env != 0 {
+		ok := false
+		envv, ok = l.get(env).(*table)
+		if !ok {
+			return luautil.Error{Msg: "Value used as environment is not a table.", Type: luautil.ErrTypGenRuntime}
+		}
+	}
+
+	l.stack.Push(l.asFunc(c.proto, envv))
+	return nil
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2016-2017 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua_test
+
+import "testing"
+import "strings"
+import "sync"
+
+import "github.com/milochristiansen/lua"
+import "github.com/milochristiansen/lua/testhelp"
+
+const chunkScript = `local n = ...
+local t = {}
+for i = 1, n do
+	t[i] = i * i
+end
+counter = (counter or 0) + 1
+return #t, t[n], counter`
+
+func TestChunk(t *testing.T) {
+	c, err := lua.Compile(strings.NewReader(chunkScript), "chunk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testhelp.Assertf(t, c.Name() == "chunk", "Unexpected name: %q", c.Name())
+
+	// Run the same chunk in lots of States at once.
+	var wg sync.WaitGroup
+	errs := make(chan string, 20)
+	for i := 1; i <= 20; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			l := testhelp.MkState()
+			for j := 1; j <= 2; j++ {
+				if err := l.PushChunk(c, 0); err != nil {
+					errs <- err.Error()
+					return
+				}
+				l.Push(n)
+				if err := l.PCall(1, 3); err != nil {
+					errs <- err.Error()
+					return
+				}
+				if l.ToInt(-3) != int64(n) || l.ToInt(-2) != int64(n*n) || l.ToInt(-1) != int64(j) {
+					errs <- "unexpected results"
+					return
+				}
+				l.Pop(3)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// Custom environment
+	l := testhelp.MkState()
+	l.NewTable(0, 0)
+	err = l.PushChunk(c, -1)
+	testhelp.Assertf(t, err == nil, "Unexpected error: %v", err)
+	l.Push(1)
+	l.Call(1, 3)
+	testhelp.Assertf(t, l.ToInt(-1) == 1, "Unexpected counter: %v", l.ToInt(-1))
+	l.Push("counter")
+	l.GetTable(lua.GlobalsIndex)
+	testhelp.Assertf(t, l.IsNil(-1), "Custom environment leaked into globals.")
+	l.Pop(4)
+
+	l.Push(5)
+	err = l.PushChunk(c, -1)
+	testhelp.Assertf(t, err != nil, "Non-table environment not caught.")
+
+	_, err = lua.Compile(strings.NewReader("x = = 1"), "bad")
+	testhelp.Assertf(t, err != nil, "Syntax error not caught.")
+}
+
+func TestCompileOptions(t *testing.T) {
+	const src = `
+local s = 0
+for i = 1, 10 do
+	if i % 2 == 0 then continue end
+	s = s + i
+end
+local n = 0
+repeat
+	n = n + 1
+	if n > 3 then continue end
+	s = s + 100
+until n == 10
+return s`
+
+	// continue is only a keyword if asked for.
+	_, err := lua.Compile(strings.NewReader(src), "continue")
+	testhelp.Assertf(t, err != nil, "continue statement compiled without Options.Continue.")
+
+	l := testhelp.MkState()
+	testhelp.AssertBlock(t, l, `local continue = 1; ::continue::; return continue`, 1)
+
+	err = l.LoadTextOptions(strings.NewReader(src), "continue", 0, lua.Options{Continue: true})
+	testhelp.Assertf(t, err == nil, "Unexpected error: %v", err)
+	l.Call(0, 1)
+	testhelp.Assertf(t, l.ToInt(-1) == 325, "Unexpected result: %v", l.ToInt(-1))
+	l.Pop(1)
+
+	err = l.LoadTextOptions(strings.NewReader("continue"), "continue", 0, lua.Options{Continue: true})
+	testhelp.Assertf(t, err != nil, "continue outside of a loop not caught.")
+
+	// LoadText, and so load, use the State's options.
+	l2 := testhelp.MkState()
+	l2.Options.Continue = true
+	testhelp.AssertBlock(t, l2, "return load([==["+src+"]==])()", 325)
+
+	// Stripped chunks still work, but errors have no line numbers.
+	const bad = "local x = 1\nlocal y = nil + x"
+	err = l.LoadTextOptions(strings.NewReader(bad), "strip", 0, lua.Options{})
+	testhelp.Assertf(t, err == nil, "Unexpected error: %v", err)
+	err = l.PCall(0, 0)
+	testhelp.Assertf(t, err != nil && strings.Contains(err.Error(), "strip:2:"), "Unexpected error: %v", err)
+
+	err = l.LoadTextOptions(strings.NewReader(bad), "strip", 0, lua.Options{StripDebug: true, Optimize: true})
+	testhelp.Assertf(t, err == nil, "Unexpected error: %v", err)
+	err = l.PCall(0, 0)
+	testhelp.Assertf(t, err != nil && !strings.Contains(err.Error(), "strip:2:"), "Unexpected error: %v", err)
+}
@@ -45,6 +45,10 @@ type compState struct {
 	continues []patchList
 	blocks    []*blockStuff
 	locals    []int // local index -> register
+
+	// Constant propagation, see compile_fold.go
+	assigned map[string]bool // Names that are assigned to somewhere in this function (or a function inside it).
+	consts   map[int]value   // local index -> value, for locals that always hold a constant.
 }
 
 type localPatchList []int
@@ -93,13 +97,14 @@ func (state *compState) constRK(val value) int {
 // Returns a valid index for the given constant.
 // val MUST be an int64, float64, bool, nil, or string!
 func (state *compState) constK(val value) int {
+	tval := tv(val)
 	for i, v := range state.f.constants {
-		if val == v {
+		if tval == v {
 			return i
 		}
 	}
 	at := len(state.f.constants)
-	state.f.constants = append(state.f.constants, val)
+	state.f.constants = append(state.f.constants, tval)
 	return at
 }
 
@@ -108,18 +113,28 @@ type jumpDat struct {
 	pc    int
 	regs  int
 	line  int
+
+	// For gotos, the number of locals that are still in scope at the label's level. This starts as regs, and is
+	// lowered as the goto is moved out of blocks (the locals of those blocks are not in scope at the label).
+	scope int
 }
 
 func (from jumpDat) patch(f *funcProto, to jumpDat) {
-	if from.regs < to.regs {
-		luautil.Raise(fmt.Sprintf("Unconditional jump on line %v (to line %v) into the scope of one or more local variables", from.line, to.line), luautil.ErrTypGenSyntax) // TODO: Better errors
+	if from.scope < to.regs {
+		luautil.Raise(fmt.Sprintf("Goto %q on line %v jumps into the scope of one or more local variables (label on line %v)", from.label, from.line, to.line), luautil.ErrTypGenSyntax)
 	}
 
+	// If the jump leaves the scope of any locals make sure their upvalues are closed, this is what makes backward
+	// gotos create fresh locals each time around.
+	if from.regs > to.regs {
+		f.code[from.pc].setA(to.regs + 1)
+	}
 	f.code[from.pc].setSBx(mkoffset(from.pc, to.pc))
 }
 
 type blockStuff struct {
-	bpc int
+	bpc  int
+	regs int // The number of active locals when the block was entered.
 
 	labels []jumpDat
 	gotos  map[string][]jumpDat
@@ -144,7 +159,7 @@ func (p patchList) loop(f *funcProto, pc, reg int) {
 	}
 }
 
-func compSource(source, name string, line int) (f *funcProto, err error) {
+func compSource(source, name string, line int, opts Options) (f *funcProto, err error) {
 	// Quick-and-dirty error trapping.
 	defer func() {
 		if x := recover(); x != nil {
@@ -165,11 +180,31 @@ func compSource(source, name string, line int) (f *funcProto, err error) {
 	}()
 	//_ = fmt.Print
 
-	block, err := ast.Parse(source, line)
+	block, err := ast.ParseWithOptions(source, line, ast.ParseOptions{Continue: opts.Continue})
 	if err != nil {
 		return nil, err
 	}
-	return compile(&ast.FuncDecl{Source: name, IsVariadic: true, Block: block}, nil), nil
+	f = compile(&ast.FuncDecl{Source: name, IsVariadic: true, Block: block}, nil)
+	if opts.Optimize {
+		optimize(f)
+	}
+	if opts.StripDebug {
+		stripDebug(f)
+	}
+	return f, nil
+}
+
+// stripDebug removes the line info, local variable names, and upvalue names from a function and all the functions
+// it contains, the same things `luac -s` strips.
+func stripDebug(f *funcProto) {
+	f.lineInfo = nil
+	f.localVars = nil
+	for i := range f.upVals {
+		f.upVals[i].name = ""
+	}
+	for i := range f.prototypes {
+		stripDebug(&f.prototypes[i])
+	}
 }
 
 func compile(f *ast.FuncDecl, parent *compState) *funcProto {
@@ -190,6 +225,9 @@ func compile(f *ast.FuncDecl, parent *compState) *funcProto {
 			parameterCount: len(f.Params),
 		},
 		p: parent,
+
+		assigned: assignedNames(f.Block),
+		consts:   map[int]value{},
 	}
 
 	if f.IsVariadic {
@@ -229,7 +267,7 @@ func prepBlock(state *compState) {
 	// end value.
 	// Locals that are in scope are guaranteed to have a sPC that is greater than
 	// their ePC.
-	sliceutil.Push(&state.blocks, &blockStuff{bpc: len(state.f.code) - 1, gotos: map[string][]jumpDat{}})
+	sliceutil.Push(&state.blocks, &blockStuff{bpc: len(state.f.code) - 1, regs: state.nextReg, gotos: map[string][]jumpDat{}})
 }
 
 func preppedBlock(block []ast.Stmt, state *compState, epilogue int) {
@@ -237,6 +275,25 @@ func preppedBlock(block []ast.Stmt, state *compState, epilogue int) {
 		statement(n, state)
 	}
 
+	// Labels at the very end of a block act as if the block's locals are already out of scope, so you can jump
+	// forward to them past local declarations (for example to implement `continue` with `goto`). repeat-until
+	// does not use this function, since the condition can still see the locals.
+	stuff := sliceutil.Top(&state.blocks).(*blockStuff)
+	for i := len(block) - 1; i >= 0; i-- {
+		if d, ok := block[i].(*ast.DoBlock); ok && len(d.Block) == 0 {
+			continue // `;`
+		}
+		l, ok := block[i].(*ast.Label)
+		if !ok {
+			break
+		}
+		for j := range stuff.labels {
+			if stuff.labels[j].label == l.Label {
+				stuff.labels[j].regs = stuff.regs
+			}
+		}
+	}
+
 	closeBlock(block, state, epilogue, 0)
 }
 
@@ -292,9 +349,15 @@ func closeBlock(block []ast.Stmt, state *compState, epilogue, off int) {
 		return
 	}
 
-	// Promote any unresolved gotos in this block to the next block up
+	// Promote any unresolved gotos in this block to the next block up, none of this block's locals are in scope
+	// for the labels they may find there.
 	pstuff := sliceutil.Top(&state.blocks).(*blockStuff)
 	for t, ts := range stuff.gotos {
+		for i := range ts {
+			if ts[i].scope > state.nextReg {
+				ts[i].scope = state.nextReg
+			}
+		}
 		pstuff.gotos[t] = append(pstuff.gotos[t], ts...)
 	}
 }
@@ -308,6 +371,7 @@ func statement(n ast.Stmt, state *compState) {
 			} else {
 				exprlist(nn.Values, state, state.nextReg, len(nn.Targets))
 			}
+			consts := localConsts(nn, state)
 
 			// Don't actually create the locals until they are all set, that way they are not available
 			// inside their own initialization expressions.
@@ -322,6 +386,9 @@ func statement(n ast.Stmt, state *compState) {
 				// Since I already search the variable list in reverse order all I need to do
 				// is blindly declare the "new" variable.
 				state.mklocal(n.Value, 0)
+				if v, ok := consts[n]; ok {
+					state.consts[len(state.f.localVars)-1] = v
+				}
 			}
 			return
 		}
@@ -336,7 +403,7 @@ func statement(n ast.Stmt, state *compState) {
 			}
 			reg := state.nextReg
 			state.mklocal(n.Value, 0)
-			expr(nn.Values[0], state, reg, false).To(false)
+			expr(nn.Values[0], state, reg).To(false)
 			return
 		}
 
@@ -424,7 +491,7 @@ func statement(n ast.Stmt, state *compState) {
 		//req := len(nn.Targets)
 		//for i, e := range nn.Values {
 		//	if i == len(nn.Values)-1 {
-		//		ex := expr(e, state, nextTemp, false)
+		//		ex := expr(e, state, nextTemp)
 		//		if req > 1 {
 		//			ex.To(false)
 		//			ex.setResults(req)
@@ -435,7 +502,7 @@ func statement(n ast.Stmt, state *compState) {
 		//		results = append(results, r)
 		//		break
 		//	}
-		//	r, u := expr(e, state, nextTemp, false).RK()
+		//	r, u := expr(e, state, nextTemp).RK()
 		//	results = append(results, r)
 		//	if u {
 		//		nextTemp++
@@ -457,7 +524,7 @@ func statement(n ast.Stmt, state *compState) {
 	case *ast.DoBlock:
 		block(nn.Block, state)
 	case *ast.If:
-		list, k := expr(nn.Cond, state, state.nextReg, false).Bool()
+		list, k := expr(nn.Cond, state, state.nextReg).Bool()
 		if list == nil {
 			if k {
 				block(nn.Then, state)
@@ -483,7 +550,7 @@ func statement(n ast.Stmt, state *compState) {
 		}
 	case *ast.WhileLoop:
 		begin := len(state.f.code)
-		list, k := expr(nn.Cond, state, state.nextReg, false).Bool()
+		list, k := expr(nn.Cond, state, state.nextReg).Bool()
 		if list == nil && !k {
 			return
 		}
@@ -509,7 +576,7 @@ func statement(n ast.Stmt, state *compState) {
 			statement(n, state)
 		}
 		sliceutil.Pop(&state.continues).(patchList).loop(state.f, len(state.f.code), state.nextReg+1)
-		list, k := expr(nn.Cond, state, state.nextReg, false).Bool()
+		list, k := expr(nn.Cond, state, state.nextReg).Bool()
 		if list == nil {
 			if k {
 				closeBlock(nn.Block, state, 0, 0)
@@ -529,11 +596,11 @@ func statement(n ast.Stmt, state *compState) {
 		pl = state.mklocaladv("(for limit)", pl)
 		pl = state.mklocaladv("(for step)", pl)
 		pl = state.mklocaladv(nn.Counter, pl)
-		expr(nn.Init, state, nreg, false).To(false)
+		expr(nn.Init, state, nreg).To(false)
 		nreg++
-		expr(nn.Limit, state, nreg, false).To(false)
+		expr(nn.Limit, state, nreg).To(false)
 		nreg++
-		expr(nn.Step, state, nreg, false).To(false)
+		expr(nn.Step, state, nreg).To(false)
 		pl.patch(state.f, 1)
 		prep := patchList([]int{len(state.f.code)})
 		state.addInst(createAsBx(opForPrep, initReg, 0), nn.Line())
@@ -570,11 +637,11 @@ func statement(n ast.Stmt, state *compState) {
 		sliceutil.Pop(&state.breaks).(patchList).loop(state.f, len(state.f.code), state.nextReg+1)
 		begin.patch(state.f, lbottom-1)
 	case *ast.Goto:
-		if nn.IsBreak {
+		if nn.IsBreak || nn.IsContinue {
 			if len(state.breaks) == 0 {
 				luautil.Raise(fmt.Sprintf("Break or continue statement on line %v outside of loop", nn.Line()), luautil.ErrTypGenSyntax) // TODO: Better errors
 			}
-			if nn.Label == "break" {
+			if !nn.IsContinue {
 				l := len(state.breaks) - 1
 				state.breaks[l] = append(state.breaks[l], len(state.f.code))
 				state.addInst(createAsBx(opJump, 0, 0), nn.Line())
@@ -592,10 +659,16 @@ func statement(n ast.Stmt, state *compState) {
 			pc:    len(state.f.code),
 			regs:  state.nextReg,
 			line:  nn.Line(),
+			scope: state.nextReg,
 		})
 		state.addInst(createAsBx(opJump, 0, 0), nn.Line())
 	case *ast.Label:
 		stuff := sliceutil.Top(&state.blocks).(*blockStuff)
+		for _, l := range stuff.labels {
+			if l.label == nn.Label {
+				luautil.Raise(fmt.Sprintf("Label %q on line %v already defined on line %v", nn.Label, nn.Line(), l.line), luautil.ErrTypGenSyntax)
+			}
+		}
 		stuff.labels = append(stuff.labels, jumpDat{
 			label: nn.Label,
 			pc:    len(state.f.code),
@@ -615,7 +688,7 @@ func statement(n ast.Stmt, state *compState) {
 		}
 
 		for i, e := range nn.Items {
-			ex := expr(e, state, nreg, false)
+			ex := expr(e, state, nreg)
 			if i == len(nn.Items)-1 && ex.mayMulti {
 				ex.setResults(-1)
 				items = 0
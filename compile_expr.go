@@ -154,8 +154,8 @@ func lowerIdent(n ast.Expr, state *compState, reg int) (identData, int) {
 		switch nObj := nn.Obj.(type) {
 		case *ast.TableAccessor:
 			lowerIdentHelper(nObj, state, data)
-			data.keyRK, _ = expr(nn.Key, state, reg+1, false).RK()
-			return *data, 1
+			data.keyRK, _ = expr(nn.Key, state, reg+1).RK()
+			return *data, keyRegs(data, reg)
 		case *ast.ConstIdent:
 			typ, idx := resolveVar(nObj.Value, state)
 			switch typ {
@@ -179,16 +179,16 @@ func lowerIdent(n ast.Expr, state *compState, reg int) (identData, int) {
 				keyReg = reg
 				regs = 1
 			}
-			data.keyRK, _ = expr(nn.Key, state, keyReg, false).RK()
+			data.keyRK, _ = expr(nn.Key, state, keyReg).RK()
 			return *data, regs
 		case *ast.Parens:
-			expr(nObj.Inner, state, data.reg, false).To(false)
-			data.keyRK, _ = expr(nn.Key, state, reg+1, false).RK()
-			return *data, 1
+			expr(nObj.Inner, state, data.reg).To(false)
+			data.keyRK, _ = expr(nn.Key, state, reg+1).RK()
+			return *data, keyRegs(data, reg)
 		case *ast.FuncCall:
-			expr(nObj, state, data.reg, false).To(false)
-			data.keyRK, _ = expr(nn.Key, state, reg+1, false).RK()
-			return *data, 1
+			expr(nObj, state, data.reg).To(false)
+			data.keyRK, _ = expr(nn.Key, state, reg+1).RK()
+			return *data, keyRegs(data, reg)
 		default:
 			luautil.Raise("Syntax error", luautil.ErrTypGenSyntax) // TODO: Better errors
 		}
@@ -220,17 +220,26 @@ func lowerIdent(n ast.Expr, state *compState, reg int) (identData, int) {
 	}
 }
 
+// keyRegs returns the number of registers used by a lowered table accessor that holds its table in reg: 2 if the
+// key was placed in the register after the table, else 1.
+func keyRegs(data *identData, reg int) int {
+	if data.keyRK == reg+1 {
+		return 2
+	}
+	return 1
+}
+
 func lowerIdentHelper(n *ast.TableAccessor, state *compState, data *identData) {
 	switch nObj := n.Obj.(type) {
 	case *ast.TableAccessor:
 		lowerIdentHelper(nObj, state, data)
-		rk, _ := expr(n.Key, state, data.reg+1, false).RK()
+		rk, _ := expr(n.Key, state, data.reg+1).RK()
 		state.addInst(createABC(opGetTable, data.reg, data.reg, rk), n.Key.Line())
 	case *ast.ConstIdent:
 		typ, idx := resolveVar(nObj.Value, state)
 		switch typ {
 		case 0:
-			rk, _ := expr(n.Key, state, data.reg+1, false).RK()
+			rk, _ := expr(n.Key, state, data.reg+1).RK()
 			state.addInst(createABC(opGetTable, data.reg, idx, rk), n.Key.Line())
 		case 1:
 			etyp, eidx := resolveVar("_ENV", state)
@@ -240,16 +249,20 @@ func lowerIdentHelper(n *ast.TableAccessor, state *compState, data *identData) {
 				//state.addInst(createABC(opGetTableUp, data.reg, 0 /*_ENV*/, state.constRK(nObj.Value)), nObj.Line())
 				state.addInst(createABC(opGetTableUp, data.reg, eidx, state.constRK(nObj.Value)), nObj.Line())
 			}
-			rk, _ := expr(n.Key, state, data.reg+1, false).RK()
-			state.f.code = append(state.f.code, createABC(opGetTable, data.reg, data.reg, rk))
+			rk, _ := expr(n.Key, state, data.reg+1).RK()
+			state.addInst(createABC(opGetTable, data.reg, data.reg, rk), n.Key.Line())
 		case 2:
-			rk, _ := expr(n.Key, state, data.reg+1, false).RK()
+			rk, _ := expr(n.Key, state, data.reg+1).RK()
 			state.addInst(createABC(opGetTableUp, data.reg, idx, rk), n.Key.Line())
 		}
 	case *ast.Parens:
-		expr(nObj.Inner, state, data.reg, false).To(false)
+		expr(nObj.Inner, state, data.reg).To(false)
+		rk, _ := expr(n.Key, state, data.reg+1).RK()
+		state.addInst(createABC(opGetTable, data.reg, data.reg, rk), n.Key.Line())
 	case *ast.FuncCall:
-		expr(nObj, state, data.reg, false).To(false)
+		expr(nObj, state, data.reg).To(false)
+		rk, _ := expr(n.Key, state, data.reg+1).RK()
+		state.addInst(createABC(opGetTable, data.reg, data.reg, rk), n.Key.Line())
 	default:
 		panic("IMPOSSIBLE") // I think?
 	}
@@ -260,17 +273,17 @@ func compileCall(call *ast.FuncCall, state *compState, reg, rets int, tail bool)
 	reg++
 	params := 0
 	if call.Receiver != nil {
-		src, _ := expr(call.Receiver, state, f, false).To(true)
-		rk, _ := expr(call.Function, state, reg, false).RK()
+		src, _ := expr(call.Receiver, state, f).To(true)
+		rk, _ := expr(call.Function, state, reg).RK()
 		state.addInst(createABC(opSelf, f, src, rk), call.Receiver.Line())
 		params++
 		reg++
 	} else {
-		expr(call.Function, state, f, false).To(false)
+		expr(call.Function, state, f).To(false)
 	}
 
 	for i, e := range call.Args {
-		exres := expr(e, state, reg, false)
+		exres := expr(e, state, reg)
 		if i == len(call.Args)-1 && exres.mayMulti {
 			exres.setResults(-1)
 			params = -2
@@ -287,24 +300,31 @@ func compileCall(call *ast.FuncCall, state *compState, reg, rets int, tail bool)
 	state.addInst(createABC(opCall, f, params+1, rets+1), call.Line())
 }
 
-// To get better code quality I need to change how expressions are parsed.
-
+// exprData describes the result of an expression. The value may be in a register, a constant, or (for comparisons)
+// a conditional jump. On top of that an expression may have lists of jumps that are taken when it is true or false,
+// this is how `and` and `or` short circuit. These work like the jump lists in the reference compiler: a jump that
+// follows a TESTSET carries the value that was tested with it, any other jump needs a LOADBOOL at its target if the
+// value of the expression is needed.
 type exprData struct {
-	// If non-nil this expression was a boolean expression, and as such does not produce
-	// an actual value without some extra code
-	boolean  patchList
-	boolRev  bool // If true jump on true instead of false.
-	boolCanR bool // If true this boolean expression also sets reg (the value in reg may not be boolean)
+	t patchList // Jumps taken when the expression is true.
+	f patchList // Jumps taken when the expression is false.
+
+	// If true the expression is a comparison, and jump is the index of the JMP that is taken if it is true.
+	isJump bool
+	jump   int
 
 	// If true the expression resulted in a value placed in the provided register
 	register bool
 
-	// If the expression did not result in a register value and it was not a boolean
-	// expression this will be set to a constant index that holds the state.f.
+	// If the expression did not result in a register value and it was not a comparison this will be set to a
+	// constant index that holds the value.
 	// I really should use LOADBOOL and LOADNIL where possible, but this way is simpler.
 	// TODO: Issue LOADKX instructions where needed!
 	constant int
 
+	// True if the value in the register was just produced by a NOT.
+	isNot bool
+
 	// True if expression is a single function call or VARARG.
 	mayMulti   bool
 	patchMulti int // MUST be a CALL or VARARG
@@ -315,6 +335,78 @@ type exprData struct {
 	line  int
 }
 
+// noReg is used as the destination of TESTSET instructions until it is known where the value should go.
+const noReg = maxArgA
+
+// isTestOp returns true if op is one of the instructions that skip the following JMP depending on some condition.
+func isTestOp(op opCode) bool {
+	return op == OpEqual || op == OpLessThan || op == OpLessOrEqual || op == opTest || op == opTestSet
+}
+
+// control returns the index of the instruction that controls the JMP at pc (pc itself if it is unconditional).
+func control(f *funcProto, pc int) int {
+	if pc >= 1 && isTestOp(f.code[pc-1].getOpCode()) {
+		return pc - 1
+	}
+	return pc
+}
+
+// needValue returns true if any of the jumps in the list does not carry a value (is not controlled by a TESTSET).
+func (p patchList) needValue(f *funcProto) bool {
+	for _, pc := range p {
+		if f.code[control(f, pc)].getOpCode() != opTestSet {
+			return true
+		}
+	}
+	return false
+}
+
+// patchTestReg sets the destination register of the TESTSET controlling the jump at pc. If reg is noReg (the value
+// is not needed), or if the tested value is already in reg the TESTSET is changed into a TEST. Returns false if the
+// jump is not controlled by a TESTSET.
+func patchTestReg(f *funcProto, pc, reg int) bool {
+	i := &f.code[control(f, pc)]
+	if i.getOpCode() != opTestSet {
+		return false
+	}
+	if reg != noReg && reg != i.b() {
+		i.setA(reg)
+	} else {
+		*i = createABC(opTest, i.b(), 0, i.c())
+	}
+	return true
+}
+
+// patchValues points all the jumps in the list at their targets. Jumps controlled by a TESTSET store their value in
+// reg and go to vtarget, everything else goes to dtarget (which should load the right boolean into reg).
+func (p patchList) patchValues(f *funcProto, vtarget, reg, dtarget int) {
+	for _, pc := range p {
+		if patchTestReg(f, pc, reg) {
+			f.code[pc].setSBx(mkoffset(pc, vtarget))
+		} else {
+			f.code[pc].setSBx(mkoffset(pc, dtarget))
+		}
+	}
+}
+
+// removeValues changes all the TESTSETs controlling the jumps in the list into TESTs. Jump lists used as conditions
+// never need their values.
+func (p patchList) removeValues(f *funcProto) {
+	for _, pc := range p {
+		patchTestReg(f, pc, noReg)
+	}
+}
+
+// patchHere points all the jumps in the list at the next instruction, discarding any values they carry.
+func (p patchList) patchHere(f *funcProto) {
+	p.removeValues(f)
+	p.patch(f, len(f.code))
+}
+
+func (e exprData) hasJumps() bool {
+	return len(e.t) > 0 || len(e.f) > 0
+}
+
 // -1 for unlimited.
 // 0 does nothing if mayMulti is false
 // if mayMulti is false items above 1 are taken care of via an inserted LOADNIL
@@ -324,7 +416,7 @@ func (e exprData) setResults(c int) {
 		if c <= 1 {
 			return
 		}
-		state.addInst(createABC(opLoadNil, e.reg+1, c-2, 0), e.line)
+		state.addInst(createABC(opLoadNil, e.oreg+1, c-2, 0), e.line)
 		return
 	}
 	if state.f.code[e.patchMulti].getOpCode() == opCall {
@@ -337,6 +429,10 @@ func (e exprData) setResults(c int) {
 // result register, was the requested register used?
 func (e exprData) To(tryInPlace bool) (int, bool) {
 	state := e.state
+	if e.isJump || e.hasJumps() {
+		return e.toJumps(), true
+	}
+
 	switch {
 	case e.register:
 		if e.reg != e.oreg {
@@ -347,135 +443,221 @@ func (e exprData) To(tryInPlace bool) (int, bool) {
 			return e.oreg, true
 		}
 		return e.reg, true
-	case e.boolCanR:
-		e.boolean.patch(state.f, len(state.f.code))
-		if e.reg != e.oreg {
-			if tryInPlace {
-				return e.reg, false
-			}
-			state.addInst(createABC(opMove, e.oreg, e.reg, 0), e.line)
-			return e.oreg, true
-		}
-		return e.reg, true
-	case e.boolean != nil:
-		if e.boolRev {
-			state.addInst(createABC(opLoadBool, e.reg, 0, 1), e.line)
-			e.boolean.patch(state.f, len(state.f.code))
-			state.addInst(createABC(opLoadBool, e.reg, 1, 0), e.line)
-		} else {
-			state.addInst(createABC(opLoadBool, e.reg, 1, 1), e.line)
-			e.boolean.patch(state.f, len(state.f.code))
-			state.addInst(createABC(opLoadBool, e.reg, 0, 0), e.line)
-		}
-		return e.reg, true
 	default:
 		state.addInst(createABx(opLoadK, e.reg, e.constant), e.line)
 		return e.reg, true
 	}
 }
 
+// toJumps is To for expressions with jumps, the result always ends up in oreg.
+func (e exprData) toJumps() int {
+	state := e.state
+	reg := e.oreg
+
+	switch {
+	case e.isJump:
+		e.t = append(e.t, e.jump)
+	case e.register:
+		if e.reg != reg {
+			state.addInst(createABC(opMove, reg, e.reg, 0), e.line)
+		}
+	default:
+		state.addInst(createABx(opLoadK, reg, e.constant), e.line)
+	}
+
+	loadF, loadT := -1, -1
+	if e.t.needValue(state.f) || e.f.needValue(state.f) {
+		skip := patchList{}
+		if !e.isJump {
+			// Jump over the LOADBOOLs if the value was loaded above.
+			skip = append(skip, len(state.f.code))
+			state.addInst(createAsBx(opJump, 0, 0), e.line)
+		}
+		loadF = len(state.f.code)
+		state.addInst(createABC(opLoadBool, reg, 0, 1), e.line)
+		loadT = len(state.f.code)
+		state.addInst(createABC(opLoadBool, reg, 1, 0), e.line)
+		skip.patch(state.f, len(state.f.code))
+	}
+
+	end := len(state.f.code)
+	e.f.patchValues(state.f, end, reg, loadF)
+	e.t.patchValues(state.f, end, reg, loadT)
+	return reg
+}
+
 // RK of result, was the requested register used?
 func (e exprData) RK() (int, bool) {
-	state := e.state
+	if e.isJump || e.hasJumps() {
+		return e.toJumps(), true
+	}
+
 	switch {
 	case e.register:
 		if e.reg != e.oreg {
 			return e.reg, false
 		}
 		return e.reg, true
-	case e.boolCanR:
-		e.boolean.patch(state.f, len(state.f.code))
-		return e.reg, true
-	case e.boolean != nil:
-		if e.boolRev {
-			state.addInst(createABC(opLoadBool, e.reg, 0, 1), e.line)
-			e.boolean.patch(state.f, len(state.f.code))
-			state.addInst(createABC(opLoadBool, e.reg, 1, 0), e.line)
-		} else {
-			state.addInst(createABC(opLoadBool, e.reg, 1, 1), e.line)
-			e.boolean.patch(state.f, len(state.f.code))
-			state.addInst(createABC(opLoadBool, e.reg, 0, 0), e.line)
-		}
-		return e.reg, true
 	default:
 		return rkAsK(e.constant), false
 	}
 }
 
-// The caller never needs to know if boolRev is set (since that always comes from the caller they already know)
-func (e exprData) Bool() (patchList, bool) {
+// discharge makes sure a constant main value is loaded into oreg.
+func (e *exprData) discharge() {
+	if e.isJump || e.register {
+		return
+	}
+	e.state.addInst(createABx(opLoadK, e.oreg, e.constant), e.line)
+	e.register = true
+	e.reg = e.oreg
+}
+
+// jumpOnCond adds a TESTSET and a JMP that is taken if the truth of the value in register r matches cond. The
+// TESTSET's destination is filled in later, see patchTestReg.
+func (e *exprData) jumpOnCond(r int, cond bool) int {
 	state := e.state
+	c := 0
+	if cond {
+		c = 1
+	}
+
+	// If the value is from a NOT just test its operand the other way around. There is no value to carry then, but a
+	// negated value is always a boolean anyway.
+	if last := len(state.f.code) - 1; e.isNot && e.register && r == e.reg && last >= 0 {
+		if i := state.f.code[last]; i.getOpCode() == opNot && i.a() == r {
+			state.f.code[last] = createABC(opTest, i.b(), 0, c^1)
+			state.addInst(createAsBx(opJump, 0, 0), e.line)
+			return len(state.f.code) - 1
+		}
+	}
+
+	state.addInst(createABC(opTestSet, noReg, r, c), e.line)
+	state.addInst(createAsBx(opJump, 0, 0), e.line)
+	return len(state.f.code) - 1
+}
+
+// negate reverses the sense of the comparison controlling the jump at pc.
+func (e *exprData) negate(pc int) {
+	i := &e.state.f.code[pc-1]
+	i.setA(i.a() ^ 1)
+}
+
+// goIfTrue adds code that falls through if the expression is true and jumps if it is false. The jump is added to
+// the false list, and the true list is patched to the following code.
+func (e *exprData) goIfTrue() {
+	state := e.state
+	pc := -1
 	switch {
+	case e.isJump:
+		e.negate(e.jump)
+		pc = e.jump
 	case e.register:
-		state.addInst(createABC(opTest, e.reg, 0, 0), e.line)
-		f := patchList([]int{len(state.f.code)})
-		state.addInst(createAsBx(opJump, 0, 0), e.line)
-		return f, false
-	case e.boolean != nil:
-		return e.boolean, false
-	default:
-		return nil, toBool(state.f.constants[e.constant])
+		pc = e.jumpOnCond(e.reg, false)
+	case !state.f.constants[e.constant].truthy():
+		// The jump needs to carry the value, so it has to be in a register.
+		e.discharge()
+		pc = e.jumpOnCond(e.reg, false)
+	}
+	if pc != -1 {
+		e.f = append(e.f, pc)
 	}
+	e.t.patchHere(state.f)
+	e.t = nil
 }
 
-// patch, reg ok, const (only if patch == nil, reg ok is always true in this case)
-func (e exprData) BoolReg() (patchList, bool, bool) {
+// goIfFalse is the opposite of goIfTrue.
+func (e *exprData) goIfFalse() {
 	state := e.state
+	pc := -1
 	switch {
+	case e.isJump:
+		pc = e.jump
 	case e.register:
-		if e.boolRev {
-			state.addInst(createABC(opTest, e.reg, 0, 1), e.line)
-			f := patchList([]int{len(state.f.code)})
-			state.addInst(createAsBx(opJump, 0, 0), e.line)
-			return f, true, false
-		}
-		state.addInst(createABC(opTest, e.reg, 0, 0), e.line)
-		f := patchList([]int{len(state.f.code)})
-		state.addInst(createAsBx(opJump, 0, 0), e.line)
-		return f, true, false
-	case e.boolean != nil:
-		return e.boolean, false, false
-	default:
-		state.addInst(createABx(opLoadK, e.reg, e.constant), e.line)
-		return nil, true, toBool(state.f.constants[e.constant])
+		pc = e.jumpOnCond(e.reg, true)
+	case state.f.constants[e.constant].truthy():
+		// The jump needs to carry the value, so it has to be in a register.
+		e.discharge()
+		pc = e.jumpOnCond(e.reg, true)
 	}
+	if pc != -1 {
+		e.t = append(e.t, pc)
+	}
+	e.f.patchHere(state.f)
+	e.f = nil
+}
+
+// Bool compiles the expression as a condition. It returns the list of jumps that are taken if the expression is
+// false, everything else falls through. If the list is nil the expression is constant, and the bool is its value.
+func (e exprData) Bool() (patchList, bool) {
+	state := e.state
+	if !e.isJump && !e.register && !e.hasJumps() {
+		return nil, state.f.constants[e.constant].truthy()
+	}
+
+	e.goIfTrue()
+	if len(e.f) == 0 {
+		return nil, true
+	}
+	e.f.removeValues(state.f)
+	return e.f, false
 }
 
 // Handle an expression.
 // Assumes that the items above reg are available to use as temporaries.
-// boolRev reverses the sense of boolean operators (true jumps and false falls through).
-func expr(e ast.Expr, state *compState, reg int, boolRev bool) exprData {
+func expr(e ast.Expr, state *compState, reg int) exprData {
 	rtn := exprData{
-		state:   state,
-		boolRev: boolRev,
-		reg:     reg,
-		oreg:    reg,
-		line:    e.Line(),
+		state: state,
+		reg:   reg,
+		oreg:  reg,
+		line:  e.Line(),
 	}
 
 	switch ee := e.(type) {
 	case *ast.Operator:
+		// If all the operands are constants try to do the operation right now.
+		if v, ok := foldConst(ee, state); ok {
+			rtn.constant = state.constK(v)
+			return rtn
+		}
+
 		// Operator precedence is already handled by the AST, Yay!
 		switch ee.Op {
 		// Simple binary operators
 		case ast.OpAdd, ast.OpSub, ast.OpMul, ast.OpMod, ast.OpPow, ast.OpDiv, ast.OpIDiv, ast.OpBinAND, ast.OpBinOR, ast.OpBinXOR, ast.OpBinShiftL, ast.OpBinShiftR:
-			// TODO: Constant folding
-			l, lu := expr(ee.Left, state, reg, false).RK()
+			l, lu := expr(ee.Left, state, reg).RK()
 			r := reg
 			if lu {
 				r++
 			}
-			r, _ = expr(ee.Right, state, r, false).RK()
+			r, _ = expr(ee.Right, state, r).RK()
 			state.addInst(createABC(opCode(ee.Op)+OpAdd, reg, l, r), ee.Line())
 			rtn.register = true
 
 		// Simple unary operators
-		case ast.OpUMinus, ast.OpBinNot, ast.OpNot, ast.OpLength:
-			// TODO: Constant folding for OpUMinus and OpBinNot
-			v, _ := expr(ee.Right, state, reg, false).RK()
+		case ast.OpUMinus, ast.OpBinNot, ast.OpLength:
+			v, _ := expr(ee.Right, state, reg).RK()
 			state.addInst(createABC(opCode(ee.Op)+OpAdd, reg, v, 0), ee.Line())
 			rtn.register = true
 
+		// not swaps the jump lists, only the value needs an actual NOT.
+		case ast.OpNot:
+			ex := expr(ee.Right, state, reg)
+			switch {
+			case ex.isJump:
+				ex.negate(ex.jump)
+				rtn.isJump, rtn.jump = true, ex.jump
+			case ex.register:
+				state.addInst(createABC(opNot, reg, ex.reg, 0), ee.Line())
+				rtn.register = true
+				rtn.isNot = true
+			default:
+				rtn.constant = state.constK(!state.f.constants[ex.constant].truthy())
+			}
+			rtn.t, rtn.f = ex.f, ex.t
+			rtn.t.removeValues(state.f)
+			rtn.f.removeValues(state.f)
+
 		// Complex binary operators
 
 		case ast.OpConcat:
@@ -485,160 +667,61 @@ func expr(e ast.Expr, state *compState, reg int, boolRev bool) exprData {
 			en, een := e, ee
 			ok := true
 			for ok && een.Op == ast.OpConcat {
-				expr(een.Left, state, last, false).To(false)
+				expr(een.Left, state, last).To(false)
 				last++
 				en = een.Right
 				een, ok = en.(*ast.Operator)
 			}
-			expr(en, state, last, false).To(false)
+			expr(en, state, last).To(false)
 
 			state.addInst(createABC(opConcat, reg, reg, last), ee.Line())
 			rtn.register = true
 
-		// Simple Logical operators
+		// Comparisons. These leave a JMP that is taken if the comparison is true, see exprData.
 
-		case ast.OpEqual:
-			sense := 0
-			if boolRev {
-				sense = 1
-			}
-			l, lu := expr(ee.Left, state, reg, false).RK()
-			r := reg
-			if lu {
-				r++
-			}
-			r, _ = expr(ee.Right, state, r, false).RK()
-			state.addInst(createABC(OpEqual, sense, l, r), ee.Line())
-			rtn.boolean = patchList([]int{len(state.f.code)})
-			state.addInst(createAsBx(opJump, 0, 0), ee.Line())
-		case ast.OpNotEqual:
-			sense := 1
-			if boolRev {
-				sense = 0
-			}
-			l, lu := expr(ee.Left, state, reg, false).RK()
-			r := reg
-			if lu {
-				r++
-			}
-			r, _ = expr(ee.Right, state, r, false).RK()
-			state.addInst(createABC(OpEqual, sense, l, r), ee.Line())
-			rtn.boolean = patchList([]int{len(state.f.code)})
-			state.addInst(createAsBx(opJump, 0, 0), ee.Line())
-		case ast.OpLessThan:
-			sense := 0
-			if boolRev {
-				sense = 1
-			}
-			l, lu := expr(ee.Left, state, reg, false).RK()
+		case ast.OpEqual, ast.OpNotEqual, ast.OpLessThan, ast.OpLessOrEqual, ast.OpGreaterThan, ast.OpGreaterOrEqual:
+			l, lu := expr(ee.Left, state, reg).RK()
 			r := reg
 			if lu {
 				r++
 			}
-			r, _ = expr(ee.Right, state, r, false).RK()
-			state.addInst(createABC(OpLessThan, sense, l, r), ee.Line())
-			rtn.boolean = patchList([]int{len(state.f.code)})
-			state.addInst(createAsBx(opJump, 0, 0), ee.Line())
-		case ast.OpLessOrEqual:
-			sense := 0
-			if boolRev {
-				sense = 1
-			}
-			l, lu := expr(ee.Left, state, reg, false).RK()
-			r := reg
-			if lu {
-				r++
-			}
-			r, _ = expr(ee.Right, state, r, false).RK()
-			state.addInst(createABC(OpLessOrEqual, sense, l, r), ee.Line())
-			rtn.boolean = patchList([]int{len(state.f.code)})
-			state.addInst(createAsBx(opJump, 0, 0), ee.Line())
-		case ast.OpGreaterThan:
-			sense := 1
-			if boolRev {
-				sense = 0
-			}
-			l, lu := expr(ee.Left, state, reg, false).RK()
-			r := reg
-			if lu {
-				r++
+			r, _ = expr(ee.Right, state, r).RK()
+
+			// a > b is b < a and a >= b is b <= a. The operands are still evaluated in order.
+			switch ee.Op {
+			case ast.OpEqual:
+				state.addInst(createABC(OpEqual, 1, l, r), ee.Line())
+			case ast.OpNotEqual:
+				state.addInst(createABC(OpEqual, 0, l, r), ee.Line())
+			case ast.OpLessThan:
+				state.addInst(createABC(OpLessThan, 1, l, r), ee.Line())
+			case ast.OpLessOrEqual:
+				state.addInst(createABC(OpLessOrEqual, 1, l, r), ee.Line())
+			case ast.OpGreaterThan:
+				state.addInst(createABC(OpLessThan, 1, r, l), ee.Line())
+			case ast.OpGreaterOrEqual:
+				state.addInst(createABC(OpLessOrEqual, 1, r, l), ee.Line())
 			}
-			r, _ = expr(ee.Right, state, r, false).RK()
-			state.addInst(createABC(OpLessOrEqual, sense, l, r), ee.Line())
-			rtn.boolean = patchList([]int{len(state.f.code)})
+			rtn.isJump = true
+			rtn.jump = len(state.f.code)
 			state.addInst(createAsBx(opJump, 0, 0), ee.Line())
-		case ast.OpGreaterOrEqual:
-			sense := 1
-			if boolRev {
-				sense = 0
-			}
-			l, lu := expr(ee.Left, state, reg, false).RK()
-			r := reg
-			if lu {
-				r++
-			}
-			r, _ = expr(ee.Right, state, r, false).RK()
-			state.addInst(createABC(OpLessThan, sense, l, r), ee.Line())
-			rtn.boolean = patchList([]int{len(state.f.code)})
-			state.addInst(createAsBx(opJump, 0, 0), ee.Line())
-
-		// The pain in the a** operators
-		// TODO: The code generated here is quite bad.
 
-		// TESTSET dest src sense ; if bool(src) == sense { dest = src, <jump> } else { <fallthrough> }
-		// TEST val _ sense ; if bool(val) == sense { <jump> } else { <fallthrough> }
+		// Short circuit operators. The left side jumps past the right side if it decides the result, the right
+		// side's jump lists (and value) become the result.
 
 		case ast.OpAnd:
-			rtn.boolCanR = true
-			sense := 0
-			patch := patchList([]int{})
-			lr, lru := expr(ee.Left, state, reg, false).To(true)
-			if lru {
-				state.addInst(createABC(opTest, reg, 0, sense), ee.Left.Line())
-			} else {
-				state.addInst(createABC(opTestSet, reg, lr, sense), ee.Left.Line())
-			}
-			patch = append(patch, len(state.f.code))
-			state.addInst(createAsBx(opJump, 0, 0), ee.Left.Line())
-			expr(ee.Right, state, reg, false).To(false)
-			state.addInst(createABC(opTest, reg, 0, sense), ee.Right.Line())
-			patch = append(patch, len(state.f.code))
-			state.addInst(createAsBx(opJump, 0, 0), ee.Right.Line())
-
-			if boolRev {
-				rtn.boolean = patchList([]int{len(state.f.code)})
-				state.addInst(createAsBx(opJump, 0, 0), ee.Line())
-				patch.patch(state.f, len(state.f.code))
-				return rtn
-			}
-			rtn.boolean = patch
-			return rtn
+			left := expr(ee.Left, state, reg)
+			left.goIfTrue()
+			rtn = expr(ee.Right, state, reg)
+			rtn.f = append(left.f, rtn.f...)
 		case ast.OpOr:
-			rtn.boolCanR = true
-			sense := 1
-			patch := patchList([]int{})
-			lr, lru := expr(ee.Left, state, reg, false).To(true)
-			if lru {
-				state.addInst(createABC(opTest, reg, 0, sense), ee.Left.Line())
-			} else {
-				state.addInst(createABC(opTestSet, reg, lr, sense), ee.Left.Line())
-			}
-			patch = append(patch, len(state.f.code))
-			state.addInst(createAsBx(opJump, 0, 0), ee.Left.Line())
-			expr(ee.Right, state, reg, false).To(false)
-			state.addInst(createABC(opTest, reg, 0, sense), ee.Right.Line())
-			patch = append(patch, len(state.f.code))
-			state.addInst(createAsBx(opJump, 0, 0), ee.Right.Line())
-
-			if !boolRev {
-				rtn.boolean = patchList([]int{len(state.f.code)})
-				state.addInst(createAsBx(opJump, 0, 0), ee.Line())
-				patch.patch(state.f, len(state.f.code))
-				return rtn
-			}
-			rtn.boolean = patch
-			return rtn
+			left := expr(ee.Left, state, reg)
+			left.goIfFalse()
+			rtn = expr(ee.Right, state, reg)
+			rtn.t = append(left.t, rtn.t...)
 		}
+		// Operators never produce multiple values, `a and f()` is truncated to one like any other operand.
+		rtn.mayMulti = false
 	case *ast.FuncCall:
 		compileCall(ee, state, reg, 1, false)
 		rtn.mayMulti = true
@@ -674,7 +757,7 @@ func expr(e ast.Expr, state *compState, reg int, boolRev bool) exprData {
 				state.addInst(createABC(opSetList, reg, 50, fc), ee.Line())
 				fc++
 			}
-			ex := expr(item, state, reg+ic+1, false)
+			ex := expr(item, state, reg+ic+1)
 			if i == len(list)-1 && ex.mayMulti {
 				ex.setResults(-1)
 				state.addInst(createABC(opSetList, reg, 0, fc), ee.Line())
@@ -688,8 +771,8 @@ func expr(e ast.Expr, state *compState, reg int, boolRev bool) exprData {
 		}
 
 		for i, item := range keyed {
-			vrk, _ := expr(item, state, reg+1, false).RK()
-			krk, _ := expr(keys[i], state, reg+2, false).RK()
+			vrk, _ := expr(item, state, reg+1).RK()
+			krk, _ := expr(keys[i], state, reg+2).RK()
 			state.addInst(createABC(opSetTable, reg, krk, vrk), ee.Line())
 		}
 		rtn.register = true
@@ -710,7 +793,7 @@ func expr(e ast.Expr, state *compState, reg int, boolRev bool) exprData {
 			state.addInst(createABC(opVarArg, reg, 2, 0), eee.Line())
 			rtn.register = true
 		default:
-			ex := expr(ee.Inner, state, reg, boolRev)
+			ex := expr(ee.Inner, state, reg)
 			return ex
 		}
 	case *ast.ConstInt:
@@ -720,6 +803,11 @@ func expr(e ast.Expr, state *compState, reg int, boolRev bool) exprData {
 	case *ast.ConstString:
 		rtn.constant = state.constK(ee.Value)
 	case *ast.ConstIdent:
+		if v, ok := state.localConst(ee.Value); ok {
+			rtn.constant = state.constK(v)
+			return rtn
+		}
+
 		ident, _ := lowerIdent(e, state, reg)
 		place, idx := ident.Get(reg, true)
 		rtn.register = true
@@ -749,7 +837,7 @@ func exprlist(es []ast.Expr, state *compState, firstreg, minresults int) {
 	// This is really simple
 	var last exprData
 	for _, e := range es {
-		last = expr(e, state, firstreg, false)
+		last = expr(e, state, firstreg)
 		firstreg++
 		minresults--
 		last.To(false)
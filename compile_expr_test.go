@@ -0,0 +1,57 @@
+/*
+Copyright 2016-2017 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua
+
+import "testing"
+import "strings"
+
+// Check that and/or compile to jumps from one test to the next, and only load booleans when they are needed.
+func TestAndOrCode(t *testing.T) {
+	tests := []struct {
+		src  string
+		has  []string
+		hasn []string
+	}{
+		{`local a, b = ... if a < 5 or b == nil then a = 3 end`, []string{"LT ", "EQ "}, []string{"LOADBOOL", "TEST"}},
+		{`local a, b = ... if a and b then a = 3 end`, []string{"TEST "}, []string{"LOADBOOL", "TESTSET"}},
+		{`local a, b = ... while not a do a = b end`, []string{"TEST "}, []string{"LOADBOOL", "NOT"}},
+		{`local a, b = ... local c = a or b`, []string{"TESTSET"}, []string{"LOADBOOL"}},
+		{`local a, b = ... local c = a and b or 5`, []string{"TESTSET"}, []string{"LOADBOOL"}},
+		{`local a, b = ... local c = a < b`, []string{"LOADBOOL"}, []string{"TEST"}},
+		{`local a, b = ... return a or b`, []string{"TESTSET"}, []string{"LOADBOOL"}},
+	}
+
+	for _, test := range tests {
+		code := disassemble(t, test.src)
+		for _, op := range test.has {
+			if !strings.Contains(code, op) {
+				t.Errorf("%q: missing %v:\n%v\n", test.src, op, code)
+			}
+		}
+		for _, op := range test.hasn {
+			if strings.Contains(code, op) {
+				t.Errorf("%q: should not have %v:\n%v\n", test.src, op, code)
+			}
+		}
+	}
+}
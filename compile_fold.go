@@ -0,0 +1,226 @@
+/*
+Copyright 2016-2017 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua
+
+import "github.com/milochristiansen/lua/ast"
+
+// foldConst tries to evaluate an expression at compile time. If e is a constant, a local that always holds a
+// constant, or an operator with constant operands that can be safely evaluated, the result is returned along with
+// true. The math is done by arithRaw and compareRaw, which don't need a State, so Compile may run in any number of
+// goroutines at once.
+//
+// Folding must never change what a script does, so anything that could raise an error (or depends on a meta method
+// or a per-State option) is left for the VM. For example 1//0 is not folded (it raises), and neither are % and //
+// with negative operands (the result depends on State.TruncatedDivision). Strings are not converted to numbers.
+func foldConst(e ast.Expr, state *compState) (value, bool) {
+	switch ee := e.(type) {
+	case *ast.ConstInt:
+		return toInt(ee.Value), true
+	case *ast.ConstFloat:
+		return toFloat(ee.Value), true
+	case *ast.ConstString:
+		return ee.Value, true
+	case *ast.ConstBool:
+		return ee.Value, true
+	case *ast.ConstNil:
+		return nil, true
+	case *ast.ConstIdent:
+		return state.localConst(ee.Value)
+	case *ast.Parens:
+		return foldConst(ee.Inner, state)
+	case *ast.Operator:
+		return foldOperator(ee, state)
+	}
+	return nil, false
+}
+
+func foldOperator(e *ast.Operator, state *compState) (value, bool) {
+	var a, b value
+	if e.Left != nil {
+		var ok bool
+		a, ok = foldConst(e.Left, state)
+		if !ok {
+			return nil, false
+		}
+	}
+	b, ok := foldConst(e.Right, state)
+	if !ok {
+		return nil, false
+	}
+
+	switch e.Op {
+	case ast.OpAdd, ast.OpSub, ast.OpMul, ast.OpPow, ast.OpDiv:
+		if isNumber(a) && isNumber(b) {
+			return arithRaw(opCode(e.Op)+OpAdd, a, b)
+		}
+	case ast.OpMod, ast.OpIDiv:
+		// Floored and truncated division only agree when both operands are positive, and only integers are
+		// safe (legacy // converts floats to integers).
+		ia, oka := a.(int64)
+		ib, okb := b.(int64)
+		if oka && okb && ia >= 0 && ib > 0 {
+			return arithRaw(opCode(e.Op)+OpAdd, a, b)
+		}
+	case ast.OpBinAND, ast.OpBinOR, ast.OpBinXOR, ast.OpBinShiftL, ast.OpBinShiftR:
+		if isNumber(a) && isNumber(b) {
+			_, oka := tryInt(a)
+			_, okb := tryInt(b)
+			if oka && okb {
+				return arithRaw(opCode(e.Op)+OpAdd, a, b)
+			}
+		}
+	case ast.OpUMinus:
+		if isNumber(b) {
+			return arithRaw(OpUMinus, b, b)
+		}
+	case ast.OpBinNot:
+		if _, ok := tryInt(b); ok && isNumber(b) {
+			return arithRaw(OpBinNot, b, b)
+		}
+	case ast.OpNot:
+		return !toBool(b), true
+	case ast.OpLength:
+		if s, ok := b.(string); ok {
+			return int64(len(s)), true
+		}
+	case ast.OpConcat:
+		if concatable(a) && concatable(b) {
+			return toStringConcat(a) + toStringConcat(b), true
+		}
+
+	case ast.OpEqual, ast.OpNotEqual:
+		if typeOf(a) != typeOf(b) {
+			return e.Op == ast.OpNotEqual, true
+		}
+		if foldComparable(a, b) {
+			if rtn, ok := compareRaw(OpEqual, a, b); ok {
+				return rtn == (e.Op == ast.OpEqual), true
+			}
+		}
+	case ast.OpLessThan, ast.OpLessOrEqual, ast.OpGreaterThan, ast.OpGreaterOrEqual:
+		if !foldComparable(a, b) {
+			break
+		}
+		op := OpLessThan
+		if e.Op == ast.OpLessOrEqual || e.Op == ast.OpGreaterOrEqual {
+			op = OpLessOrEqual
+		}
+		if e.Op == ast.OpGreaterThan || e.Op == ast.OpGreaterOrEqual {
+			a, b = b, a
+		}
+		if rtn, ok := compareRaw(op, a, b); ok {
+			return rtn, true
+		}
+	}
+	return nil, false
+}
+
+func isNumber(v value) bool {
+	switch v.(type) {
+	case int64, float64:
+		return true
+	}
+	return false
+}
+
+// foldComparable returns true if compare can handle a and b without raising an error. Comparing an integer with a
+// float may try to convert the float to an integer, so that is left for the VM.
+func foldComparable(a, b value) bool {
+	switch a.(type) {
+	case int64:
+		_, ok := b.(int64)
+		return ok
+	case float64:
+		_, ok := b.(float64)
+		return ok
+	case string:
+		_, ok := b.(string)
+		return ok
+	case bool:
+		_, ok := b.(bool)
+		return ok
+	case nil:
+		return b == nil
+	}
+	return false
+}
+
+// Constant propagation.
+//
+// A local that is initialized with a constant (or something that folds to one) and is never assigned to is
+// replaced by its value everywhere it is used, so `local day = 60*60*24` followed by `day * 7` is folded just like
+// `60*60*24*7` is. The local still gets its register (and its value), so nothing changes for debugging.
+//
+// Figuring out if a local is ever assigned to is done the lazy way: any assignment to any variable with the same
+// name anywhere in the function (including the functions inside it) counts. This misses a few locals that could be
+// propagated (when another variable with the same name is assigned), but it can never get it wrong.
+
+// assignedNames returns the names of all variables that are assigned to in the given block or any function inside it.
+func assignedNames(block []ast.Stmt) map[string]bool {
+	names := map[string]bool{}
+	for _, s := range block {
+		ast.Inspect(s, func(n ast.Node) bool {
+			if a, ok := n.(*ast.Assign); ok && !a.LocalDecl && !a.LocalFunc {
+				for _, t := range a.Targets {
+					if id, ok := t.(*ast.ConstIdent); ok {
+						names[id.Value] = true
+					}
+				}
+			}
+			return true
+		})
+	}
+	return names
+}
+
+// localConsts returns the values of the locals declared by a local statement that always hold a constant. This
+// must be called before the new locals are created, as the values are resolved the same way their expressions are.
+func localConsts(n *ast.Assign, state *compState) map[*ast.ConstIdent]value {
+	consts := map[*ast.ConstIdent]value{}
+	for i, t := range n.Targets {
+		id, ok := t.(*ast.ConstIdent)
+		if !ok || i >= len(n.Values) || state.assigned[id.Value] {
+			continue
+		}
+		if v, ok := foldConst(n.Values[i], state); ok {
+			consts[id] = v
+		}
+	}
+	return consts
+}
+
+// localConst returns the value of the local (of this function or one it is inside of) with the given name, if it
+// always holds a constant.
+func (state *compState) localConst(name string) (value, bool) {
+	for i := len(state.f.localVars) - 1; i >= 0; i-- {
+		l := state.f.localVars[i]
+		if l.sPC > l.ePC && l.name == name {
+			v, ok := state.consts[i]
+			return v, ok
+		}
+	}
+	if state.p != nil {
+		return state.p.localConst(name)
+	}
+	return nil, false
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2016-2017 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua
+
+import "testing"
+import "strings"
+import "sync"
+
+// Compile some source code and return the disassembly.
+func disassemble(t *testing.T, src string) string {
+	f, err := compSource(src, "test", 1, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f.String()
+}
+
+// Each of these pairs of chunks should compile to exactly the same code.
+func TestConstFolding(t *testing.T) {
+	tests := [][2]string{
+		{`local x = 60*60*24`, `local x = 86400`},
+		{`local x = (1 + 2) * 3 - 4`, `local x = 5`},
+		{`local x = 2^10`, `local x = 1024.0`},
+		{`local x = 1 / 4`, `local x = 0.25`},
+		{`local x, y = 7 // 2, 7 % 2`, `local x, y = 3, 1`},
+		{`local x = 0xFF & ~0xF | 1 << 8`, `local x = 496`},
+		{`local x = 2.0 >> 1`, `local x = 1`},
+		{`local x = "a" .. "b" .. 1 .. 2.5`, `local x = "ab12.5"`},
+		{`local x = #"hello"`, `local x = 5`},
+		{`local x, y, z = not nil, not 0, not not false`, `local x, y, z = true, false, false`},
+		{`local x, y = 1 < 2, "a" >= "b"`, `local x, y = true, false`},
+		{`local x, y = 1.0 == 0.5 + 0.5, nil ~= false`, `local x, y = true, true`},
+		{`local x = ("x" .. "y") == "xy"`, `local x = true`},
+		{`if 1 > 2 then print("no") end`, `if false then print("no") end`},
+		{`print((3 - 1) * 2)`, `print(4)`},
+
+		// Constant propagation
+		{`local day = 60*60*24; local week = day * 7`, `local day = 86400; local week = 604800`},
+		{`local a, b = 2, "x"; print(a, b .. a, -a)`, `local a, b = 2, "x"; print(2, "x2", -2)`},
+		{`local k = 2; local function f() return k * 3 end`, `local k = 2; local function f() return 6 end`},
+		{`local x = 1; local x = x + 1; print(x)`, `local x = 1; local x = 2; print(2)`},
+	}
+
+	for _, test := range tests {
+		got, want := disassemble(t, test[0]), disassemble(t, test[1])
+		if got != want {
+			t.Errorf("%q did not compile like %q:\n%v\nExpected:\n%v\n", test[0], test[1], got, want)
+		}
+	}
+}
+
+// These must not be folded, either because they raise errors, depend on an option, or call meta methods.
+func TestConstFoldingSkipped(t *testing.T) {
+	tests := []struct {
+		src, op string
+	}{
+		{`return 1 // 0`, "IDIV"},
+		{`return 1 % 0`, "MOD"},
+		{`return -7 % 2`, "MOD"},
+		{`return 7.5 // 2`, "IDIV"},
+		{`return "10" + 1`, "ADD"},
+		{`return 1.5 | 0`, "BOR"},
+		{`return ~1.5`, "BNOT"},
+		{`return -"2"`, "UNM"},
+		{`return #{}`, "LEN"},
+		{`return "a" .. true`, "CONCAT"},
+		{`return 1 < 1.5`, "LT"},
+		{`return 1 == 1.0`, "EQ"},
+		{`return nil < 1`, "LT"},
+
+		// Locals that are assigned to (anywhere) are not propagated.
+		{`local x = 1; x = 2; return x + 1`, "ADD"},
+		{`local x = 1; local function f() x = 2 end; return x + 1`, "ADD"},
+		{`local x = 1; do local x = 2; x = 3 end; return x + 1`, "ADD"},
+		{`local x, y = 1; return y + 1`, "ADD"},
+		{`local x = {}; return #x`, "LEN"},
+	}
+
+	for _, test := range tests {
+		code := disassemble(t, test.src)
+		if !strings.Contains(code, test.op) {
+			t.Errorf("%q was folded:\n%v\n", test.src, code)
+		}
+	}
+}
+
+// Folded expressions must give the same results the VM would.
+func TestConstFoldingResults(t *testing.T) {
+	l := NewState()
+	l.Push("assert")
+	l.Push(func(l *State) int {
+		if !l.ToBool(1) {
+			l.Push("assertion failed!")
+			l.Error()
+		}
+		return 0
+	})
+	l.SetTableRaw(GlobalsIndex)
+
+	// The variables keep the right hand sides from being folded (they are assigned to, so they are not propagated).
+	err := l.LoadText(strings.NewReader(`
+local one, two, half, e = 1, 2, 0.5, ""
+one, two, half, e = one, two, half, e
+assert(60*60*24 == 60*60*24*one)
+assert(2^10 == two^10)
+assert(7 // 2 == 7 // two and 7 % 2 == 7 % two)
+assert(1 / 0 == one / 0 and -1 / 0 == -one / 0)
+assert(1 / -0.0 == 1 / -(half - half))
+assert(1 << 64 == one << 64 and 1 << 63 == one << 63 and -1 >> 1 == -one >> 1)
+assert(2.0 >> 1 == 2.0 >> one)
+assert(0x7fffffffffffffff + 1 == 0x7fffffffffffffff + one)
+assert("a" .. 1 .. 2.5 == e .. "a" .. one .. 2.5)
+assert(#"hello" == #("hello" .. e))
+assert((1 < 2) == (one < two) and ("a" >= "b") == ("a" >= e .. "b"))
+local k = 10
+local function f() return k * 2 end
+assert(f() == 20 and k + one == 11 and k .. e == "10")
+`), "test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.PCall(0, 0)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// Folding must not share any state between compiles, since Compile may be used from many goroutines at once. Run
+// with -race to make this test useful.
+func TestConstFoldingConcurrent(t *testing.T) {
+	src := `local x, y, z = 60*60*24, 2^10 .. "", (7 // 2 == 3) and ~5 < -5`
+	want := disassemble(t, src)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				f, err := compSource(src, "test", 1, Options{})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if f.String() != want {
+					t.Errorf("Concurrent compiles gave different code:\n%v\n%v", f.String(), want)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,293 @@
+/*
+Copyright 2016-2017 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua
+
+// This file contains the optional peephole optimizer. It runs on finished function prototypes, so it only needs to
+// know about instructions, not the AST. Everything here has to leave the code exactly equivalent, including what
+// the debug info says (line numbers and the PC ranges of locals).
+
+// optimize runs the peephole passes over a function and all the functions it contains, and works out how many
+// registers each function actually needs.
+func optimize(f *funcProto) {
+	for i := range f.prototypes {
+		optimize(&f.prototypes[i])
+	}
+
+	for {
+		threadJumps(f)
+		remove := removable(f)
+		if remove == nil {
+			break
+		}
+		removeInsts(f, remove)
+	}
+
+	f.maxStackSize = stackSize(f)
+}
+
+// jumpTarget returns the PC an instruction jumps to, or -1 if it is not a jump.
+func jumpTarget(f *funcProto, pc int) int {
+	switch i := f.code[pc]; i.getOpCode() {
+	case opJump, opForLoop, opForPrep, opTForLoop:
+		return pc + 1 + i.sbx()
+	}
+	return -1
+}
+
+// skips returns true if the instruction may skip the one after it.
+func skips(i instruction) bool {
+	op := i.getOpCode()
+	return isTestOp(op) || op == opLoadBool && i.c() != 0
+}
+
+// threadJumps points jumps that go to another (unconditional) JMP straight to where that JMP goes. If either jump
+// closes upvalues the result closes everything both would.
+func threadJumps(f *funcProto) {
+	for pc, i := range f.code {
+		if i.getOpCode() != opJump {
+			continue
+		}
+
+		a, to := i.a(), jumpTarget(f, pc)
+		for n := 0; n < len(f.code) && to < len(f.code) && f.code[to].getOpCode() == opJump; n++ {
+			next := f.code[to]
+			if next.a() != 0 && (a == 0 || next.a() < a) {
+				a = next.a()
+			}
+			to = jumpTarget(f, to)
+		}
+		f.code[pc].setA(a)
+		f.code[pc].setSBx(mkoffset(pc, to))
+	}
+}
+
+// removable returns a list of instructions that can be removed without changing what the function does, or nil
+// if there are none. Merged LOADNILs are fixed up here, the second one is just marked for removal.
+func removable(f *funcProto) []bool {
+	code := f.code
+
+	// Find everything that is the target of a jump, and everything that can actually be reached.
+	targets := make([]bool, len(code)+2)
+	reachable := make([]bool, len(code)+2)
+	work := []int{0}
+	for len(work) > 0 {
+		pc := work[len(work)-1]
+		work = work[:len(work)-1]
+		if pc >= len(code) || reachable[pc] {
+			continue
+		}
+		reachable[pc] = true
+
+		i := code[pc]
+		if to := jumpTarget(f, pc); to != -1 {
+			targets[to] = true
+			work = append(work, to)
+		}
+		if skips(i) {
+			targets[pc+2] = true
+			work = append(work, pc+2)
+		}
+		switch op := i.getOpCode(); {
+		case op == opJump, op == opForPrep, op == opReturn:
+		case op == opLoadBool && i.c() != 0:
+		default:
+			work = append(work, pc+1)
+		}
+	}
+
+	var remove []bool
+	mark := func(pc int) {
+		if remove == nil {
+			remove = make([]bool, len(code))
+		}
+		remove[pc] = true
+	}
+
+	last := -1 // The last instruction that is kept.
+	for pc, i := range code {
+		// If the previous instruction may skip this one it has to stay put, even if it is dead.
+		if last != -1 && skips(code[last]) && last == pc-1 {
+			last = pc
+			continue
+		}
+
+		switch op := i.getOpCode(); {
+		case !reachable[pc]:
+			// Dead code.
+			mark(pc)
+			continue
+		case op == opJump && i.a() == 0 && i.sbx() == 0:
+			// Jump to the next instruction.
+			mark(pc)
+			continue
+		case op == opMove && i.a() == i.b():
+			mark(pc)
+			continue
+		case op == opLoadNil && !targets[pc] && pc > 0 && last == pc-1 && code[last].getOpCode() == opLoadNil &&
+			(last == 0 || !skips(code[last-1])):
+			// Merge with the previous LOADNIL if the ranges touch. Neither may be skipped on its own.
+			p := &code[last]
+			lo, hi := p.a(), p.a()+p.b()
+			if i.a() <= hi+1 && i.a()+i.b() >= lo-1 {
+				if i.a() < lo {
+					lo = i.a()
+				}
+				if i.a()+i.b() > hi {
+					hi = i.a() + i.b()
+				}
+				p.setA(lo)
+				p.setB(hi - lo)
+				mark(pc)
+				continue
+			}
+		}
+		last = pc
+	}
+	return remove
+}
+
+// removeInsts deletes the marked instructions, fixing up jumps, line info, and local variable PC ranges.
+func removeInsts(f *funcProto, remove []bool) {
+	// newPC maps each old PC (plus the end of the code) to the PC of the first instruction that is kept at or
+	// after it.
+	newPC := make([]int, len(f.code)+1)
+	n := 0
+	for pc := range f.code {
+		newPC[pc] = n
+		if !remove[pc] {
+			n++
+		}
+	}
+	newPC[len(f.code)] = n
+
+	code := make([]instruction, 0, n)
+	lines := make([]int, 0, n)
+	for pc, i := range f.code {
+		if remove[pc] {
+			continue
+		}
+		if to := jumpTarget(f, pc); to != -1 {
+			i.setSBx(mkoffset(newPC[pc], newPC[to]))
+		}
+		code = append(code, i)
+		if pc < len(f.lineInfo) {
+			lines = append(lines, f.lineInfo[pc])
+		}
+	}
+
+	for i := range f.localVars {
+		v := &f.localVars[i]
+		v.sPC = int32(newPC[clampPC(int(v.sPC), len(f.code))])
+		v.ePC = int32(newPC[clampPC(int(v.ePC), len(f.code))])
+	}
+
+	f.code = code
+	f.lineInfo = lines
+}
+
+func clampPC(pc, l int) int {
+	if pc < 0 {
+		return 0
+	}
+	if pc > l {
+		return l
+	}
+	return pc
+}
+
+// stackSize returns the number of registers the function uses.
+func stackSize(f *funcProto) int {
+	size := f.parameterCount
+	use := func(r int) {
+		if r+1 > size {
+			size = r + 1
+		}
+	}
+	rk := func(r int) {
+		if !isK(r) {
+			use(r)
+		}
+	}
+
+	for _, i := range f.code {
+		a, b, c := i.a(), i.b(), i.c()
+		switch op := i.getOpCode(); op {
+		case opJump, opExtraArg:
+		case opMove, opTestSet:
+			use(a)
+			use(b)
+		case opLoadNil:
+			use(a + b)
+		case opSetTableUp, OpEqual, OpLessThan, OpLessOrEqual:
+			rk(b)
+			rk(c)
+		case opGetTableUp:
+			use(a)
+			rk(c)
+		case opSetTable, opGetTable:
+			use(a)
+			use(b)
+			rk(c)
+		case opSelf:
+			use(a + 1)
+			use(b)
+			rk(c)
+		case opConcat:
+			use(a)
+			use(c)
+		case opCall:
+			use(a)
+			use(a + b - 1)
+			use(a + c - 2)
+		case opTailCall:
+			use(a + b - 1)
+		case opReturn, opVarArg:
+			use(a)
+			use(a + b - 2)
+		case opForLoop, opForPrep:
+			use(a + 3)
+		case opTForCall:
+			use(a + 2 + c)
+		case opTForLoop:
+			use(a + 1)
+		case opSetList:
+			use(a + b)
+		default:
+			use(a)
+			if opModes[op].b == 2 {
+				rk(b)
+			} else if opModes[op].b == 1 && op != opGetUpValue && op != opSetUpValue && op != opLoadBool {
+				use(b)
+			}
+			if opModes[op].c == 2 {
+				rk(c)
+			}
+		}
+	}
+
+	// The reference VM always wants at least two.
+	if size < 2 {
+		size = 2
+	}
+	return size
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2016-2017 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua
+
+import "testing"
+import "strings"
+
+// Compile some source code with the optimizer on, and make sure the debug info still matches the code.
+func optimized(t *testing.T, src string) *funcProto {
+	f, err := compSource(src, "test", 1, Options{Optimize: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var check func(f *funcProto)
+	check = func(f *funcProto) {
+		if len(f.lineInfo) != len(f.code) {
+			t.Errorf("%q: %v instructions but %v lines", src, len(f.code), len(f.lineInfo))
+		}
+		for _, v := range f.localVars {
+			if v.sPC > v.ePC || int(v.ePC) > len(f.code) {
+				t.Errorf("%q: local %q has a bad range [%v,%v]", src, v.name, v.sPC, v.ePC)
+			}
+		}
+		for pc := range f.code {
+			if to := jumpTarget(f, pc); to < -1 || to > len(f.code) {
+				t.Errorf("%q: instruction %v jumps out of the function", src, pc)
+			}
+		}
+		for i := range f.prototypes {
+			check(&f.prototypes[i])
+		}
+	}
+	check(f)
+	return f
+}
+
+func TestOptimize(t *testing.T) {
+	tests := []struct {
+		src   string
+		hasn  string
+		count int
+	}{
+		// Jumps to jumps and jumps to the next instruction.
+		{`local a, b while a do if b then a = 1 end end`, "SBX:0 ", -1},
+		// Dead code after return.
+		{`local a if a then return 1 else return 2 end`, "", 7},
+		// Adjacent LOADNILs.
+		{`local a; local b; local c`, "", 2},
+		// A LOADBOOL that skips the next instruction has to keep it.
+		{`local a, b = ... local c = a < b`, "", -1},
+	}
+
+	for _, test := range tests {
+		f := optimized(t, test.src)
+		code := f.String()
+		if test.hasn != "" && strings.Contains(code, test.hasn) {
+			t.Errorf("%q: should not have %q:\n%v\n", test.src, test.hasn, code)
+		}
+		if test.count != -1 && len(f.code) != test.count {
+			t.Errorf("%q: expected %v instructions:\n%v\n", test.src, test.count, code)
+		}
+	}
+}
+
+func TestOptimizeStackSize(t *testing.T) {
+	f := optimized(t, `local a, b, c = 1, 2, 3 print(a + b + c) return function(x, y) end`)
+	if f.maxStackSize != 5 {
+		t.Errorf("Main function stack size is %v, expected 5:\n%v\n", f.maxStackSize, f)
+	}
+	if f.prototypes[0].maxStackSize != 2 {
+		t.Errorf("Inner function stack size is %v, expected 2:\n%v\n", f.prototypes[0].maxStackSize, f)
+	}
+}
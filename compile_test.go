@@ -0,0 +1,114 @@
+/*
+Copyright 2016-2017 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua_test
+
+import "testing"
+import "strings"
+
+import "github.com/milochristiansen/lua/testhelp"
+
+// Regression tests for compiler and VM bugs that don't fit any of the ported test scripts.
+
+// Assignment targets and expressions like `f().x.y` need a GETTABLE for every key between the call or parens and
+// the last key.
+func TestNestedAccessor(t *testing.T) {
+	testhelp.AssertBlock(t, testhelp.MkState(), `
+	local t = {x = {y = {}}}
+	local function f() return t end
+	f().x.y[1] = "a"
+	f()["x"].z = "b"
+	assert(t.x.y[1] == "a" and t.x.z == "b" and t.y == nil and t.z == nil)
+	local a, b = (t.x).y[1], (f()).x.z
+	return a == "a" and b == "b"
+	`, true)
+}
+
+// Every instruction needs line info, or the line reported for any instruction after the missing entry is wrong.
+func TestNestedAccessorLine(t *testing.T) {
+	l := testhelp.MkState()
+	err := l.LoadText(strings.NewReader("t = {x = {y = 1}}\nlocal v = t.x.y\nreturn v .. {}\n"), "lines", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.PCall(0, 0)
+	if err == nil || !strings.Contains(err.Error(), "lines:3:") {
+		t.Errorf("Error not reported on line 3: %v", err)
+	}
+}
+
+// A function that uses ... keeps its arguments below its registers, so the fixed parameters need to be copied
+// into the registers the function expects them in.
+func TestVarArgFixedParams(t *testing.T) {
+	testhelp.AssertBlock(t, testhelp.MkState(), `
+	local function f(a, b, ...)
+		local n = select("#", ...)
+		return a, b
+	end
+	local a, b = f(1, 2, 3, 4)
+	assert(a == 1 and b == 2)
+	a, b = f(1)
+	return a == 1 and b == nil
+	`, true)
+}
+
+// ... only holds the arguments after the fixed parameters.
+func TestVarArgParams(t *testing.T) {
+	testhelp.AssertBlock(t, testhelp.MkState(), `
+	local function f(a, b, ...)
+		local c, d = ...
+		return a, b, c, d, select("#", ...)
+	end
+	local a, b, c, d, n = f(1, 2, 3, 4)
+	assert(a == 1 and b == 2 and c == 3 and d == 4 and n == 2)
+	a, b, c, d, n = f(1)
+	assert(a == 1 and b == nil and c == nil and d == nil and n == 0)
+	local function g(a, ...) return f(a, ...) end
+	a, b, c, d, n = g(5, 6, 7)
+	assert(a == 5 and b == 6 and c == 7 and d == nil and n == 1)
+	return true
+	`, true)
+}
+
+// When a local is assigned to more targets than it fills, the extra targets are set to nil starting after the
+// target register, not after the register the local lives in.
+func TestAssignExtraNil(t *testing.T) {
+	testhelp.AssertBlock(t, testhelp.MkState(), `
+	local x = 1
+	local y = 2
+	local a, b, c = x
+	assert(x == 1 and y == 2 and a == 1 and b == nil and c == nil)
+	local p, q = y
+	return x == 1 and y == 2 and p == 2 and q == nil
+	`, true)
+}
+
+// A key computed into a register must not be overwritten by the value that is assigned to it.
+func TestAssignRegisterKey(t *testing.T) {
+	testhelp.AssertBlock(t, testhelp.MkState(), `
+	local t = {x = {}}
+	local i = 1
+	t.x[i + 1] = i + 10
+	t.x[i .. "k"] = {i}
+	return t.x[2] == 11 and t.x["1k"][1] == 1
+	`, true)
+}
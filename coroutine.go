@@ -0,0 +1,256 @@
+/*
+Copyright 2016-2017 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua
+
+import "github.com/milochristiansen/lua/luautil"
+
+// Coroutines are implemented using goroutines. Each thread has its own stack (and so its own set of call frames)
+// and when it is first resumed a goroutine is started to run it. Resume and Yield simply pass control back and
+// forth between the goroutines, only one of them is ever running at a time.
+//
+// Since a suspended thread is simply a blocked goroutine yielding from inside a metamethod, a native function,
+// or a protected call is no problem at all.
+//
+// Threads that have been started but have not finished are tracked by the State that created them, so Close can
+// stop them. A thread is stopped by closing its resume channel, Yield then panics with threadClosed, which unwinds
+// the thread's stack (PCall and friends pass it on instead of catching it) until it reaches runThread.
+
+// ThreadStatus is the status of a thread (coroutine), see "coroutine.status" in the Lua 5.3 Reference Manual.
+type ThreadStatus int
+
+const (
+	ThreadRunning   ThreadStatus = iota // The thread is running (the main thread is always running or normal).
+	ThreadSuspended                     // The thread is waiting to be started or resumed.
+	ThreadNormal                        // The thread is active, but is not running (it resumed another thread).
+	ThreadDead                          // The thread finished running or stopped because of an error.
+)
+
+var threadStatusNames = [...]string{"running", "suspended", "normal", "dead"}
+
+func (s ThreadStatus) String() string {
+	return threadStatusNames[s]
+}
+
+type coroutine struct {
+	started bool
+
+	resume chan int             // Number of values passed to Resume.
+	yield  chan coroutineSignal // Values yielded or returned, or an error.
+}
+
+type coroutineSignal struct {
+	n   int
+	err error
+}
+
+// threadClosed is the value a thread panics with when it is stopped by Close.
+type threadClosed struct{}
+
+// NewThread creates a new thread and pushes it onto the stack. The new thread is also returned for use with
+// Resume and friends.
+//
+// The new thread shares the global table, the registry, and the metatables for the basic types with l, but it
+// has its own stack. Output, NativeTrace, TruncatedDivision, Options, and the current hook (see SetHook) are copied
+// from l.
+//
+// A thread that is never resumed until it finishes keeps its goroutine (and everything that is on its stack)
+// alive until it is stopped with Close.
+func (l *State) NewThread() *State {
+	co := &State{
+		Output:            l.Output,
+		NativeTrace:       l.NativeTrace,
+		TruncatedDivision: l.TruncatedDivision,
+		Options:           l.Options,
+
+		globalState: l.globalState,
+		stack:       newStack(&l.stackLimits),
+
+		hook:      l.hook,
+		hookMask:  l.hookMask,
+		hookCount: l.hookCount,
+		hookLeft:  l.hookCount,
+
+		status: ThreadSuspended,
+		co: &coroutine{
+			resume: make(chan int),
+			yield:  make(chan coroutineSignal),
+		},
+	}
+	l.stack.Push(co)
+	return co
+}
+
+// ToThread reads a thread value from the stack at the given index.
+// Negative indexes are relative to TOS, positive indexes are absolute.
+// If the value is not a thread this will raise an error.
+func (l *State) ToThread(i int) *State {
+	co, ok := l.get(i).(*State)
+	if !ok {
+		luautil.Raise("Invalid conversion to thread: Value is not a thread.", luautil.ErrTypGenRuntime)
+	}
+	return co
+}
+
+// Status returns the current status of the thread.
+func (l *State) Status() ThreadStatus {
+	return l.status
+}
+
+// IsYieldable returns true if l is a coroutine (and so may call Yield).
+func (l *State) IsYieldable() bool {
+	return l.co != nil
+}
+
+// XMove pops n values from the stack of l and pushes them onto the stack of to (in the same order).
+//
+// Both States must be threads created from the same original State, else this will raise an error.
+func (l *State) XMove(to *State, n int) {
+	if n <= 0 || l == to {
+		return
+	}
+	if l.globalState != to.globalState {
+		luautil.Raise("Cannot move values between unrelated States.", luautil.ErrTypGenRuntime)
+	}
+
+	segC, segN := l.stack.topBounds()
+	if segN-n < segC {
+		luautil.Raise("Not enough values on the stack for XMove.", luautil.ErrTypGenRuntime)
+	}
+
+	for i := segN - n + 1; i <= segN; i++ {
+		to.stack.PushT(l.stack.data[i])
+	}
+	l.stack.Pop(n)
+}
+
+// Resume starts or continues the thread l.
+//
+// To start a thread push the function to run followed by its arguments onto the thread's stack, then call
+// Resume with the argument count. To continue a suspended thread push the values you want Yield to return
+// onto the thread's stack and call Resume with their count.
+//
+// from is the thread that is doing the resuming (it may be nil), while Resume is running its status is set
+// to ThreadNormal.
+//
+// When the thread yields or returns Resume returns the number of values passed to Yield or returned from the
+// function, these values are on the top of the thread's stack (use XMove to get them). If the thread raises
+// an error it is returned and the thread is dead.
+func (l *State) Resume(from *State, args int) (int, error) {
+	switch {
+	case l.co == nil:
+		return 0, luautil.Error{Msg: "Cannot resume non-suspended coroutine.", Type: luautil.ErrTypGenRuntime}
+	case l.status == ThreadDead:
+		return 0, luautil.Error{Msg: "Cannot resume dead coroutine.", Type: luautil.ErrTypGenRuntime}
+	case l.status != ThreadSuspended:
+		return 0, luautil.Error{Msg: "Cannot resume non-suspended coroutine.", Type: luautil.ErrTypGenRuntime}
+	}
+
+	if from != nil {
+		from.status = ThreadNormal
+		defer func() {
+			from.status = ThreadRunning
+		}()
+	}
+
+	l.status = ThreadRunning
+	if !l.co.started {
+		l.co.started = true
+		if l.threads == nil {
+			l.threads = map[*State]bool{}
+		}
+		l.threads[l] = true
+		go l.runThread(args)
+	} else {
+		l.co.resume <- args
+	}
+
+	sig := <-l.co.yield
+	return sig.n, sig.err
+}
+
+// runThread is the body of a thread's goroutine.
+func (l *State) runThread(args int) {
+	n := 0
+	var err error
+	defer func() {
+		if e := recover(); e != nil && e != (threadClosed{}) {
+			panic(e)
+		}
+
+		l.status = ThreadDead
+		delete(l.threads, l)
+		l.co.yield <- coroutineSignal{n: n, err: err}
+	}()
+
+	err = l.PCall(args, -1)
+	if err == nil {
+		n = l.stack.TopIndex() + 1
+	}
+}
+
+// Yield suspends the running thread, passing the top n values on its stack to the Resume call that started
+// or continued it. Once the thread is resumed Yield returns the number of values passed to Resume, these
+// values are on the top of the stack.
+//
+// Generally Yield is used as the return statement of a native function, like so:
+//
+//	return l.Yield(n)
+//
+// If l is not a coroutine this will raise an error.
+func (l *State) Yield(n int) int {
+	if l.co == nil {
+		luautil.Raise("Attempt to yield from outside a coroutine.", luautil.ErrTypGenRuntime)
+	}
+
+	l.status = ThreadSuspended
+	l.co.yield <- coroutineSignal{n: n}
+	args, ok := <-l.co.resume
+	if !ok {
+		panic(threadClosed{})
+	}
+	return args
+}
+
+// Close stops every thread created from l (or from any thread that shares its globals) that was started but has
+// not finished. The goroutines of the stopped threads exit, and the threads are dead afterwards. Nothing is
+// run while a thread is stopped, not even the message handlers of XPCall calls it was inside of.
+//
+// Call Close when you are done with a State that may have unfinished coroutines, otherwise they (and everything
+// on their stacks) are kept alive until the program exits. The State itself may still be used after Close.
+//
+// Close must not be called while any of the threads are running (for example from inside a native function),
+// if it is an error is raised.
+func (l *State) Close() {
+	threads := make([]*State, 0, len(l.threads))
+	for co := range l.threads {
+		if co.status != ThreadSuspended {
+			luautil.Raise("Cannot close a State while it is running.", luautil.ErrTypGenRuntime)
+		}
+		threads = append(threads, co)
+	}
+
+	for _, co := range threads {
+		close(co.co.resume)
+		<-co.co.yield
+	}
+}
@@ -0,0 +1,429 @@
+/*
+Copyright 2016-2017 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua
+
+import "github.com/milochristiansen/lua/luautil"
+
+// HookEvent identifies the reason a hook was called.
+type HookEvent int
+
+const (
+	HookCall HookEvent = iota
+	HookReturn
+	HookLine
+	HookCount
+	HookTailCall
+)
+
+var hookEventNames = [...]string{"call", "return", "line", "count", "tail call"}
+
+func (e HookEvent) String() string {
+	if e < 0 || int(e) >= len(hookEventNames) {
+		return "unknown"
+	}
+	return hookEventNames[e]
+}
+
+// HookMask is used with SetHook to select which events a hook should be called for.
+type HookMask int
+
+const (
+	// Call the hook every time a function is called. Tail calls report HookTailCall instead of HookCall.
+	MaskCall HookMask = 1 << iota
+
+	// Call the hook just before a function returns.
+	MaskReturn
+
+	// Call the hook when the VM starts a new line of code, or jumps back to an earlier instruction (even if it
+	// is on the same line). Only Lua functions with line information generate line events.
+	MaskLine
+
+	// Call the hook every "count" instructions.
+	MaskCount
+)
+
+// HookFunc is the type of the functions used as debug hooks.
+//
+// A hook may use the State exactly like a native function would (you can push values, call functions, etc.), but
+// anything it leaves on the stack is removed when it returns. Hooks are disabled while a hook is running, so calling
+// Lua functions from inside a hook will not cause more hook calls. If a hook raises an error the error propagates
+// just like it would if the function being run had raised it.
+type HookFunc func(l *State, ar *ActivationRecord)
+
+// ActivationRecord holds information about a function activation (a stack frame).
+//
+// This is about the same thing as the reference implementation's lua_Debug.
+type ActivationRecord struct {
+	// The event that caused the hook to be called, meaningless if this record did not come from a hook.
+	Event HookEvent
+
+	Source          string // The name of the chunk the function was defined in, "(native code)" for native functions.
+	CurrentLine     int    // The line the function is currently running, -1 if not available.
+	LineDefined     int    // The line the function definition starts on, -1 for native functions.
+	LastLineDefined int    // The line the function definition ends on, -1 for native functions.
+
+	// "Lua" for Lua functions, "main" for the main function of a chunk, and "Go" for native functions.
+	What string
+
+	// A reasonable name for the function, and how that name was found ("global", "local", "method", "field",
+	// "upvalue", "metamethod", "for iterator", or "").
+	//
+	// Functions are values, so they don't really have names. These are found by looking at the code that called
+	// the function, so they are only available if the function was called from Lua code. If no name can be found
+	// Name and NameWhat are both "".
+	Name     string
+	NameWhat string
+
+	IsTailCall bool // Was this function tail called? If so the name is not available.
+}
+
+// SetHook sets the debug hook for this thread. mask specifies which events the hook will be called for, and count
+// is only used if MaskCount is set, in which case the hook is called every count instructions. Setting fn to nil
+// or mask to 0 turns off hooks.
+//
+// Hooks are per-thread, but new threads (see NewThread) start with the hook of the thread that created them.
+func (l *State) SetHook(fn HookFunc, mask HookMask, count int) {
+	if fn == nil || count <= 0 {
+		mask &^= MaskCount
+	}
+	if fn == nil || mask == 0 {
+		fn, mask = nil, 0
+	}
+
+	l.hook = fn
+	l.hookMask = mask
+	l.hookCount = count
+	l.hookLeft = count
+}
+
+// Hook returns the current hook function, mask, and count.
+func (l *State) Hook() (HookFunc, HookMask, int) {
+	return l.hook, l.hookMask, l.hookCount
+}
+
+// StackInfo returns information about the function running at the given level of the call stack. Level 0 is the
+// current running function (if called from a hook this is the function that triggered the hook), level 1 is the
+// function that called it, and so on. If the level is greater than the stack depth ok will be false.
+func (l *State) StackInfo(level int) (ar *ActivationRecord, ok bool) {
+	fi := len(l.stack.frames) - 1 - level
+	if level < 0 || fi < 1 {
+		return nil, false
+	}
+	return l.frameInfo(fi), true
+}
+
+// Traceback returns a traceback of the call stack starting at the given level (see StackInfo), formatted
+// much like the tracebacks the reference implementation generates. If msg is not empty it is added to the start of
+// the traceback.
+//
+// This is mostly useful from inside an XPCall message handler, as that is the only place (other than a hook) where
+// the stack of a failing function is still available.
+func (l *State) Traceback(msg string, level int) string {
+	out := ""
+	if msg != "" {
+		out = msg + "\n"
+	}
+	out += "stack traceback:"
+
+	for fi := len(l.stack.frames) - 1 - level; fi >= 1 && level >= 0; fi-- {
+		f := l.luaFrame(fi)
+		out += "\n\t" + f.String()
+		if f.TailCall {
+			out += "\n\t(...tail calls...)"
+		}
+	}
+	return out
+}
+
+// luaFrame converts the frame with the given index into a luautil.Frame for use in error traces.
+func (l *State) luaFrame(fi int) luautil.Frame {
+	ar := l.frameInfo(fi)
+	return luautil.Frame{
+		Source:      ar.Source,
+		Line:        ar.CurrentLine,
+		LineDefined: ar.LineDefined,
+		Name:        ar.Name,
+		NameWhat:    ar.NameWhat,
+		Native:      ar.What == "Go",
+		TailCall:    ar.IsTailCall,
+	}
+}
+
+// frameInfo fills out an ActivationRecord for the frame with the given index.
+func (l *State) frameInfo(fi int) *ActivationRecord {
+	frame := l.stack.frames[fi]
+
+	ar := &ActivationRecord{
+		CurrentLine: -1,
+		IsTailCall:  frame.tailCall,
+	}
+	if frame.fn.native != nil {
+		ar.Source = "(native code)"
+		ar.What = "Go"
+		ar.LineDefined = -1
+		ar.LastLineDefined = -1
+	} else {
+		p := &frame.fn.proto
+		ar.Source = p.source
+		ar.What = "Lua"
+		if p.lineDefined == 0 {
+			ar.What = "main"
+		}
+		ar.LineDefined = p.lineDefined
+		ar.LastLineDefined = p.lastLineDefined
+		ar.CurrentLine = p.lineAt(int(frame.pc) - 1)
+	}
+
+	if !frame.tailCall {
+		ar.Name, ar.NameWhat = l.funcName(fi)
+	}
+	return ar
+}
+
+// lineAt returns the line the instruction at the given pc came from, or -1 if there is no line information.
+func (p *funcProto) lineAt(pc int) int {
+	if pc < 0 {
+		pc = 0
+	}
+	if pc >= len(p.lineInfo) {
+		return -1
+	}
+	return p.lineInfo[pc]
+}
+
+// traceExec handles line and count hooks. It is called by the VM before every instruction when line or count
+// hooks are active.
+func (l *State) traceExec() {
+	if l.inHook {
+		return
+	}
+
+	frame := l.stack.cFrame()
+	if l.hookMask&MaskCount != 0 {
+		l.hookLeft--
+		if l.hookLeft <= 0 {
+			l.hookLeft = l.hookCount
+			l.callHook(HookCount, -1)
+		}
+	}
+
+	if l.hookMask&MaskLine != 0 {
+		// frame.pc has already been advanced past the instruction that is about to be run.
+		p := &frame.fn.proto
+		pc := int(frame.pc) - 1
+		line := p.lineAt(pc)
+
+		// Entering a new function, jumping backwards (a loop), or starting a new line.
+		if line >= 0 && (pc == 0 || pc <= int(frame.oldpc) || line != p.lineAt(int(frame.oldpc))) {
+			l.callHook(HookLine, line)
+		}
+		frame.oldpc = int32(pc)
+	}
+}
+
+// callHook calls the hook function for the given event. The current frame is always the frame that triggered
+// the event.
+func (l *State) callHook(event HookEvent, line int) {
+	if l.inHook || l.hook == nil {
+		return
+	}
+
+	ar := l.frameInfo(len(l.stack.frames) - 1)
+	ar.Event = event
+	if line >= 0 {
+		ar.CurrentLine = line
+	}
+
+	// Anything the hook leaves on the stack needs to be removed or the function being run will get very confused.
+	// If the hook raises an error it is up to whoever recovers the error to clean up.
+	stk := l.stack
+	top := len(stk.data)
+
+	l.inHook = true
+	defer func() { l.inHook = false }()
+
+	l.hook(l, ar)
+
+	for i := top; i < len(stk.data); i++ {
+		stk.data[i] = tvalue{}
+	}
+	stk.data = stk.data[:top]
+}
+
+// funcName tries to find a name for the function running in the frame with the given index by looking at the
+// instruction that called it, much like the reference implementation's getfuncname.
+func (l *State) funcName(fi int) (name, what string) {
+	if fi < 2 {
+		return "", "" // Called directly from native code on the base frame.
+	}
+	caller := l.stack.frames[fi-1]
+	if caller.fn == nil || caller.fn.native != nil {
+		return "", ""
+	}
+
+	p := &caller.fn.proto
+	pc := int(caller.pc) - 1
+	if pc < 0 || pc >= len(p.code) {
+		return "", ""
+	}
+
+	i := p.code[pc]
+	switch i.getOpCode() {
+	case opCall, opTailCall:
+		return p.objName(pc, i.a())
+	case opTForCall:
+		return "for iterator", "for iterator"
+
+	// Anything else must have been a meta method.
+	case opSelf, opGetTableUp, opGetTable:
+		return "__index", "metamethod"
+	case opSetTableUp, opSetTable:
+		return "__newindex", "metamethod"
+	case OpAdd, OpSub, OpMul, OpMod, OpPow, OpDiv, OpIDiv, OpBinAND, OpBinOR, OpBinXOR, OpBinShiftL, OpBinShiftR,
+		OpUMinus, OpBinNot:
+		return mathMeta[i.getOpCode()-OpAdd], "metamethod"
+	case opLength:
+		return "__len", "metamethod"
+	case opConcat:
+		return "__concat", "metamethod"
+	case OpEqual:
+		return "__eq", "metamethod"
+	case OpLessThan:
+		return "__lt", "metamethod"
+	case OpLessOrEqual:
+		return "__le", "metamethod"
+	}
+	return "", ""
+}
+
+// localName returns the name of the n'th (0 based) local variable active at the given pc, or "" if there is no
+// such local.
+func (p *funcProto) localName(n, pc int) string {
+	for _, v := range p.localVars {
+		if int(v.sPC) > pc {
+			break
+		}
+		if pc < int(v.ePC) {
+			if n == 0 {
+				return v.name
+			}
+			n--
+		}
+	}
+	return ""
+}
+
+// objName tries to find a name for the value in the given register at the given pc (symbolic execution in the
+// style of the reference getobjname).
+func (p *funcProto) objName(pc, reg int) (name, what string) {
+	if name := p.localName(reg, pc); name != "" {
+		return name, "local"
+	}
+
+	spc := p.findSetReg(pc, reg)
+	if spc < 0 {
+		return "", ""
+	}
+
+	i := p.code[spc]
+	switch i.getOpCode() {
+	case opMove:
+		if b := i.b(); b < i.a() {
+			return p.objName(spc, b)
+		}
+	case opGetTableUp:
+		k := p.constName(i.c())
+		if i.b() < len(p.upVals) && p.upVals[i.b()].name == "_ENV" {
+			return k, "global"
+		}
+		return k, "field"
+	case opGetTable:
+		k := p.constName(i.c())
+		if p.localName(i.b(), spc) == "_ENV" {
+			return k, "global"
+		}
+		return k, "field"
+	case opGetUpValue:
+		if i.b() < len(p.upVals) {
+			return p.upVals[i.b()].name, "upvalue"
+		}
+	case opLoadK:
+		if s, ok := p.constants[i.bx()].ref.(string); ok {
+			return s, "constant"
+		}
+	case opSelf:
+		return p.constName(i.c()), "method"
+	}
+	return "", ""
+}
+
+// constName returns the string constant the given RK refers to, or "?" if it isn't a string constant.
+func (p *funcProto) constName(rk int) string {
+	if !isK(rk) {
+		return "?"
+	}
+	if s, ok := p.constants[indexK(rk)].ref.(string); ok {
+		return s
+	}
+	return "?"
+}
+
+// findSetReg returns the pc of the last instruction before lastpc that changed the given register, or -1 if
+// it can't be determined.
+func (p *funcProto) findSetReg(lastpc, reg int) int {
+	setreg := -1
+	jmptarget := 0
+	for pc := 0; pc < lastpc; pc++ {
+		i := p.code[pc]
+		a := i.a()
+		change := false
+		switch i.getOpCode() {
+		case opLoadNil:
+			change = a <= reg && reg <= a+i.b()
+		case opTForCall:
+			change = reg >= a+2
+		case opCall, opTailCall:
+			change = reg >= a
+		case opJump:
+			// If the jump is forward and does not skip lastpc, everything before the jump target may not
+			// have run.
+			dest := pc + 1 + i.sbx()
+			if pc < dest && dest <= lastpc && dest > jmptarget {
+				jmptarget = dest
+			}
+		case opSetTableUp, opSetUpValue, opSetTable, OpEqual, OpLessThan, OpLessOrEqual, opTest, opReturn,
+			opSetList, opExtraArg:
+			// Don't change register A
+		default:
+			change = reg == a
+		}
+		if change {
+			if pc < jmptarget {
+				setreg = -1
+			} else {
+				setreg = pc
+			}
+		}
+	}
+	return setreg
+}
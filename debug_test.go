@@ -0,0 +1,208 @@
+/*
+Copyright 2016-2017 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua_test
+
+import "testing"
+import "fmt"
+import "strings"
+
+import "github.com/milochristiansen/lua"
+import "github.com/milochristiansen/lua/luautil"
+import "github.com/milochristiansen/lua/testhelp"
+
+// Line numbers in these scripts matter! Don't reformat them.
+const hookScript = `local function add(a, b)
+	return a + b
+end
+local t = {}
+function t.mul(a, b)
+	return a * b
+end
+local x = add(1, 2)
+x = t.mul(x, 2)
+for i = 1, 2 do
+	x = x + i
+end
+return x`
+
+func TestHookCallReturn(t *testing.T) {
+	l := testhelp.MkState()
+
+	events := []string{}
+	l.SetHook(func(l *lua.State, ar *lua.ActivationRecord) {
+		events = append(events, fmt.Sprintf("%v %v %v %v", ar.Event, ar.What, ar.NameWhat, ar.Name))
+	}, lua.MaskCall|lua.MaskReturn, 0)
+
+	loadBlock(t, l, hookScript)
+	l.Call(0, 1)
+	l.SetHook(nil, 0, 0)
+	testhelp.Assertf(t, l.ToInt(-1) == 9, "Unexpected result: %v", l.ToInt(-1))
+
+	expected := []string{
+		"call main  ",
+		"call Lua local add",
+		"return Lua local add",
+		"call Lua field mul",
+		"return Lua field mul",
+		"return main  ",
+	}
+	testhelp.Assertf(t, strings.Join(events, "\n") == strings.Join(expected, "\n"), "Unexpected events:\n%v", strings.Join(events, "\n"))
+}
+
+func TestHookLine(t *testing.T) {
+	l := testhelp.MkState()
+
+	lines := []string{}
+	l.SetHook(func(l *lua.State, ar *lua.ActivationRecord) {
+		lines = append(lines, fmt.Sprint(ar.CurrentLine))
+	}, lua.MaskLine, 0)
+
+	loadBlock(t, l, hookScript)
+	l.Call(0, 1)
+	l.SetHook(nil, 0, 0)
+
+	expected := "1 4 5 8 2 9 6 10 11 10 11 10 13"
+	testhelp.Assertf(t, strings.Join(lines, " ") == expected, "Unexpected lines: %v", strings.Join(lines, " "))
+}
+
+func TestHookCount(t *testing.T) {
+	l := testhelp.MkState()
+
+	n := 0
+	l.SetHook(func(l *lua.State, ar *lua.ActivationRecord) {
+		n++
+
+		// Hooks can use the stack and call functions without messing up the running code.
+		l.Push(ar.CurrentLine)
+		l.Push(true)
+	}, lua.MaskCount, 10)
+
+	loadBlock(t, l, `local x = 0 for i = 1, 100 do x = x + i end return x`)
+	l.Call(0, 1)
+	l.SetHook(nil, 0, 0)
+	testhelp.Assertf(t, l.ToInt(-1) == 5050, "Unexpected result: %v", l.ToInt(-1))
+	testhelp.Assertf(t, n >= 30, "Too few count events: %v", n)
+}
+
+func TestStackInfo(t *testing.T) {
+	l := testhelp.MkState()
+
+	info := []string{}
+	l.Push("where")
+	l.Push(func(l *lua.State) int {
+		for i := 0; ; i++ {
+			ar, ok := l.StackInfo(i)
+			if !ok {
+				break
+			}
+			info = append(info, fmt.Sprintf("%v:%v %v %v", ar.Source, ar.CurrentLine, ar.NameWhat, ar.Name))
+		}
+		return 0
+	})
+	l.SetTableRaw(lua.GlobalsIndex)
+
+	loadBlock(t, l, `local function f()
+		where()
+	end
+	f()`)
+	l.Call(0, 0)
+
+	expected := []string{
+		"(native code):-1 global where",
+		"test:2 local f",
+		"test:4  ",
+	}
+	testhelp.Assertf(t, strings.Join(info, "\n") == strings.Join(expected, "\n"), "Unexpected stack:\n%v", strings.Join(info, "\n"))
+}
+
+func TestXPCall(t *testing.T) {
+	l := testhelp.MkState()
+
+	l.Push(func(l *lua.State) int {
+		l.Push(l.Traceback(l.ToString(1), 1))
+		return 1
+	})
+	loadBlock(t, l, `local function f()
+		error("boom")
+	end
+	f()`)
+	err := l.XPCall(0, 0, -2)
+	testhelp.Assertf(t, err != nil, "Expected an error.")
+	testhelp.Assertf(t, l.AbsIndex(-1) == 1, "Stack not cleaned up: %v items", l.AbsIndex(-1))
+
+	expected := `test:2: boom
+stack traceback:
+	(native code): in function 'error'
+	test:2: in local 'f'
+	test:4: in main chunk`
+	testhelp.Assertf(t, err.Error() == expected, "Unexpected error:\n%v", err)
+
+	testhelp.AssertBlock(t, l, `
+	local function h(m) return "handled: " .. m end
+	local ok, a, b = xpcall(function(a, b) return a + b, a - b end, h, 3, 2)
+	assert(ok and a == 5 and b == 1)
+
+	local ok, msg = xpcall(error, h, "boom")
+	assert(not ok and msg == "handled: boom")
+
+	local ok, msg = xpcall(error, error, "boom")
+	assert(not ok and string.find(msg, "error in error handling"))
+	return true
+	`, true)
+}
+
+func TestErrorFrames(t *testing.T) {
+	l := testhelp.MkState()
+
+	loadBlock(t, l, `local t = {}
+	function t.g()
+		error("boom")
+	end
+	local function f()
+		return t.g()
+	end
+	f()`)
+	err := l.PCall(0, 0)
+	e, ok := err.(luautil.Error)
+	if !ok {
+		t.Fatalf("Expected a luautil.Error, got: %v", err)
+	}
+
+	expected := []luautil.Frame{
+		{Source: "(native code)", Line: -1, LineDefined: -1, Name: "error", NameWhat: "global", Native: true},
+		{Source: "test", Line: 3, LineDefined: 2, TailCall: true},
+		{Source: "test", Line: 8, LineDefined: 0},
+	}
+	testhelp.Assertf(t, len(e.Frames) == len(expected), "Unexpected frame count: %v", len(e.Frames))
+	for i := 0; i < len(e.Frames) && i < len(expected); i++ {
+		testhelp.Assertf(t, e.Frames[i] == expected[i], "Frame %v: expected %#v, got %#v", i, expected[i], e.Frames[i])
+	}
+
+	msg := `test:3: boom
+  Stack Trace:
+    (native code): in function 'error'
+    test:3: in function <test:2>
+    (...tail calls...)
+    test:8: in main chunk`
+	testhelp.Assertf(t, e.Error() == msg, "Unexpected message:\n%v", e.Error())
+}
@@ -71,7 +71,7 @@ func (d dumper) writeConstants(fp *funcProto) {
 	d.writeInt(int32(len(fp.constants)))
 
 	for _, v := range fp.constants {
-		switch v2 := v.(type) {
+		switch v2 := v.value().(type) {
 		case nil:
 			d.writeByte(0) // LUA_TNIL
 
@@ -0,0 +1,57 @@
+//go:build glua
+// +build glua
+
+/*
+Copyright 2016-2017 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua
+
+import (
+	"strings"
+
+	"testing"
+
+	glua "github.com/yuin/gopher-lua"
+)
+
+// The gopher-lua half of BenchmarkA (see fib_test.go). gopher-lua is not vendored, so this only builds with the
+// "glua" tag:
+//	go test -tags glua -bench=. -run=none github.com/milochristiansen/lua
+
+func BenchmarkB(b *testing.B) {
+	l := glua.NewState()
+	exe, err := l.Load(strings.NewReader(source), "fibtest.go")
+	if err != nil {
+		b.Fatal(err)
+		return
+	}
+
+	b.ResetTimer()
+	for i := 1; i < b.N; i++ {
+		l.Push(exe)
+		err := l.PCall(0, 0, nil)
+		if err != nil {
+			b.Fatal(err)
+			return
+		}
+	}
+}
@@ -1,5 +1,3 @@
-// +build ignore
-
 /*
 Copyright 2016-2017 by Milo Christiansen
 
@@ -28,8 +26,6 @@ import (
 	"strings"
 
 	"testing"
-
-	glua "github.com/yuin/gopher-lua"
 )
 
 var source = `
@@ -56,39 +52,66 @@ fib(50)
 // A pair of almost identical benchmarks for comparing performance between this package and gopher-lua.
 // Run with:
 //	go test -bench=. -run=none github.com/milochristiansen/lua
-// Don't forget to remove the build constraint first!
+// BenchmarkB is in fib_glua_test.go, add "-tags glua" to include it (you will need gopher-lua).
 
 func BenchmarkA(b *testing.B) {
-	l := NewState()
+	benchScript(b, source)
+}
 
-	err := l.LoadText(strings.NewReader(source), "fibtest.go", 0)
-	if err != nil {
-		b.Fatal(err)
-	}
+// The rest of these benchmarks are mostly about numbers, which used to allocate every time an instruction produced
+// one. Keep an eye on the allocation counts as well as the times.
 
-	b.ResetTimer()
-	for i := 1; i < b.N; i++ {
-		l.PushIndex(-1)
-		err := l.PCall(0, 0)
-		if err != nil {
-			b.Fatal(err)
-			return
-		}
-	}
+// Lots of function calls.
+func BenchmarkFibRecursive(b *testing.B) {
+	benchScript(b, `
+local function fib(n)
+	if n < 2 then return n end
+	return fib(n - 1) + fib(n - 2)
+end
+fib(20)
+`)
+}
+
+// Integer and float arithmetic in a tight loop.
+func BenchmarkArith(b *testing.B) {
+	benchScript(b, `
+local x, y = 0, 0.5
+for i = 1, 10000 do
+	x = (x + i * 3) % 1000003
+	y = y * 1.0001 + i / 7
+end
+`)
+}
+
+// Filling and reading the array part of a table.
+func BenchmarkTableArray(b *testing.B) {
+	benchScript(b, `
+local t = {}
+for i = 1, 1000 do
+	t[i] = i * 2
+end
+local sum = 0
+for j = 1, 10 do
+	for i = 1, #t do
+		sum = sum + t[i]
+	end
+end
+`)
 }
 
-func BenchmarkB(b *testing.B) {
-	l := glua.NewState()
-	exe, err := l.Load(strings.NewReader(source), "fibtest.go")
+func benchScript(b *testing.B, src string) {
+	l := NewState()
+
+	err := l.LoadText(strings.NewReader(src), "bench", 0)
 	if err != nil {
 		b.Fatal(err)
-		return
 	}
 
+	b.ReportAllocs()
 	b.ResetTimer()
-	for i := 1; i < b.N; i++ {
-		l.Push(exe)
-		err := l.PCall(0, 0, nil)
+	for i := 0; i < b.N; i++ {
+		l.PushIndex(-1)
+		err := l.PCall(0, 0)
 		if err != nil {
 			b.Fatal(err)
 			return
@@ -30,7 +30,7 @@ import "text/tabwriter"
 // Internally the compiler uses the debug info fields to keep track of some things, but they may
 // be striped later and/or never set if a striped binary is loaded directly.
 type funcProto struct {
-	constants  []value
+	constants  []tvalue
 	code       []instruction
 	prototypes []funcProto
 	lineInfo   []int // Debug info
@@ -82,7 +82,7 @@ func (f funcProto) str(prefix string) string {
 		case 2:
 			if isK(i.b()) {
 				iout = fmt.Sprintf("%s\tB:k(%d)", iout, indexK(i.b()))
-				extra = fmt.Sprintf("%s BK:%v", extra, f.constants[indexK(i.b())])
+				extra = fmt.Sprintf("%s BK:%v", extra, f.constants[indexK(i.b())].value())
 			} else {
 				iout = fmt.Sprintf("%s\tB:r(%d)", iout, i.b())
 			}
@@ -106,7 +106,7 @@ func (f funcProto) str(prefix string) string {
 		case 2:
 			if isK(i.c()) {
 				iout = fmt.Sprintf("%s\tC:k(%d)", iout, indexK(i.c()))
-				extra = fmt.Sprintf("%s CK:%v", extra, f.constants[indexK(i.c())])
+				extra = fmt.Sprintf("%s CK:%v", extra, f.constants[indexK(i.c())].value())
 			} else {
 				iout = fmt.Sprintf("%s\tC:r(%d)", iout, i.c())
 			}
@@ -147,7 +147,7 @@ func (f funcProto) str(prefix string) string {
 		fmt.Fprintf(out, "%v  None.\n", prefix)
 	}
 	for i, v := range f.constants {
-		fmt.Fprintf(w, "%v  [%v]\t%#v\n", prefix, i, v)
+		fmt.Fprintf(w, "%v  [%v]\t%#v\n", prefix, i, v.value())
 	}
 	w.Flush()
 
@@ -196,8 +196,9 @@ type upValue struct {
 
 	// closure information
 	closed bool
-	val    value // closed
-	absIdx int   // isLocal && !closed (absolute stack index)
+	val    tvalue // closed
+	absIdx int    // isLocal && !closed (absolute stack index)
+	stk    *stack // isLocal && !closed (the stack absIdx is an index into, may belong to another thread)
 
 	// Unclosed link info, nil if not part of the unclosed list (the head pointer is part of the stack)
 	next *upValue
@@ -219,7 +220,7 @@ func (f *function) addUp(v value) int {
 	i := len(f.up)
 	f.up = append(f.up, &upValue{
 		closed: true,
-		val:    v,
+		val:    tv(v),
 		name:   "(native upvalue)",
 		index:  -1,
 		absIdx: -1,
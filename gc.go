@@ -0,0 +1,126 @@
+/*
+Copyright 2016-2017 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua
+
+import "runtime"
+import "sync"
+import "sync/atomic"
+
+// Finalizer support.
+//
+// When a table or userdata value is given a metatable with a __gc field it is marked for finalization with
+// runtime.SetFinalizer. Go runs finalizers on a goroutine of its own, where it is not safe to touch the State, so
+// the Go finalizer simply adds the object to a queue. The queue is drained (and the __gc meta methods called) at
+// safe points: when Call (or PCall) is called or when RunFinalizers is called explicitly.
+//
+// Like with the reference implementation an object is only marked for finalization if its metatable has a __gc
+// field when the metatable is set. The __gc field is looked up again when the finalizer is actually run, so it may
+// be changed later (and if it is removed the object is simply dropped).
+//
+// Keep in mind that Go will never finalize an object that is part of a reference cycle, so an object that can
+// reach itself (for example because its __gc meta method has it as an upvalue) will never be finalized!
+
+// gcQueue holds objects that are ready to be finalized.
+type gcQueue struct {
+	lock    sync.Mutex
+	queue   []value
+	pending int32 // Accessed atomically, non-zero if queue has items.
+	running bool  // Set while finalizers are running, so they don't try to run recursively.
+}
+
+func (q *gcQueue) add(v value) {
+	q.lock.Lock()
+	q.queue = append(q.queue, v)
+	atomic.StoreInt32(&q.pending, 1)
+	q.lock.Unlock()
+}
+
+func (q *gcQueue) take() []value {
+	q.lock.Lock()
+	vs := q.queue
+	q.queue = nil
+	atomic.StoreInt32(&q.pending, 0)
+	q.lock.Unlock()
+	return vs
+}
+
+// markForFinalize sets a Go finalizer for the given table or userdata if the new metatable has a __gc field and
+// the object has not already been marked.
+func (l *State) markForFinalize(v value, meta *table) {
+	if meta == nil || meta.GetRaw("__gc") == nil {
+		return
+	}
+
+	q := &l.finalizers
+	switch v2 := v.(type) {
+	case *table:
+		if !v2.finalize {
+			v2.finalize = true
+			runtime.SetFinalizer(v2, func(t *table) { q.add(t) })
+		}
+	case *userData:
+		if !v2.finalize {
+			v2.finalize = true
+			runtime.SetFinalizer(v2, func(u *userData) { q.add(u) })
+		}
+	}
+}
+
+// RunFinalizers calls the __gc meta methods of all objects that were collected since the last time finalizers
+// were run. If any of the finalizers raise an error the first error is returned (the other finalizers are still run).
+//
+// Finalizers are also run automatically every time Call or PCall is called, but errors raised by finalizers run
+// that way are discarded. Finalizers will not run while other finalizers are running.
+func (l *State) RunFinalizers() error {
+	q := &l.finalizers
+	if q.running {
+		return nil
+	}
+	q.running = true
+	defer func() { q.running = false }()
+
+	var first error
+	for atomic.LoadInt32(&q.pending) != 0 {
+		for _, v := range q.take() {
+			meth := l.hasMetaMethod(v, "__gc")
+			if meth == nil {
+				continue
+			}
+
+			l.stack.Push(meth)
+			l.stack.Push(v)
+			err := l.PCall(1, 0)
+			if err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// maybeRunFinalizers runs any pending finalizers. This is very cheap if there is nothing to do.
+func (l *State) maybeRunFinalizers() {
+	if atomic.LoadInt32(&l.finalizers.pending) != 0 && !l.finalizers.running {
+		l.RunFinalizers()
+	}
+}
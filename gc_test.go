@@ -0,0 +1,156 @@
+/*
+Copyright 2016-2017 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua_test
+
+import "testing"
+import "runtime"
+import "time"
+
+import "github.com/milochristiansen/lua"
+import "github.com/milochristiansen/lua/testhelp"
+
+// collect runs the Go collector until the given State has run at least n finalizers (as counted by the global
+// "collected") or it gives up.
+func collect(t *testing.T, l *lua.State, n int64) int64 {
+	count := int64(0)
+	for i := 0; i < 100 && count < n; i++ {
+		runtime.GC()
+		time.Sleep(time.Millisecond)
+
+		err := l.RunFinalizers()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		l.Push("collected")
+		l.GetTableRaw(lua.GlobalsIndex)
+		count = l.ToInt(-1)
+		l.Pop(1)
+	}
+	return count
+}
+
+func TestFinalizers(t *testing.T) {
+	l := testhelp.MkState()
+
+	loadBlock(t, l, `
+	collected = 0
+	local meta = {__gc = function(o) collected = collected + 1 end}
+	for i = 1, 10 do
+		setmetatable({}, meta)
+	end
+
+	-- Not marked, __gc was added after the metatable was set.
+	local meta = {}
+	setmetatable({}, meta)
+	meta.__gc = function(o) collected = collected + 100 end
+	`)
+	err := l.PCall(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := collect(t, l, 10)
+	testhelp.Assertf(t, count == 10, "Unexpected finalizer count: %v", count)
+
+	// Userdata values created by native code.
+	closed := 0
+	l.NewTable(0, 1)
+	l.Push("__gc")
+	l.Push(func(l *lua.State) int {
+		closed++
+		return 0
+	})
+	l.SetTableRaw(-3)
+	for i := 0; i < 10; i++ {
+		l.Push(&struct{ i int }{i})
+		l.PushIndex(-2)
+		l.SetMetaTable(-2)
+		l.Pop(1)
+	}
+	l.Pop(1)
+
+	for i := 0; i < 100 && closed < 10; i++ {
+		runtime.GC()
+		time.Sleep(time.Millisecond)
+
+		// Finalizers run automatically when a function is called.
+		l.Push(func(l *lua.State) int { return 0 })
+		l.Call(0, 0)
+	}
+	testhelp.Assertf(t, closed == 10, "Unexpected userdata finalizer count: %v", closed)
+}
+
+func TestWeakTables(t *testing.T) {
+	l := testhelp.MkState()
+
+	loadBlock(t, l, `
+	keep = {}
+	weakk = setmetatable({}, {__mode = "k"})
+	weakv = setmetatable({}, {__mode = "v"})
+	for i = 1, 10 do
+		weakk[{}] = i
+		weakv[i] = {}
+	end
+	weakk[keep] = 1
+	weakv[11] = keep
+	weakv.x = "strings are not collectable"
+
+	-- Converting an existing table.
+	weakkv = {1, 2, function() end}
+	weakkv[{}] = 3
+	setmetatable(weakkv, {__mode = "kv"})
+	`)
+	err := l.PCall(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runtime.GC()
+	runtime.GC()
+
+	testhelp.AssertBlock(t, l, `
+	local n = 0
+	for k, v in pairs(weakk) do
+		assert(k == keep and v == 1)
+		n = n + 1
+	end
+	assert(n == 1 and weakk[keep] == 1)
+
+	n = 0
+	for k, v in pairs(weakv) do n = n + 1 end
+	assert(n == 2 and weakv[11] == keep and #weakv == 0)
+
+	n = 0
+	for k, v in pairs(weakkv) do n = n + 1 end
+	assert(n == 2 and #weakkv == 2)
+
+	-- Setting and clearing keys still works as expected.
+	weakk[keep] = nil
+	assert(next(weakk) == nil)
+	weakv[1] = keep
+	weakv[2] = keep
+	assert(#weakv == 2)
+	return true
+	`, true)
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2016-2017 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua
+
+import "context"
+import "math"
+
+import "github.com/milochristiansen/lua/luautil"
+
+// How many instructions may run between context checks. Checking a context is not free, so doing it for every
+// instruction would be a bad idea.
+const checkInterval = 1000
+
+// The default stack limits, these are roughly what the reference implementation allows. Every call to a Lua
+// function uses some of the Go stack as well (the VM calls itself recursively), a few hundred bytes for a simple
+// function, so the default call depth stays well below the point where the Go runtime would give up.
+const (
+	DefaultCallDepth  = 200000
+	DefaultStackSlots = 1000000
+)
+
+// How far the stack limits may be exceeded while an XPCall message handler is handling a stack overflow.
+const (
+	extraFrames = 200
+	extraSlots  = 10000
+)
+
+// stackLimits holds the maximum call depth and the maximum number of stack slots.
+type stackLimits struct {
+	depth int
+	slots int
+}
+
+// SetStackLimits sets the maximum number of nested calls and the maximum number of values on the stack (for all
+// frames together). When either limit would be exceeded an error with the message "stack overflow" is raised.
+// Pass 0 (or less) to use the default for a limit, see DefaultCallDepth and DefaultStackSlots.
+//
+// The limits are shared by all threads created from a State, but each thread has its own stack. Calls from native
+// code (Call, PCall, etc) count towards the call depth just like calls from Lua code.
+func (l *State) SetStackLimits(depth, slots int) {
+	if depth <= 0 {
+		depth = DefaultCallDepth
+	}
+	if slots <= 0 {
+		slots = DefaultStackSlots
+	}
+	l.stackLimits.depth = depth
+	l.stackLimits.slots = slots
+}
+
+// StackLimits returns the current maximum call depth and maximum number of stack slots, see SetStackLimits.
+func (l *State) StackLimits() (depth, slots int) {
+	return l.stackLimits.depth, l.stackLimits.slots
+}
+
+// SetInstructionLimit sets the number of VM instructions that may be run before an error of type
+// luautil.ErrTypInterrupted is raised. Pass a negative value to remove the limit.
+//
+// The limit is shared by all threads created from a State, and it is not reset automatically. Once the limit is
+// reached *every* instruction will raise an error (so scripts cannot use pcall to ignore it) until you call this
+// function again. Native functions do not count towards the limit.
+func (l *State) SetInstructionLimit(n int64) {
+	l.limited = n >= 0
+	l.instLimit = n
+	l.lastCount = l.countdown // Make sure no instructions are subtracted from the new limit.
+	l.recount()
+}
+
+// InstructionsLeft returns the number of instructions that may be run before the instruction limit is reached,
+// or -1 if there is no limit.
+func (l *State) InstructionsLeft() int64 {
+	if !l.limited {
+		return -1
+	}
+	l.recount()
+	return l.instLimit
+}
+
+// PCallContext is exactly like PCall, except if the given context is canceled (or reaches its deadline) while
+// the function is running an error of type luautil.ErrTypInterrupted is raised (and returned).
+//
+// The context is only checked every so often, so execution may continue for a (very) short time after it is
+// canceled. Execution will not be interrupted while a native function is running.
+func (l *State) PCallContext(ctx context.Context, args, rtns int) error {
+	old := l.ctx
+	l.ctx = ctx
+	l.recount()
+	defer func() {
+		l.ctx = old
+		l.recount()
+	}()
+
+	return l.PCall(args, rtns)
+}
+
+// recount subtracts the instructions run since the last call from the instruction limit, then figures out
+// how many instructions may run before the next checkpoint.
+func (g *globalState) recount() {
+	if g.limited {
+		g.instLimit -= g.lastCount - g.countdown
+		if g.instLimit < 0 {
+			g.instLimit = 0
+		}
+	}
+
+	n := int64(math.MaxInt64)
+	if g.ctx != nil {
+		n = checkInterval
+		if g.ctx.Err() != nil {
+			n = 0
+		}
+	}
+	if g.limited && g.instLimit < n {
+		n = g.instLimit
+	}
+	g.countdown, g.lastCount = n, n
+}
+
+// checkpoint is called by the VM when the countdown to the next check runs out. It raises an error if the
+// instruction limit was reached or the current context is done.
+func (l *State) checkpoint() {
+	l.recount()
+
+	if l.limited && l.instLimit <= 0 {
+		luautil.Raise("Instruction limit exceeded.", luautil.ErrTypInterrupted)
+	}
+	if l.ctx != nil {
+		if err := l.ctx.Err(); err != nil {
+			panic(luautil.Error{Msg: "Execution interrupted", Type: luautil.ErrTypInterrupted, Err: err})
+		}
+	}
+}
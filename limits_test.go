@@ -0,0 +1,178 @@
+/*
+Copyright 2016-2017 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua_test
+
+import "testing"
+import "strings"
+import "context"
+import "time"
+
+import "github.com/milochristiansen/lua"
+import "github.com/milochristiansen/lua/luautil"
+import "github.com/milochristiansen/lua/testhelp"
+
+func loadBlock(t *testing.T, l *lua.State, blk string) {
+	err := l.LoadText(strings.NewReader(blk), "test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertInterrupted(t *testing.T, err error) {
+	e, ok := err.(luautil.Error)
+	if !ok || e.Type != luautil.ErrTypInterrupted {
+		t.Errorf("Expected an interrupted error, got: %v", err)
+	}
+}
+
+func TestInstructionLimit(t *testing.T) {
+	l := testhelp.MkState()
+
+	l.SetInstructionLimit(10000)
+	loadBlock(t, l, `while true do end`)
+	assertInterrupted(t, l.PCall(0, 0))
+	testhelp.Assertf(t, l.InstructionsLeft() == 0, "Unexpected instruction count: %v", l.InstructionsLeft())
+
+	// pcall cannot be used to ignore the limit.
+	l.SetInstructionLimit(10000)
+	loadBlock(t, l, `while true do pcall(function() while true do end end) end`)
+	assertInterrupted(t, l.PCall(0, 0))
+
+	// The State must still be usable once the limit is changed.
+	l.SetInstructionLimit(-1)
+	testhelp.Assert(t, l.InstructionsLeft() == -1, "Limit was not removed.")
+	testhelp.AssertBlock(t, l, `local x = 0 for i = 1, 10000 do x = x + i end return x`, 50005000)
+
+	// Make sure the count is exact.
+	l.SetInstructionLimit(100)
+	loadBlock(t, l, `local x = 0 for i = 1, 10 do x = x + i end return x`)
+	testhelp.Assert(t, l.PCall(0, 1) == nil, "Short script was interrupted.")
+	testhelp.Assertf(t, l.InstructionsLeft() < 100 && l.InstructionsLeft() > 50, "Unexpected instruction count: %v", l.InstructionsLeft())
+}
+
+func TestPCallContext(t *testing.T) {
+	l := testhelp.MkState()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	loadBlock(t, l, `while true do end`)
+	err := l.PCallContext(ctx, 0, 0)
+	assertInterrupted(t, err)
+	testhelp.Assertf(t, err.(luautil.Error).Err == context.DeadlineExceeded, "Wrong wrapped error: %v", err)
+
+	// A canceled context from a previous call must not affect later calls.
+	testhelp.AssertBlock(t, l, `return 1 + 2`, 3)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	loadBlock(t, l, `local x = 0 for i = 1, 1e9 do x = x + i end return x`)
+	assertInterrupted(t, l.PCallContext(ctx, 0, 1))
+}
+
+func TestMemoryLimit(t *testing.T) {
+	l := testhelp.MkState()
+
+	l.SetAllocationLimit(1 << 20)
+	l.ResetAllocatedBytes()
+
+	loadBlock(t, l, `local t = {} for i=1,1e9 do t[i]=("x"):rep(1e6) end`)
+	err := l.PCall(0, 0)
+	e, ok := err.(luautil.Error)
+	if !ok || e.Type != luautil.ErrTypMemory {
+		t.Errorf("Expected a memory error, got: %v", err)
+	}
+	testhelp.Assertf(t, l.AllocatedBytes() <= 1<<20, "Memory usage over limit: %v", l.AllocatedBytes())
+
+	// The error must be catchable by scripts.
+	testhelp.AssertBlock(t, l, `
+		local ok, err = pcall(function()
+			local s = "x"
+			while true do s = s .. s end
+		end)
+		return not ok and string.find(err, "memory limit exceeded") ~= nil
+	`, true)
+
+	// Small allocations should be counted too.
+	l.SetAllocationLimit(0)
+	before := l.AllocatedBytes()
+	testhelp.AssertBlock(t, l, `local t = {} for i = 1, 100 do t[i] = {} t["k"..i] = function() return i end end`, nil)
+	testhelp.Assertf(t, l.AllocatedBytes() > before+100*64, "Memory usage not counted: %v", l.AllocatedBytes()-before)
+}
+
+func TestStackOverflow(t *testing.T) {
+	l := testhelp.MkState()
+	l.SetStackLimits(500, 0)
+
+	loadBlock(t, l, `local function f() return 1 + f() end f()`)
+	err := l.PCall(0, 0)
+	e, ok := err.(luautil.Error)
+	if !ok || e.Msg != "stack overflow" {
+		t.Errorf("Expected a stack overflow, got: %v", err)
+	}
+
+	// Calls from native code count too.
+	l.Push(func(l *lua.State) int {
+		l.PushIndex(1)
+		l.Call(0, 0)
+		return 0
+	})
+	l.SetGlobal("native")
+	loadBlock(t, l, `local function f() native(f) end f()`)
+	err = l.PCall(0, 0)
+	e, ok = err.(luautil.Error)
+	if !ok || e.Msg != "stack overflow" {
+		t.Errorf("Expected a stack overflow, got: %v", err)
+	}
+
+	// The error must be catchable by scripts, and the State must still be usable afterwards.
+	testhelp.AssertBlock(t, l, `
+		local depth = 0
+		local function f() depth = depth + 1; f() end
+		local ok, err = pcall(f)
+		assert(not ok and err == "stack overflow" and depth > 400 and depth < 500, err)
+
+		-- Message handlers get a little room to work with.
+		ok, err = xpcall(f, function(m) return "handled: " .. m end)
+		assert(not ok and err == "handled: stack overflow", err)
+
+		local t = setmetatable({}, {__index = function(t, k) return t[k] end})
+		ok, err = pcall(function() return t.x end)
+		assert(not ok and err == "stack overflow", err)
+
+		local a, b = {}, {}
+		setmetatable(a, {__index = b})
+		setmetatable(b, {__index = a})
+		ok, err = pcall(function() return a.x end)
+		assert(not ok and err == "'__index' chain too long; possible loop", err)
+
+		ok, err = pcall(table.unpack, {}, 1, 1e6)
+		assert(not ok and err == "stack overflow", err)
+
+		local function count(n) if n == 0 then return 0 end return 1 + count(n - 1) end
+		return count(400)
+	`, 400)
+
+	d, s := l.StackLimits()
+	testhelp.Assertf(t, d == 500 && s == lua.DefaultStackSlots, "Unexpected limits: %v %v", d, s)
+}
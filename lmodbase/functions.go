@@ -36,9 +36,8 @@ import "github.com/milochristiansen/lua/luautil"
 //	collectgarbage
 //	dofile
 //	loadfile
-//	xpcall
 func Open(l *lua.State) int {
-	l.NewTable(0, 32) // 19 standard functions (+4 DNI)
+	l.NewTable(0, 32) // 20 standard functions (+3 DNI)
 	tidx := l.AbsIndex(-1)
 
 	l.SetTableFunctions(tidx, functions)
@@ -64,15 +63,22 @@ var functions = map[string]lua.NativeFunction{
 			return l.AbsIndex(-1)
 		}
 
-		msg := l.OptString(2, "Assertion Failed!")
-		l.Push(msg)
+		if l.IsNil(2) {
+			l.Push("Assertion Failed!")
+		} else {
+			l.PushIndex(2)
+		}
 		l.Error()
 		return 0
 	},
 	// collectgarbage, DNI: I use the Go collector, so many of the uses for this function make no sense.
 	// dofile, DNI: This VM will not provide file IO.
 	"error": func(l *lua.State) int {
-		// TODO: Support level (optional second arg) once proper stack traces are working
+		level := int(l.OptInt(2, 1))
+		if l.TypeOf(1) == lua.TypString && level > 0 {
+			l.Push(l.Where(level) + l.ToString(1))
+			l.Error()
+		}
 		l.PushIndex(1)
 		l.Error()
 		return 0
@@ -101,23 +107,30 @@ var functions = map[string]lua.NativeFunction{
 			return 2
 		})
 		l.PushIndex(1)
-		l.Push(int64(0))
+		l.Push(int64(l.IndexBase() - 1))
 		return 3
 	},
 	"load": func(l *lua.State) int {
 		chunk := ""
 		name := ""
 		if l.TypeOf(1) != lua.TypString {
-			l.PushIndex(1)
-			l.Call(0, 1)
-			v := l.OptString(-1, "")
-			l.Pop(1)
-			for v != "" {
-				chunk += v
+			for {
 				l.PushIndex(1)
 				l.Call(0, 1)
-				v = l.OptString(-1, "")
+				if l.IsNil(-1) {
+					l.Pop(1)
+					break
+				}
+				if l.TypeOf(-1) != lua.TypString {
+					l.Push("reader function must return a string")
+					l.Error()
+				}
+				v := l.ToString(-1)
 				l.Pop(1)
+				if v == "" {
+					break
+				}
+				chunk += v
 			}
 
 			name = l.OptString(2, "=(load)")
@@ -166,7 +179,6 @@ var functions = map[string]lua.NativeFunction{
 	},
 	// loadfile, DNI: This VM will not provide file IO.
 	"next": func(l *lua.State) int {
-		// WARNING: next is not reentrant! Use getiter for most cases.
 		l.PushIndex(2)
 		l.Next(1)
 		if l.TypeOf(-1) == lua.TypNil {
@@ -177,7 +189,7 @@ var functions = map[string]lua.NativeFunction{
 	"getiter": func(l *lua.State) int {
 		// Get an iterator for the given table. Call the returned value to get key/value pairs.
 		// The iterator is self contained and does not need access to the original table.
-		// Like next modifying the table during iteration may produce weirdness.
+		// Like next adding keys to the table during iteration may produce weirdness.
 		l.GetIter(1)
 		return 1
 	},
@@ -189,8 +201,8 @@ var functions = map[string]lua.NativeFunction{
 			return 3
 		}
 
-		// pairs does NOT use the default next! Instead I use a custom iterator to get around the fact
-		// that next is not reentrant.
+		// pairs does NOT use the default next! It returns the same iterator as getiter, which used to be
+		// needed because next was not reentrant. Now that next is stateless either would work.
 		l.GetIter(1)
 		l.PushIndex(1) // The iterator does not actually use the table and first key.
 		l.Push(nil)
@@ -203,7 +215,7 @@ var functions = map[string]lua.NativeFunction{
 		err := l.PCall(l.AbsIndex(-1)-2, -1)
 		if err != nil {
 			l.Push(false)
-			l.Push(err.Error())
+			l.PushError(err)
 			return 2
 		}
 		return l.AbsIndex(-1) - 1
@@ -274,5 +286,25 @@ var functions = map[string]lua.NativeFunction{
 		l.Push(l.TypeOf(1).String())
 		return 1
 	},
-	// xpcall, DNI: Meaningless, as this VM has no concept of a message handler.
+	"xpcall": func(l *lua.State) int {
+		top := l.AbsIndex(-1)
+		if top < 2 {
+			luautil.Raise("Bad argument #2 to xpcall, value expected.", luautil.ErrTypGenRuntime)
+		}
+
+		// The handler needs to stay put, so copy the function and its arguments to the top of the stack.
+		l.Push(true)
+		l.PushIndex(1)
+		for i := 3; i <= top; i++ {
+			l.PushIndex(i)
+		}
+
+		err := l.XPCall(top-2, -1, 2)
+		if err != nil {
+			l.Push(false)
+			l.PushError(err)
+			return 2
+		}
+		return l.AbsIndex(-1) - top
+	},
 }
@@ -0,0 +1,134 @@
+/*
+Copyright 2016-2017 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lmodcoroutine
+
+import "github.com/milochristiansen/lua"
+import "github.com/milochristiansen/lua/luautil"
+
+// Open loads the "coroutine" module when executed with "lua.(*State).Call".
+//
+// It would also be possible to use this with "lua.(*State).Require" (which has some side effects that
+// are inappropriate for a core library like this) or "lua.(*State).Preload" (which makes even less
+// sense for a core library).
+func Open(l *lua.State) int {
+	l.NewTable(0, 8) // 7 standard functions
+	tidx := l.AbsIndex(-1)
+
+	l.SetTableFunctions(tidx, functions)
+
+	l.Push("coroutine")
+	l.PushIndex(tidx)
+	l.SetTableRaw(lua.GlobalsIndex)
+
+	// Sanity check
+	if l.AbsIndex(-1) != tidx {
+		panic("Ouch!")
+	}
+	return 1
+}
+
+// create makes a new thread from the function at index i, leaving the thread on the stack.
+func create(l *lua.State, i int) *lua.State {
+	if l.TypeOf(i) != lua.TypFunction {
+		luautil.Raise("Value passed to coroutine.create or coroutine.wrap is not a function.", luautil.ErrTypGenRuntime)
+	}
+
+	co := l.NewThread()
+	l.PushIndex(i)
+	l.XMove(co, 1)
+	return co
+}
+
+// resume passes the top n values of l to co and resumes it. If co yields or returns the results are
+// moved to l.
+func resume(l, co *lua.State, n int) (int, error) {
+	switch co.Status() {
+	case lua.ThreadSuspended:
+	case lua.ThreadDead:
+		return 0, luautil.Error{Msg: "cannot resume dead coroutine", Type: luautil.ErrTypGenRuntime}
+	default:
+		return 0, luautil.Error{Msg: "cannot resume non-suspended coroutine", Type: luautil.ErrTypGenRuntime}
+	}
+
+	l.XMove(co, n)
+	rtns, err := co.Resume(l, n)
+	if err != nil {
+		return 0, err
+	}
+	co.XMove(l, rtns)
+	return rtns, nil
+}
+
+var functions = map[string]lua.NativeFunction{
+	"create": func(l *lua.State) int {
+		create(l, 1)
+		return 1
+	},
+	"isyieldable": func(l *lua.State) int {
+		l.Push(l.IsYieldable())
+		return 1
+	},
+	"resume": func(l *lua.State) int {
+		co := l.ToThread(1)
+		n := l.AbsIndex(-1) - 1
+
+		l.Push(true)
+		if n > 0 {
+			l.Insert(2)
+		}
+
+		rtns, err := resume(l, co, n)
+		if err != nil {
+			l.Push(false)
+			l.PushError(err)
+			return 2
+		}
+		return rtns + 1
+	},
+	"running": func(l *lua.State) int {
+		l.Push(l)
+		l.Push(!l.IsYieldable())
+		return 2
+	},
+	"status": func(l *lua.State) int {
+		l.Push(l.ToThread(1).Status().String())
+		return 1
+	},
+	"wrap": func(l *lua.State) int {
+		create(l, 1)
+		l.PushClosure(func(l *lua.State) int {
+			co := l.ToThread(lua.FirstUpVal - 1)
+
+			rtns, err := resume(l, co, l.AbsIndex(-1))
+			if err != nil {
+				l.PushError(err)
+				l.Error()
+			}
+			return rtns
+		}, -1)
+		return 1
+	},
+	"yield": func(l *lua.State) int {
+		return l.Yield(l.AbsIndex(-1))
+	},
+}
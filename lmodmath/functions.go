@@ -39,7 +39,7 @@ func Open(l *lua.State) int {
 	l.SetTableFunctions(tidx, functions)
 
 	l.Push("huge")
-	l.Push(math.MaxFloat64)
+	l.Push(math.Inf(1))
 	l.SetTableRaw(tidx)
 
 	l.Push("maxinteger")
@@ -78,44 +78,44 @@ var functions = map[string]lua.NativeFunction{
 			}
 		}
 
-		f := l.ToFloat(1)
+		f := l.CheckNumber(1)
 		f = math.Abs(f)
 		l.Push(f)
 		return 1
 	},
 	"acos": func(l *lua.State) int {
-		l.Push(math.Acos(l.ToFloat(1)))
+		l.Push(math.Acos(l.CheckNumber(1)))
 		return 1
 	},
 	"asin": func(l *lua.State) int {
-		l.Push(math.Asin(l.ToFloat(1)))
+		l.Push(math.Asin(l.CheckNumber(1)))
 		return 1
 	},
 	"atan": func(l *lua.State) int {
-		y := l.ToFloat(1)
-		x := l.OptFloat(2, 1)
+		y := l.CheckNumber(1)
+		x := l.CheckOptNumber(2, 1)
 
 		l.Push(math.Atan2(y, x))
 		return 1
 	},
 	"ceil": func(l *lua.State) int {
-		l.Push(math.Ceil(l.ToFloat(1)))
+		l.Push(math.Ceil(l.CheckNumber(1)))
 		return 1
 	},
 	"cos": func(l *lua.State) int {
-		l.Push(math.Cos(l.ToFloat(1)))
+		l.Push(math.Cos(l.CheckNumber(1)))
 		return 1
 	},
 	"deg": func(l *lua.State) int {
-		l.Push(l.ToFloat(1) * (180 / math.Pi)) // This will probably yield a more precise value than standard Lua due to Go's constant math.
+		l.Push(l.CheckNumber(1) * (180 / math.Pi)) // This will probably yield a more precise value than standard Lua due to Go's constant math.
 		return 1
 	},
 	"exp": func(l *lua.State) int {
-		l.Push(math.Exp(l.ToFloat(1)))
+		l.Push(math.Exp(l.CheckNumber(1)))
 		return 1
 	},
 	"floor": func(l *lua.State) int {
-		l.Push(math.Floor(l.ToFloat(1)))
+		l.Push(math.Floor(l.CheckNumber(1)))
 		return 1
 	},
 	"fmod": func(l *lua.State) int {
@@ -123,24 +123,29 @@ var functions = map[string]lua.NativeFunction{
 			i1, ok1 := l.TryInt(1)
 			i2, ok2 := l.TryInt(2)
 			if ok1 && ok2 {
+				if i2 == 0 {
+					l.ArgError(2, "zero")
+				}
 				l.Push(i1 % i2)
 				return 1
 			}
 		}
 
-		l.Push(math.Mod(l.ToFloat(1), l.ToFloat(2)))
+		l.Push(math.Mod(l.CheckNumber(1), l.CheckNumber(2)))
 		return 1
 	},
 	"log": func(l *lua.State) int { // ??? I hate math like this...
-		x := l.ToFloat(1)
-		base := l.OptFloat(2, math.E)
+		x := l.CheckNumber(1)
+		base := l.CheckOptNumber(2, math.E)
 		l.Push(math.Log(x) / math.Log(base))
 		return 1
 	},
 	"max": func(l *lua.State) int {
 		top := l.AbsIndex(-1)
 		max := 1
-		for i := 1; i <= top; i++ {
+		l.CheckNumber(1)
+		for i := 2; i <= top; i++ {
+			l.CheckNumber(i)
 			if l.Compare(max, i, lua.OpLessThan) {
 				max = i
 			}
@@ -151,7 +156,9 @@ var functions = map[string]lua.NativeFunction{
 	"min": func(l *lua.State) int {
 		top := l.AbsIndex(-1)
 		min := 1
-		for i := 1; i <= top; i++ {
+		l.CheckNumber(1)
+		for i := 2; i <= top; i++ {
+			l.CheckNumber(i)
 			if l.Compare(i, min, lua.OpLessThan) {
 				min = i
 			}
@@ -160,7 +167,7 @@ var functions = map[string]lua.NativeFunction{
 		return 1
 	},
 	"modf": func(l *lua.State) int {
-		a, b := math.Modf(l.ToFloat(1))
+		a, b := math.Modf(l.CheckNumber(1))
 		l.Push(a)
 		if i, ok := l.TryInt(-1); ok {
 			l.Pop(1)
@@ -170,37 +177,45 @@ var functions = map[string]lua.NativeFunction{
 		return 2
 	},
 	"rad": func(l *lua.State) int {
-		l.Push(l.ToFloat(1) * (math.Pi / 180))
+		l.Push(l.CheckNumber(1) * (math.Pi / 180))
 		return 1
 	},
 	"random": func(l *lua.State) int {
+		var m, n int64
 		switch l.AbsIndex(-1) {
 		case 0:
 			l.Push(rand.Float64())
+			return 1
 		case 1:
-			// The range for Int63n is NOT inclusive!
-			l.Push(rand.Int63n(l.ToInt(1)) + 1)
+			m, n = 1, l.CheckInt(1)
+		case 2:
+			m, n = l.CheckInt(1), l.CheckInt(2)
 		default:
-			m := l.ToInt(1)
-			n := l.ToInt(2)
-			l.Push(rand.Int63n(n-m+1) + m)
+			l.Push("wrong number of arguments")
+			l.Error()
 		}
+		if m > n {
+			l.ArgError(l.AbsIndex(-1), "interval is empty")
+		}
+
+		// The range for Int63n is NOT inclusive!
+		l.Push(rand.Int63n(n-m+1) + m)
 		return 1
 	},
 	"randomseed": func(l *lua.State) int {
-		rand.Seed(l.ToInt(1))
+		rand.Seed(int64(l.CheckNumber(1)))
 		return 0
 	},
 	"sin": func(l *lua.State) int {
-		l.Push(math.Sin(l.ToFloat(1)))
+		l.Push(math.Sin(l.CheckNumber(1)))
 		return 1
 	},
 	"sqrt": func(l *lua.State) int {
-		l.Push(math.Sqrt(l.ToFloat(1)))
+		l.Push(math.Sqrt(l.CheckNumber(1)))
 		return 1
 	},
 	"tan": func(l *lua.State) int {
-		l.Push(math.Tan(l.ToFloat(1)))
+		l.Push(math.Tan(l.CheckNumber(1)))
 		return 1
 	},
 	"tointeger": func(l *lua.State) int {
@@ -212,6 +227,7 @@ var functions = map[string]lua.NativeFunction{
 		return 1
 	},
 	"type": func(l *lua.State) int {
+		l.CheckAny(1)
 		switch l.SubTypeOf(1) {
 		case lua.STypInt:
 			l.Push("integer")
@@ -223,8 +239,8 @@ var functions = map[string]lua.NativeFunction{
 		return 1
 	},
 	"ult": func(l *lua.State) int {
-		i1 := uint64(l.ToInt(1))
-		i2 := uint64(l.ToInt(2))
+		i1 := uint64(l.CheckInt(1))
+		i2 := uint64(l.CheckInt(2))
 
 		l.Push(i1 < i2)
 		return 1
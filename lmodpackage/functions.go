@@ -71,7 +71,7 @@ func Open(l *lua.State) int {
 	l.Push("searchers")
 	l.NewTable(8, 0)
 	// I only add the preload searcher, other searchers are up to the client.
-	l.Push(int64(1))
+	l.Push(int64(l.IndexBase()))
 	l.Push(func(l *lua.State) int {
 		l.Push("_PRELOAD")
 		l.GetTableRaw(lua.RegistryIndex)
@@ -101,8 +101,9 @@ func Open(l *lua.State) int {
 		searchers := l.AbsIndex(-1)
 
 		msg := ""
+		base := l.IndexBase()
 		c := l.LengthRaw(searchers)
-		for i := 1; i <= c; i++ {
+		for i := base; i < base+c; i++ {
 			l.Push(int64(i))
 			if l.GetTableRaw(searchers) != lua.TypFunction {
 				continue // Really should be an error...
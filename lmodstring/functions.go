@@ -23,10 +23,12 @@ misrepresented as being the original software.
 package lmodstring
 
 import "github.com/milochristiansen/lua"
+import "github.com/milochristiansen/lua/luautil"
 
 import "strings"
 import "strconv"
 import "fmt"
+import "math"
 
 // Open loads the "string" module when executed with "lua.(*State).Call".
 //
@@ -95,9 +97,10 @@ func Open(l *lua.State) int {
 
 var functions = map[string]lua.NativeFunction{
 	"byte": func(l *lua.State) int {
-		str := l.OptString(1, "")
-		i := l.OptInt(2, 1)
-		j := l.OptInt(3, i)
+		str := l.CheckString(1)
+		i := l.CheckOptInt(2, int64(l.IndexBase()))
+		j := strPos(l, l.CheckOptInt(3, i))
+		i = strPos(l, i)
 
 		if i < 0 {
 			i = int64(len(str)) + (i + 1)
@@ -118,7 +121,7 @@ var functions = map[string]lua.NativeFunction{
 
 		n := j - i + 1
 		for k := int64(0); k < n; k++ {
-			l.Push(int64(str[k+j-1]))
+			l.Push(int64(str[k+i-1]))
 		}
 		return int(n)
 	},
@@ -126,19 +129,24 @@ var functions = map[string]lua.NativeFunction{
 		n := l.AbsIndex(-1)
 		b := make([]byte, 0, n)
 		for i := 1; i <= n; i++ {
-			b = append(b, byte(l.ToInt(i)))
+			c := l.CheckInt(i)
+			if c < 0 || c > 255 {
+				l.ArgError(i, "value out of range")
+			}
+			b = append(b, byte(c))
 		}
 		l.Push(string(b))
 		return 1
 	},
 	"dump": func(l *lua.State) int {
+		l.CheckType(1, lua.TypFunction)
 		l.Push(l.DumpFunction(1, l.ToBool(2)))
 		return 1
 	},
 	"find": func(l *lua.State) int { // No pattern matching
-		str := l.OptString(1, "")
-		sub := l.OptString(2, "")
-		i := l.OptInt(3, 1)
+		str := l.CheckString(1)
+		sub := l.CheckString(2)
+		i := strPos(l, l.CheckOptInt(3, int64(l.IndexBase())))
 
 		if i < 0 {
 			i = int64(len(str)) + (i + 1)
@@ -146,34 +154,39 @@ var functions = map[string]lua.NativeFunction{
 		if i < 1 {
 			i = 1
 		}
+		if i > int64(len(str))+1 {
+			l.Push(nil)
+			return 1
+		}
 		i--
 
 		idx := strings.Index(str[i:], sub)
 		if idx == -1 {
 			return 0
 		}
-		l.Push(int64(idx) + i + 1)
-		l.Push(int64(idx) + i + int64(len(sub)))
+		off := int64(l.IndexBase())
+		l.Push(int64(idx) + i + off)
+		l.Push(int64(idx) + i + off + int64(len(sub)) - 1)
 		return 2
 	},
-	"format": func(l *lua.State) int { // Uses the same format codes as Go's fmt functions.
+	"format": func(l *lua.State) int { // Uses the same format codes as Go's fmt functions (plus %a).
 		n := l.AbsIndex(-1)
 		args := make([]interface{}, 0, n)
 		for i := 2; i <= n; i++ {
 			args = append(args, l.GetRaw(i))
 		}
 
-		l.Push(fmt.Sprintf(l.OptString(1, ""), args...))
+		l.Push(fmt.Sprintf(hexFloats(l.CheckString(1), args), args...))
 		return 1
 	},
 	// gmatch
 	// gsub
 	"len": func(l *lua.State) int {
-		l.Push(int64(l.Length(1)))
+		l.Push(int64(len(l.CheckString(1))))
 		return 1
 	},
 	"lower": func(l *lua.State) int {
-		str := l.OptString(1, "")
+		str := l.CheckString(1)
 		l.Push(strings.ToLower(str))
 		return 1
 	},
@@ -181,11 +194,20 @@ var functions = map[string]lua.NativeFunction{
 	// pack
 	// packsize
 	"rep": func(l *lua.State) int {
-		str := l.OptString(1, "")
-		c := l.OptInt(2, 1)
-		sep := l.OptString(3, "")
+		str := l.CheckString(1)
+		c := l.CheckInt(2)
+		sep := l.CheckOptString(3, "")
+		if c <= 0 {
+			l.Push("")
+			return 1
+		}
 
-		b := make([]byte, 0, (int64(len(str))+int64(len(sep)))*c)
+		if n := int64(len(str) + len(sep)); n > 0 && c > math.MaxInt32/n {
+			luautil.Raise("Resulting string too large.", luautil.ErrTypGenRuntime)
+		}
+		size := int64(len(str)+len(sep))*c - int64(len(sep))
+		l.TrackMemory(size)
+		b := make([]byte, 0, size)
 
 		for i := int64(0); i < c; i++ {
 			b = append(b, str...)
@@ -198,7 +220,7 @@ var functions = map[string]lua.NativeFunction{
 		return 1
 	},
 	"reverse": func(l *lua.State) int {
-		str := l.OptString(1, "")
+		str := l.CheckString(1)
 
 		b := make([]byte, 0, len(str))
 		for i := len(str) - 1; i >= 0; i-- {
@@ -208,9 +230,9 @@ var functions = map[string]lua.NativeFunction{
 		return 1
 	},
 	"sub": func(l *lua.State) int {
-		str := l.OptString(1, "")
-		i := l.OptInt(2, 1)
-		j := l.OptInt(3, -1)
+		str := l.CheckString(1)
+		i := strPos(l, l.CheckInt(2))
+		j := strPos(l, l.CheckOptInt(3, -1))
 
 		if i < 0 {
 			i = int64(len(str)) + (i + 1)
@@ -226,7 +248,8 @@ var functions = map[string]lua.NativeFunction{
 			j = int64(len(str))
 		}
 		if i > j {
-			return 0
+			l.Push("")
+			return 1
 		}
 
 		i--
@@ -237,7 +260,7 @@ var functions = map[string]lua.NativeFunction{
 	},
 	// unpack
 	"upper": func(l *lua.State) int {
-		str := l.OptString(1, "")
+		str := l.CheckString(1)
 		l.Push(strings.ToUpper(str))
 		return 1
 	},
@@ -245,61 +268,64 @@ var functions = map[string]lua.NativeFunction{
 
 var extFunctions = map[string]lua.NativeFunction{
 	"count": func(l *lua.State) int {
-		str := l.OptString(1, "")
-		sep := l.OptString(2, "")
+		str := l.CheckString(1)
+		sep := l.CheckOptString(2, "")
 		l.Push(int64(strings.Count(str, sep)))
 		return 1
 	},
 
 	"hasprefix": func(l *lua.State) int {
-		str := l.OptString(1, "")
-		a := l.OptString(2, "")
+		str := l.CheckString(1)
+		a := l.CheckOptString(2, "")
 		l.Push(strings.HasPrefix(str, a))
 		return 1
 	},
 
 	"hassuffix": func(l *lua.State) int {
-		str := l.OptString(1, "")
-		a := l.OptString(2, "")
+		str := l.CheckString(1)
+		a := l.CheckOptString(2, "")
 		l.Push(strings.HasSuffix(str, a))
 		return 1
 	},
 
 	"join": func(l *lua.State) int {
+		l.CheckTable(1)
 		ln := l.Length(1)
 
+		base := l.IndexBase()
 		set := make([]string, 0, ln)
-		for i := 1; i <= ln; i++ {
+		for i := base; i < base+ln; i++ {
 			l.Push(int64(i))
 			l.GetTable(1)
 			set = append(set, l.ToString(-1))
 			l.Pop(1)
 		}
 
-		sep := l.OptString(2, ", ")
+		sep := l.CheckOptString(2, ", ")
 
 		l.Push(strings.Join(set, sep))
 		return 1
 	},
 
 	"replace": func(l *lua.State) int {
-		str := l.OptString(1, "")
-		o := l.OptString(2, "")
-		n := l.OptString(3, "")
-		i := int(l.OptInt(4, -1))
+		str := l.CheckString(1)
+		o := l.CheckOptString(2, "")
+		n := l.CheckOptString(3, "")
+		i := int(l.CheckOptInt(4, -1))
 		l.Push(strings.Replace(str, o, n, i))
 		return 1
 	},
 
 	"split": func(l *lua.State) int {
-		str := l.OptString(1, "")
-		sep := l.OptString(2, "")
-		n := int(l.OptInt(3, -1))
+		str := l.CheckString(1)
+		sep := l.CheckOptString(2, "")
+		n := int(l.CheckOptInt(3, -1))
 
 		result := strings.SplitN(str, sep, n)
 		l.NewTable(len(result), 0)
+		base := l.IndexBase()
 		for i := range result {
-			l.Push(int64(i + 1))
+			l.Push(int64(i + base))
 			l.Push(result[i])
 			l.SetTableRaw(-3)
 		}
@@ -307,14 +333,15 @@ var extFunctions = map[string]lua.NativeFunction{
 	},
 
 	"splitafter": func(l *lua.State) int {
-		str := l.OptString(1, "")
-		sep := l.OptString(2, "")
-		n := int(l.OptInt(3, -1))
+		str := l.CheckString(1)
+		sep := l.CheckOptString(2, "")
+		n := int(l.CheckOptInt(3, -1))
 
 		result := strings.SplitAfterN(str, sep, n)
 		l.NewTable(len(result), 0)
+		base := l.IndexBase()
 		for i := range result {
-			l.Push(int64(i + 1))
+			l.Push(int64(i + base))
 			l.Push(result[i])
 			l.SetTableRaw(-3)
 		}
@@ -322,39 +349,39 @@ var extFunctions = map[string]lua.NativeFunction{
 	},
 
 	"title": func(l *lua.State) int {
-		str := l.OptString(1, "")
+		str := l.CheckString(1)
 		l.Push(strings.Title(str))
 		return 1
 	},
 
 	"trim": func(l *lua.State) int {
-		str := l.OptString(1, "")
+		str := l.CheckString(1)
 		l.Push(strings.TrimSpace(str))
 		return 1
 	},
 
 	"trimprefix": func(l *lua.State) int {
-		str := l.OptString(1, "")
-		a := l.OptString(2, "")
+		str := l.CheckString(1)
+		a := l.CheckOptString(2, "")
 		l.Push(strings.TrimPrefix(str, a))
 		return 1
 	},
 
 	"trimspace": func(l *lua.State) int {
-		str := l.OptString(1, "")
+		str := l.CheckString(1)
 		l.Push(strings.TrimSpace(str))
 		return 1
 	},
 
 	"trimsuffix": func(l *lua.State) int {
-		str := l.OptString(1, "")
-		a := l.OptString(2, "")
+		str := l.CheckString(1)
+		a := l.CheckOptString(2, "")
 		l.Push(strings.TrimSuffix(str, a))
 		return 1
 	},
 
 	"unquote": func(l *lua.State) int {
-		str := l.OptString(1, "")
+		str := l.CheckString(1)
 
 		rtn, err := strconv.Unquote(str)
 		if err != nil {
@@ -365,3 +392,71 @@ var extFunctions = map[string]lua.NativeFunction{
 		return 1
 	},
 }
+
+// strPos converts a string position from the State's index base (see lua.State.SetIndexBase) to a 1 based
+// position. Negative positions count back from the end of the string, so they are not changed.
+func strPos(l *lua.State, i int64) int64 {
+	if i >= 0 {
+		return i - int64(l.IndexBase()) + 1
+	}
+	return i
+}
+
+// hexFloats replaces any %a or %A verbs in a format string with %s and formats the matching arguments as
+// hexadecimal floats, as Go's fmt package does not support %a. Explicit argument indexes and * widths are not
+// supported in combination with %a.
+func hexFloats(format string, args []interface{}) string {
+	if !strings.ContainsAny(format, "aA") {
+		return format
+	}
+
+	out := make([]byte, 0, len(format))
+	arg := 0
+	for i := 0; i < len(format); i++ {
+		out = append(out, format[i])
+		if format[i] != '%' {
+			continue
+		}
+
+		// Skip the flags and width, then read the precision (if any).
+		j := i + 1
+		for j < len(format) && strings.IndexByte("+-# 0123456789", format[j]) >= 0 {
+			j++
+		}
+		pstart, prec := j, -1
+		if j < len(format) && format[j] == '.' {
+			prec = 0
+			for j++; j < len(format) && format[j] >= '0' && format[j] <= '9'; j++ {
+				prec = prec*10 + int(format[j]-'0')
+			}
+		}
+		if j >= len(format) {
+			out = append(out, format[i+1:]...)
+			break
+		}
+
+		switch format[j] {
+		case '%':
+			out = append(out, format[i+1:j+1]...)
+			i = j
+			continue
+		case 'a', 'A':
+			// The precision is used here, so it must be removed from the %s verb.
+			out = append(out, format[i+1:pstart]...)
+			out = append(out, 's')
+			if arg < len(args) {
+				switch v := args[arg].(type) {
+				case float64:
+					args[arg] = luautil.FormatHexFloat(v, prec, format[j] == 'A')
+				case int64:
+					args[arg] = luautil.FormatHexFloat(float64(v), prec, format[j] == 'A')
+				}
+			}
+		default:
+			out = append(out, format[i+1:j+1]...)
+		}
+		arg++
+		i = j
+	}
+	return string(out)
+}
@@ -24,6 +24,7 @@ package lmodtable
 
 import "github.com/milochristiansen/lua"
 
+import "fmt"
 import "strings"
 import "sort"
 
@@ -51,36 +52,51 @@ func Open(l *lua.State) int {
 
 var functions = map[string]lua.NativeFunction{
 	"concat": func(l *lua.State) int {
+		l.CheckTable(1)
 		ln := l.Length(1)
-		i := l.OptInt(3, 1)
-		j := l.OptInt(4, int64(ln))
+		base := int64(l.IndexBase())
+		sep := l.CheckOptString(2, "")
+		i := l.CheckOptInt(3, base)
+		j := l.CheckOptInt(4, base+int64(ln)-1)
 
 		set := make([]string, 0, ln)
 		for k := i; k <= j; k++ {
 			l.Push(k)
 			l.GetTable(1)
-			set = append(set, l.ToString(-1)) // Not exactly to spec, but I feel kinda lazy right now...
+			if typ := l.TypeOf(-1); typ != lua.TypString && typ != lua.TypNumber {
+				l.Push(fmt.Sprintf("invalid value (at index %v) in table for 'concat'", k))
+				l.Error()
+			}
+			set = append(set, l.ToString(-1))
 			l.Pop(1)
 		}
 
-		sep := l.OptString(2, "")
-
 		l.Push(strings.Join(set, sep))
 		return 1
 	},
 	"insert": func(l *lua.State) int {
 		// tbl, [pos], value
 
-		ln := l.Length(1)
-		at := ln + 1
+		l.CheckTable(1)
+		first := l.IndexBase()
+		end := first + l.Length(1) // One past the last item.
+		at := end
 		v := 2
-		if l.AbsIndex(-1) > 2 {
-			at = int(l.ToInt(2))
+		switch l.AbsIndex(-1) {
+		case 2:
+		case 3:
+			at = int(l.CheckInt(2))
+			if at < first || at > end {
+				l.ArgError(2, "position out of bounds")
+			}
 			v = 3
+		default:
+			l.Push("wrong number of arguments to 'insert'")
+			l.Error()
 		}
 
 		// The easy case, insertion index is the item one passed the end.
-		if at == ln+1 {
+		if at == end {
 			l.Push(int64(at))
 			l.PushIndex(v)
 			l.SetTable(1)
@@ -88,7 +104,7 @@ var functions = map[string]lua.NativeFunction{
 		}
 
 		// Shift up
-		for i := ln + 1; i > at; i-- {
+		for i := end; i > at; i-- {
 			l.Push(int64(i))
 			l.Push(int64(i - 1))
 			l.GetTable(1)
@@ -102,13 +118,16 @@ var functions = map[string]lua.NativeFunction{
 		return 0
 	},
 	"move": func(l *lua.State) int {
-		f := l.ToInt(2)
-		e := l.ToInt(3)
-		t := l.ToInt(4)
+		l.CheckTable(1)
+		f := l.CheckInt(2)
+		e := l.CheckInt(3)
+		t := l.CheckInt(4)
 
 		tt := 5
 		if l.IsNil(5) {
 			tt = 1
+		} else {
+			l.CheckTable(5)
 		}
 
 		// If we have items to copy...
@@ -144,8 +163,9 @@ var functions = map[string]lua.NativeFunction{
 		l.Push(int64(top))
 		l.SetTable(tidx)
 
+		base := l.IndexBase()
 		for i := 1; i < tidx; i++ {
-			l.Push(int64(i))
+			l.Push(int64(base + i - 1))
 			l.PushIndex(i)
 			l.SetTable(tidx)
 		}
@@ -153,34 +173,37 @@ var functions = map[string]lua.NativeFunction{
 		return 1
 	},
 	"remove": func(l *lua.State) int {
-		ln := int64(l.Length(1))
-		at := l.OptInt(2, ln)
+		l.CheckTable(1)
+		first := int64(l.IndexBase())
+		last := first + int64(l.Length(1)) - 1
+		at := l.CheckOptInt(2, last)
 
-		if at != ln && (at < 1 || at > ln) {
-			l.Push("Index out of range in call to remove")
-			l.Error()
+		if at != last && (at < first || at > last+1) {
+			l.ArgError(1, "position out of bounds")
 		}
 
 		l.Push(at)
 		l.GetTable(1)
 
-		if at != ln {
-			// Shift down
-			for i := at; i < ln; i++ {
-				l.Push(i)
-				l.Push(i + 1)
-				l.GetTable(1)
-				l.SetTable(1)
-			}
+		// Shift down
+		for ; at < last; at++ {
+			l.Push(at)
+			l.Push(at + 1)
+			l.GetTable(1)
+			l.SetTable(1)
 		}
-		l.Push(ln)
+		l.Push(at)
 		l.Push(nil)
 		l.SetTable(1)
 
 		return 1
 	},
 	"sort": func(l *lua.State) int {
-		if l.AbsIndex(-1) == 1 {
+		l.CheckTable(1)
+		if !l.IsNil(2) {
+			l.CheckType(2, lua.TypFunction)
+		} else {
+			l.Pop(l.AbsIndex(-1) - 1)
 			l.Push(func(l *lua.State) int {
 				l.Push(l.Compare(1, 2, lua.OpLessThan))
 				return 1
@@ -191,9 +214,9 @@ var functions = map[string]lua.NativeFunction{
 		return 0
 	},
 	"unpack": func(l *lua.State) int {
-		ln := int64(l.Length(1))
-		i := l.OptInt(2, 1)
-		e := l.OptInt(3, ln)
+		base := int64(l.IndexBase())
+		i := l.CheckOptInt(2, base)
+		e := l.CheckOptInt(3, base+int64(l.Length(1))-1)
 
 		if i > e {
 			return 0
@@ -220,8 +243,9 @@ func (s *tableSorter) Len() int {
 func (s *tableSorter) Less(i, j int) bool {
 	l := (*lua.State)(s)
 
-	i++ // Lua is 1 based
-	j++
+	base := l.IndexBase()
+	i += base
+	j += base
 
 	l.PushIndex(2)
 	l.Push(int64(i))
@@ -237,8 +261,9 @@ func (s *tableSorter) Less(i, j int) bool {
 func (s *tableSorter) Swap(i, j int) {
 	l := (*lua.State)(s)
 
-	i++ // Lua is 1 based
-	j++
+	base := l.IndexBase()
+	i += base
+	j += base
 
 	l.Push(int64(j)) // Key for j = i   - j
 	l.Push(int64(i)) // Value for j = i - j i
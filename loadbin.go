@@ -128,7 +128,7 @@ func (l loader) readConstants(fp *funcProto) error {
 		return err
 	}
 
-	constants := make([]value, n)
+	constants := make([]tvalue, n)
 	for i := range constants {
 		t, err := l.readByte()
 		if err != nil {
@@ -137,14 +137,14 @@ func (l loader) readConstants(fp *funcProto) error {
 
 		switch t {
 		case 0: // LUA_TNIL
-			constants[i] = nil
+			constants[i] = tvalue{}
 
 		case 1: // LUA_TBOOLEAN
 			b, err := l.readByte()
 			if err != nil {
 				return err
 			}
-			constants[i] = b != 0
+			constants[i] = tvBool(b != 0)
 
 		case 3 | (0 << 4): // LUA_TNUMFLT
 			var n float64
@@ -152,7 +152,7 @@ func (l loader) readConstants(fp *funcProto) error {
 			if err != nil {
 				return err
 			}
-			constants[i] = n
+			constants[i] = tvFloat(n)
 
 		case 3 | (1 << 4): // LUA_TNUMINT
 			var n int64
@@ -160,7 +160,7 @@ func (l loader) readConstants(fp *funcProto) error {
 			if err != nil {
 				return err
 			}
-			constants[i] = n
+			constants[i] = tvInt(n)
 
 		case 4 | (0 << 4): // LUA_TSHRSTR
 			fallthrough
@@ -169,7 +169,7 @@ func (l loader) readConstants(fp *funcProto) error {
 			if err != nil {
 				return err
 			}
-			constants[i] = v
+			constants[i] = tv(v)
 
 		default:
 			//  cvartag
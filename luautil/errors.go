@@ -22,6 +22,8 @@ misrepresented as being the original software.
 
 package luautil
 
+import "fmt"
+
 type ErrType int
 
 // Error types.
@@ -39,6 +41,9 @@ const (
 
 	ErrTypWrapped // An error from some other library or native API code wrapped into a standard Error.
 	ErrTypEvil    // If some idiot panics with a non-error value, it will be wrapped with this type.
+
+	ErrTypInterrupted // Execution was stopped because a context was canceled or an instruction limit was reached.
+	ErrTypMemory      // A memory limit was exceeded.
 )
 
 // Error is used for any and every error that is produced by the VM and its peripherals.
@@ -47,18 +52,79 @@ type Error struct {
 	Msg  string
 	Type ErrType
 
+	// The Lua call stack at the time of the error, innermost function first. Only errors that pass through
+	// an error handler that asks for a trace (such as PCall) will have this.
+	Frames []Frame
+
+	// The Lua value the error was raised with, if any. This is set for errors raised by the "error" script
+	// function (or State.Error), and is nil for errors generated by the VM itself. Since nil is a perfectly
+	// good error value HasValue is used to tell the two cases apart.
+	Value    interface{}
+	HasValue bool
+
+	// Any extra trace information. Currently this is only used for the native stack trace (if requested).
 	Trace string
 }
 
+// Frame holds information about a single function on the call stack.
+type Frame struct {
+	Source      string // The name of the chunk the function was defined in, "(native code)" for native functions.
+	Line        int    // The line that was running, -1 if not available.
+	LineDefined int    // The line the function definition starts on, 0 for the main function of a chunk.
+
+	// A name for the function (found by looking at the code that called it) and what kind of name it is:
+	// "global", "local", "method", "field", "upvalue", "metamethod", "for iterator", or "" if no name was found.
+	Name     string
+	NameWhat string
+
+	Native   bool // Is this a native function?
+	TailCall bool // Was this function tail called? If so the function that called it is not on the stack.
+}
+
+// String formats a Frame more or less like the reference implementation does in tracebacks, for example:
+//	test.lua:10: in local 'f'
+func (f Frame) String() string {
+	out := f.Source + ":"
+	if f.Line > 0 {
+		out += fmt.Sprintf("%v:", f.Line)
+	}
+
+	switch {
+	case f.NameWhat == "global":
+		out += fmt.Sprintf(" in function '%v'", f.Name)
+	case f.NameWhat != "":
+		out += fmt.Sprintf(" in %v '%v'", f.NameWhat, f.Name)
+	case f.Native:
+		out += " in ?"
+	case f.LineDefined == 0:
+		out += " in main chunk"
+	default:
+		out += fmt.Sprintf(" in function <%v:%v>", f.Source, f.LineDefined)
+	}
+	return out
+}
+
 // Error formats an Error like so:
 //	<Msg>: <Err.Error()>
-//	  Stack Trace: <Trace>
-// If any of the three parts are missing they are elided, in the extreme case of an empty error the message will be:
+//	  Stack Trace:
+//	    <Frames[0]>
+//	    <Frames[1]>
+//	  <Trace>
+// If any of the parts are missing they are elided, in the extreme case of an empty error the message will be:
 //	Unspecified error
 func (err Error) Error() string {
 	at := ""
+	if len(err.Frames) > 0 {
+		at = "\n  Stack Trace:"
+		for _, f := range err.Frames {
+			at += "\n    " + f.String()
+			if f.TailCall {
+				at += "\n    (...tail calls...)"
+			}
+		}
+	}
 	if err.Trace != "" {
-		at = "\n  Stack Trace:" + err.Trace
+		at += "\n  " + err.Trace
 	}
 
 	msg := "Unspecified error"
@@ -97,103 +97,71 @@ func convInt(s string) (int64, bool) {
 	return a, true
 }
 
-// No hexidecamal float support, but who uses hexadecimal floats anyway?
+// convFloat handles both decimal and hexadecimal floats. strconv.ParseFloat does most of the work, but it accepts
+// some things Lua does not (like "inf" and underscores) and it requires hexadecimal floats to have an exponent.
 func convFloat(s string) (float64, bool) {
-	if len(s) > 2 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X') {
-		Raise("Sadly hexadecimal floating point literals are currently not supported, use decimal literals", ErrTypGenLexer)
-	}
-
-	f, err := strconv.ParseFloat(s, 64)
-	return f, err == nil
-}
-
-// My attempt a a float converter, basically implemented from the hexadecimal converter in "lobject.c".
-// The problem with this is that it doesn't work and I don't know why or how to fix it, I suck at this kind of math...
-func convFloatBroken(s string) (float64, bool) {
-	a := 0.0
-	e := 0
 	i := 0
-	empty := true
-	dot := false
-
-	neg := false
-	if len(s) >= 1 && s[0] == '-' {
-		neg = true
-		i += 1
+	if s[0] == '-' || s[0] == '+' {
+		i++
 	}
 
-	hex := false
-	if len(s) > i+2 && s[i+1] == '0' && (s[i+2] == 'x' || s[i+2] == 'X') {
+	hex := len(s) > i+2 && s[i] == '0' && (s[i+1] == 'x' || s[i+1] == 'X')
+	digits, expo := "0123456789.", "eE"
+	if hex {
 		i += 2
-		hex = true
+		digits, expo = "0123456789abcdefABCDEF.", "pP"
 	}
 
+	hasExpo := false
 	for ; i < len(s); i++ {
-		if s[i] == '.' {
-			if dot {
-				return 0, false
-			}
-			dot = true
-			continue
-		}
-
-		if s[i] >= '0' && s[i] <= '9' || hex && (s[i] >= 'a' && s[i] <= 'f' || s[i] >= 'A' && s[i] <= 'F') {
-			if hex {
-				a = a*16 + float64(cton(s[i]))
-			} else {
-				a = a*10 + float64(cton(s[i]))
-			}
-			empty = false
-			if dot {
-				e--
-			}
-			continue
-		}
-
-		if !hex && (s[i] == 'e' || s[i] == 'E') || hex && (s[i] == 'p' || s[i] == 'P') {
-			break
+		switch {
+		case strings.IndexByte(digits, s[i]) >= 0:
+		case strings.IndexByte(expo, s[i]) >= 0:
+			hasExpo = true
+		case (s[i] == '-' || s[i] == '+') && hasExpo:
+		default:
+			return 0, false
 		}
-
-		return 0, false // Invalid character
 	}
-	if empty {
-		return 0, false
+	if hex && !hasExpo {
+		s += "p0"
 	}
-	e *= 4
-	if i < len(s) && (!hex && (s[i] == 'e' || s[i] == 'E') || hex && (s[i] == 'p' || s[i] == 'P')) {
-		ea := 0
-		empty = false
-
-		eneg := false
-		if len(s) >= i+1 && s[i+1] == '-' {
-			eneg = true
-			i += 1
-		}
 
-		for ; i < len(s); i++ {
-			if s[i] >= '0' && s[i] <= '9' {
-				ea = ea*10 + int(cton(s[i]))
-			}
-
-			return 0, false // Invalid character
-		}
-
-		if empty {
-			return 0, false
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		// Out of range values are rounded to infinity (or 0), just like the reference implementation.
+		if nerr, ok := err.(*strconv.NumError); ok && nerr.Err == strconv.ErrRange {
+			return f, true
 		}
+		return 0, false
+	}
+	return f, true
+}
 
-		if eneg {
-			ea = -ea
+// FormatHexFloat formats a float the same way C's printf "%a" verb does, with prec digits after the point (use -1
+// for as many digits as needed to represent the value exactly).
+func FormatHexFloat(f float64, prec int, upper bool) string {
+	var s string
+	switch {
+	case math.IsInf(f, 1):
+		s = "inf"
+	case math.IsInf(f, -1):
+		s = "-inf"
+	case math.IsNaN(f):
+		s = "nan"
+	default:
+		// Go always uses at least two digits for the exponent, C uses as few as possible.
+		s = strconv.FormatFloat(f, 'x', prec, 64)
+		p := strings.IndexByte(s, 'p')
+		exp := strings.TrimLeft(s[p+2:], "0")
+		if exp == "" {
+			exp = "0"
 		}
-		e += ea
+		s = s[:p+2] + exp
 	}
 
-	if empty {
-		return 0, false
+	if upper {
+		return strings.ToUpper(s)
 	}
-	if neg {
-		a = -a
-	}
-
-	return math.Ldexp(a, e), true
+	return s
 }
@@ -0,0 +1,77 @@
+/*
+Copyright 2016-2017 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua
+
+import "github.com/milochristiansen/lua/luautil"
+
+// Memory accounting is very approximate. The VM has no idea what the Go runtime actually does with memory, and
+// it never finds out when something is freed, so the best it can do is keep a running total of what it thinks
+// scripts have allocated. This means the count (and the limit) is for everything allocated since the count was last
+// reset, not for what is currently in use. Finding out when things are freed would require a Go finalizer on every
+// table and closure, which is slow, and worse, would keep any table that is part of a reference cycle alive forever.
+//
+// These are rough guesses about how much memory the various things the VM allocates use on a 64 bit system.
+const (
+	memTable     = 80 // An empty table (the struct and the hash map header).
+	memValue     = 32 // A single item in the array part of a table (a tvalue).
+	memHashEntry = 48 // A single key/value pair in the hash part of a table.
+	memClosure   = 64 // A function, not counting its upvalues.
+	memUpValue   = 96 // A single upvalue.
+)
+
+// SetAllocationLimit sets the (approximate) number of bytes scripts may allocate before an error of type
+// luautil.ErrTypMemory ("memory limit exceeded") is raised. Set to 0 (or less) to remove the limit.
+//
+// The limit is shared by all threads created from a State. Since the VM cannot know when memory is freed
+// the limit applies to the total amount of memory allocated, not to how much is in use at any one time. Much
+// like an instruction limit it is a budget for a single run of a script, use ResetAllocatedBytes to start counting
+// over.
+func (l *State) SetAllocationLimit(n int64) {
+	l.memLimit = n
+}
+
+// AllocatedBytes returns the (approximate) number of bytes allocated by scripts since the State was created or
+// ResetAllocatedBytes was last called. Memory that has since been freed is still counted.
+//
+// Only tables, strings created by concatenation (and native functions that call TrackMemory), and closures are
+// counted.
+func (l *State) AllocatedBytes() int64 {
+	return l.memAlloc
+}
+
+// ResetAllocatedBytes resets the allocation count to 0.
+func (l *State) ResetAllocatedBytes() {
+	l.memAlloc = 0
+}
+
+// TrackMemory adds n bytes to the allocation count. If this would exceed the allocation limit an error is raised
+// (and the count is not changed).
+//
+// Native functions that create large values for scripts (such as string.rep) should call this *before*
+// allocating the value.
+func (l *State) TrackMemory(n int64) {
+	if l.memLimit > 0 && (n > l.memLimit || l.memAlloc > l.memLimit-n) {
+		luautil.Raise("memory limit exceeded", luautil.ErrTypMemory)
+	}
+	l.memAlloc += n
+}
@@ -0,0 +1,336 @@
+/*
+Copyright 2016-2017 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua
+
+import "context"
+import "io"
+import "maps"
+import "reflect"
+import "sync"
+
+import "github.com/milochristiansen/lua/luautil"
+
+// Pool is a set of States that have already been set up and are ready to use.
+//
+// Creating a State and opening the standard library is not terribly expensive, but it isn't free either. If
+// you need a fresh State for every request (or whatever) a Pool lets you skip most of that work. When a State is
+// created by the pool the init function is called, then a snapshot is taken of everything reachable from the
+// global table, the registry, and the metatables for the basic types. When the State is returned to the pool
+// (with Put) everything in the snapshot is put back the way it was, so the next user gets a State that looks
+// like it was just created.
+//
+// What is restored:
+//   - The contents and metatables of every table in the snapshot.
+//   - The metatables of all userdata in the snapshot (but not their data!).
+//   - The values of all (closed) upvalues of functions in the snapshot.
+//   - The metatables for the basic types and the types registered with RegisterType.
+//   - Output, NativeTrace, TruncatedDivision, Options, and the index base.
+//   - The execution and allocation limits, and the allocation count.
+//
+// Hooks are removed, the stack is cleared, and any unfinished threads are stopped (see Close).
+//
+// Anything a script creates that is not reachable from the snapshot is simply dropped. Keep in mind that __gc meta
+// methods from a previous user may still run (pending finalizers are discarded when a State is returned, but
+// objects may be collected later).
+//
+// A Pool is safe for concurrent use, but the States it hands out are not (as always).
+type Pool struct {
+	init func(l *State) error
+
+	lock  sync.Mutex
+	free  []*State
+	snaps map[*State]*snapshot
+	slots chan struct{} // nil if there is no limit.
+}
+
+// NewPool creates a new Pool. max is the maximum number of States that may exist at once, if it is 0 (or less)
+// there is no limit. init is called for each new State (to open the standard library, set globals, etc), it may
+// be nil. If init returns an error the State is thrown away and Get returns the error.
+//
+// States are only created when they are needed, nothing is done until the first call to Get.
+func NewPool(max int, init func(l *State) error) *Pool {
+	p := &Pool{
+		init:  init,
+		snaps: map[*State]*snapshot{},
+	}
+	if max > 0 {
+		p.slots = make(chan struct{}, max)
+	}
+	return p
+}
+
+// Get takes a State from the pool, creating a new one if there are no idle States available.
+//
+// If the pool has a maximum size and that many States are in use Get waits until one is returned. If the
+// context is canceled before that happens the context's error is returned.
+func (p *Pool) Get(ctx context.Context) (*State, error) {
+	if p.slots != nil {
+		select {
+		case p.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	p.lock.Lock()
+	if n := len(p.free); n > 0 {
+		l := p.free[n-1]
+		p.free[n-1] = nil
+		p.free = p.free[:n-1]
+		p.lock.Unlock()
+		return l, nil
+	}
+	p.lock.Unlock()
+
+	l := NewState()
+	if p.init != nil {
+		err := p.init(l)
+		if err != nil {
+			p.release()
+			return nil, err
+		}
+	}
+	l.stack.reset()
+	snap := newSnapshot(l)
+
+	p.lock.Lock()
+	p.snaps[l] = snap
+	p.lock.Unlock()
+	return l, nil
+}
+
+// Put resets a State and returns it to the pool. The State must have been created by this pool, and it must
+// not be in use (in particular do not call Put from inside a native function!).
+//
+// Do not use the State after calling Put.
+func (p *Pool) Put(l *State) {
+	p.lock.Lock()
+	snap, ok := p.snaps[l]
+	p.lock.Unlock()
+	if !ok {
+		luautil.Raise("State does not belong to this pool.", luautil.ErrTypGenRuntime)
+	}
+
+	l.Close()
+	snap.restore(l)
+
+	p.lock.Lock()
+	p.free = append(p.free, l)
+	p.lock.Unlock()
+	p.release()
+}
+
+// Discard removes a State from the pool without returning it. Use this if a State has been changed in some way
+// that Put cannot undo.
+func (p *Pool) Discard(l *State) {
+	p.lock.Lock()
+	_, ok := p.snaps[l]
+	delete(p.snaps, l)
+	p.lock.Unlock()
+	if ok {
+		p.release()
+	}
+}
+
+func (p *Pool) release() {
+	if p.slots != nil {
+		<-p.slots
+	}
+}
+
+// snapshot stores everything needed to reset a State.
+type snapshot struct {
+	tables map[*table]*tableSnap
+	udata  map[*userData]*table
+	ups    map[*upValue]tvalue
+
+	metaTbls  [typeCount]*table
+	userTypes map[reflect.Type]*userType
+
+	output      io.Writer
+	nativeTrace bool
+	truncDiv    bool
+	options     Options
+	indexBase   int
+
+	stackLimits stackLimits
+
+	limited   bool
+	instLimit int64
+	memAlloc  int64
+	memLimit  int64
+}
+
+type tableSnap struct {
+	meta *table
+	keys []value
+	vals []value
+}
+
+func newSnapshot(l *State) *snapshot {
+	s := &snapshot{
+		tables: map[*table]*tableSnap{},
+		udata:  map[*userData]*table{},
+		ups:    map[*upValue]tvalue{},
+
+		metaTbls:  l.metaTbls,
+		userTypes: maps.Clone(l.userTypes),
+
+		output:      l.Output,
+		nativeTrace: l.NativeTrace,
+		truncDiv:    l.TruncatedDivision,
+		options:     l.Options,
+		indexBase:   l.indexBase,
+
+		stackLimits: l.stackLimits,
+
+		limited:   l.limited,
+		instLimit: l.InstructionsLeft(),
+		memAlloc:  l.memAlloc,
+		memLimit:  l.memLimit,
+	}
+
+	s.visit(l.global)
+	s.visit(l.registry)
+	for _, meta := range l.metaTbls {
+		if meta != nil {
+			s.visit(meta)
+		}
+	}
+	return s
+}
+
+// visit adds v and everything reachable from it to the snapshot.
+func (s *snapshot) visit(v value) {
+	switch v2 := v.(type) {
+	case *table:
+		if _, ok := s.tables[v2]; ok {
+			return
+		}
+		ts := &tableSnap{meta: v2.meta}
+		s.tables[v2] = ts
+
+		for k, v := v2.Next(nil); k != nil; k, v = v2.Next(k) {
+			ts.keys = append(ts.keys, k)
+			ts.vals = append(ts.vals, v)
+			s.visit(k)
+			s.visit(v)
+		}
+		if v2.meta != nil {
+			s.visit(v2.meta)
+		}
+	case *userData:
+		if _, ok := s.udata[v2]; ok {
+			return
+		}
+		s.udata[v2] = v2.meta
+		if v2.meta != nil {
+			s.visit(v2.meta)
+		}
+	case *function:
+		for _, up := range v2.up {
+			if _, ok := s.ups[up]; ok || !up.closed {
+				continue
+			}
+			s.ups[up] = up.val
+			s.visit(up.val.value())
+		}
+	}
+}
+
+func (s *snapshot) restore(l *State) {
+	l.stack.reset()
+	l.finalizers.take()
+	l.memLimit = 0 // Rebuilding tables counts as allocating memory.
+
+	l.hook, l.hookMask, l.hookCount, l.hookLeft, l.inHook = nil, 0, 0, 0, false
+	l.Output = s.output
+	l.NativeTrace = s.nativeTrace
+	l.TruncatedDivision = s.truncDiv
+	l.Options = s.options
+	l.indexBase = s.indexBase
+	l.stackLimits = s.stackLimits
+	l.ctx = nil
+	l.SetInstructionLimit(-1)
+	if s.limited {
+		l.SetInstructionLimit(s.instLimit)
+	}
+
+	l.metaTbls = s.metaTbls
+	if len(l.userTypes) != len(s.userTypes) {
+		// Types can't be unregistered, so if the count is the same nothing changed.
+		l.userTypes = maps.Clone(s.userTypes)
+	}
+	for tbl, ts := range s.tables {
+		ts.restore(tbl)
+	}
+	for ud, meta := range s.udata {
+		ud.meta = meta
+	}
+	for up, v := range s.ups {
+		up.val = v
+	}
+
+	l.memAlloc = s.memAlloc
+	l.memLimit = s.memLimit
+}
+
+// restore puts the table back the way it was when the snapshot was taken. The table is only rebuilt if
+// something was actually changed.
+func (ts *tableSnap) restore(tbl *table) {
+	if tbl.meta != ts.meta {
+		tbl.meta = ts.meta
+		tbl.setMode(ts.meta)
+	}
+	if ts.same(tbl) {
+		return
+	}
+
+	tbl.array = nil
+	tbl.length = -1
+	tbl.hash = make(map[value]int, len(ts.keys))
+	tbl.hkeys = make([]value, 0, len(ts.keys))
+	tbl.hvals = make([]value, 0, len(ts.keys))
+	tbl.dead = 0
+	tbl.added = 0
+	for i, k := range ts.keys {
+		tbl.SetRaw(k, ts.vals[i])
+	}
+}
+
+// same returns true if the table has exactly the same contents it did when the snapshot was taken.
+func (ts *tableSnap) same(tbl *table) bool {
+	n := 0
+	for k, _ := tbl.Next(nil); k != nil; k, _ = tbl.Next(k) {
+		n++
+	}
+	if n != len(ts.keys) {
+		return false
+	}
+	for i, k := range ts.keys {
+		if tbl.GetRaw(k) != ts.vals[i] {
+			return false
+		}
+	}
+	return true
+}
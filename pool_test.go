@@ -0,0 +1,155 @@
+/*
+Copyright 2016-2017 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua_test
+
+import "testing"
+import "context"
+import "runtime"
+import "sync"
+import "sync/atomic"
+import "time"
+
+import "github.com/milochristiansen/lua"
+import "github.com/milochristiansen/lua/testhelp"
+
+func TestPool(t *testing.T) {
+	var inits int32
+	p := lua.NewPool(2, func(l *lua.State) error {
+		atomic.AddInt32(&inits, 1)
+		l.Push(1) // Anything left on the stack is removed.
+		return l.Protect(func() { testhelp.OpenLibs(l) })
+	})
+
+	l, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Mess things up as much as possible.
+	testhelp.AssertBlock(t, l, `
+		x = 1
+		string.rep = nil
+		string.custom = true
+		table.insert(package.loaded, 1)
+		setmetatable(_G, {__index = function() return "oops" end})
+		getmetatable("").__index = {}
+		local t = setmetatable({}, {__mode = "k"})
+		t[t] = true
+		math.pi = 3
+		return true
+	`, true)
+	l.SetAllocationLimit(1)
+	l.SetInstructionLimit(0)
+	l.Push(1)
+	l.Push(2)
+	p.Put(l)
+
+	l2, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testhelp.Assertf(t, l2 == l, "Idle State not reused.")
+	testhelp.Assertf(t, l2.AbsIndex(-1) == 0, "Stack not cleared: %v items", l2.AbsIndex(-1))
+	testhelp.Assertf(t, l2.InstructionsLeft() == -1, "Instruction limit not reset.")
+	testhelp.AssertBlock(t, l2, `
+		assert(x == nil)
+		assert(getmetatable(_G) == nil)
+		assert(string.rep ~= nil and string.custom == nil)
+		assert(("x"):rep(3) == "xxx")
+		assert(#package.loaded == 0)
+		assert(math.pi > 3.14)
+		return true
+	`, true)
+
+	// Only two States may exist at once.
+	l3, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	_, err = p.Get(ctx)
+	cancel()
+	testhelp.Assertf(t, err == context.DeadlineExceeded, "Unexpected error: %v", err)
+	testhelp.Assertf(t, atomic.LoadInt32(&inits) == 2, "Unexpected init count: %v", inits)
+
+	p.Discard(l3)
+	p.Put(l2)
+
+	// Concurrent use
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				l, err := p.Get(context.Background())
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				testhelp.AssertBlock(t, l, `
+					assert(counter == nil)
+					counter = 1
+					return true
+				`, true)
+				p.Put(l)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestPoolThreads(t *testing.T) {
+	p := lua.NewPool(0, func(l *lua.State) error {
+		return l.Protect(func() { testhelp.OpenLibs(l) })
+	})
+
+	l, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := runtime.NumGoroutine()
+
+	testhelp.AssertBlock(t, l, `
+		for i = 1, 10 do
+			local co = coroutine.wrap(function() while true do coroutine.yield() end end)
+			co()
+		end
+		co = coroutine.create(function() pcall(coroutine.yield) error("should never be here!") end)
+		coroutine.resume(co)
+		return coroutine.status(co)
+	`, "suspended")
+	l.Push("co")
+	l.GetTable(lua.GlobalsIndex)
+	co := l.ToThread(-1)
+	l.Pop(1)
+
+	p.Put(l)
+	testhelp.Assertf(t, co.Status() == lua.ThreadDead, "Thread not stopped: %v", co.Status())
+
+	// The goroutines exit right after they are stopped, but they may need a moment to actually do so.
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	testhelp.Assertf(t, runtime.NumGoroutine() <= before, "Thread goroutines still running: %v", runtime.NumGoroutine()-before)
+}
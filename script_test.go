@@ -24,13 +24,17 @@ package lua_test
 
 import "testing"
 
+import "github.com/milochristiansen/lua"
 import "github.com/milochristiansen/lua/testhelp"
 
 // The tests in this file run blocks of code from the official Lua test suite. Most (if not all) of these tests are
 // modified in some way, mostly to remove stuff dependent on APIs not available in my VM.
 
-func TestAssign(t *testing.T) {
-	testhelp.AssertBlock(t, testhelp.MkState(), `-- attrib.lua
+func TestAssign(t *testing.T) { testAssign(t, testhelp.MkState) }
+
+func testAssign(t *testing.T, mk func() *lua.State) {
+	testhelp.AssertBlock(t, mk(), `-- attrib.lua
+local B = next{true} -- The index base, these tests run with both 0 and 1 based tables.
 local res, res2 = 27
 
 a, b = 1, 2+3
@@ -46,7 +50,7 @@ do
 	local f = function (n)
 		local x = {}
 		for i = 1, n do
-			x[i] = i
+			x[i - 1 + B] = i
 		end
 		return table.unpack(x)
 	end
@@ -120,9 +124,9 @@ a = nil
 
 a = {10,9,8,7,6,5,4,3,2; [-3]='a', [f]=print, a='a', b='ab'}
 a, a.x, a.y = a, a[-3]
-assert(a[1]==10 and a[-3]==a.a and a[f]==print and a.x=='a' and not a.y)
-a[1], f(a)[2], b, c = {['alo']=assert}, 10, a[1], a[f], 6, 10, 23, f(a), 2
-a[1].alo(a[2]==10 and b==10 and c==print)
+assert(a[B]==10 and a[-3]==a.a and a[f]==print and a.x=='a' and not a.y)
+a[B], f(a)[B+1], b, c = {['alo']=assert}, 10, a[B], a[f], 6, 10, 23, f(a), 2
+a[B].alo(a[B+1]==10 and b==10 and c==print)
 
 
 -- test of large float/integer indices 
@@ -195,8 +199,10 @@ return res
 `, 27)
 }
 
-func TestBits(t *testing.T) {
-	testhelp.AssertBlock(t, testhelp.MkState(), `-- bitwise.lua
+func TestBits(t *testing.T) { testBits(t, testhelp.MkState) }
+
+func testBits(t *testing.T, mk func() *lua.State) {
+	testhelp.AssertBlock(t, mk(), `-- bitwise.lua
 local numbits = 64
 
 assert(~0 == -1)
@@ -251,8 +257,12 @@ assert(not pcall(function () return "0xffffffffffffffff\0" | 0 end))
 `, nil)
 }
 
-func TestCalls(t *testing.T) {
-	testhelp.AssertBlock(t, testhelp.MkState(), `-- calls.lua
+func TestCalls(t *testing.T) { testCalls(t, testhelp.MkState) }
+
+func testCalls(t *testing.T, mk func() *lua.State) {
+	testhelp.AssertBlock(t, mk(), `-- calls.lua
+local B = next{true} -- The index base, these tests run with both 0 and 1 based tables.
+
 -- get the opportunity to test 'type' too ;)
 
 assert(type(1<2) == 'boolean')
@@ -313,10 +323,10 @@ function f(a,b,c) local d = 'a'; t={a,b,c,d} end
 
 f(      -- this line change must be valid
   1,2)
-assert(t[1] == 1 and t[2] == 2 and t[3] == nil and t[4] == 'a')
+assert(t[B] == 1 and t[B+1] == 2 and t[B+2] == nil and t[B+3] == 'a')
 f(1,2,   -- this one too
       3,4)
-assert(t[1] == 1 and t[2] == 2 and t[3] == 3 and t[4] == 'a')
+assert(t[B] == 1 and t[B+1] == 2 and t[B+2] == 3 and t[B+3] == 'a')
 
 function fat(x)
   if x <= 1 then return 1
@@ -405,15 +415,15 @@ Z, F, f = nil
 -- testing multiple returns
 
 function unlpack (t, i)
-  i = i or 1
-  if (i <= #t) then
+  i = i or B
+  if (i < B + #t) then
     return t[i], unlpack(t, i+1)
   end
 end
 
 function equaltab (t1, t2)
   assert(#t1 == #t2)
-  for i = 1, #t1 do
+  for i = B, B + #t1 - 1 do
     assert(t1[i] == t2[i])
   end
 end
@@ -436,7 +446,7 @@ a,b,c,d = unlpack(pack(ret2(f()), (ret2(f()))))
 assert(a==1 and b==1 and c==nil and d==nil)
 
 a = ret2{ unlpack{1,2,3}, unlpack{3,2,1}, unlpack{"a", "b"}}
-assert(a[1] == 1 and a[2] == 3 and a[3] == "a" and a[4] == "b")
+assert(a[B] == 1 and a[B+1] == 3 and a[B+2] == "a" and a[B+3] == "b")
 
 
 -- testing calls with 'incorrect' arguments
@@ -463,8 +473,10 @@ return nil
 `, nil)
 }
 
-func TestClosure(t *testing.T) {
-	testhelp.AssertBlock(t, testhelp.MkState(), `-- closure.lua
+func TestClosure(t *testing.T) { testClosure(t, testhelp.MkState) }
+
+func testClosure(t *testing.T, mk func() *lua.State) {
+	testhelp.AssertBlock(t, mk(), `-- closure.lua
 
 -- Fails, equality does not work for closures unless they are references to the same underlying instance, not sure if I
 -- can fix this or not.
@@ -495,10 +507,11 @@ a[2].set('a')
 assert(a[3].get() == 3)
 assert(a[2].get() == 'a')
 
+local B = next{true} -- The index base, these tests run with both 0 and 1 based tables.
 a = {}
 local t = {"a", "b"}
 for i = 1, #t do
-  local k = t[i]
+  local k = t[i - 1 + B]
   a[i] = {set = function(x, y) i=x; k=y end,
           get = function () return i, k end}
   if i == 2 then break end
@@ -521,12 +534,12 @@ end
 assert(f() == 1)
 
 for k = 1, #t do
-  local v = t[k]
+  local v = t[k - 1 + B]
   f = function () return k, v end
   break
 end
-assert(({f()})[1] == 1)
-assert(({f()})[2] == "a")
+assert(({f()})[B] == 1)
+assert(({f()})[B+1] == "a")
 
 
 -- testing closure x break x return x errors
@@ -586,52 +599,35 @@ repeat
 until i > 10 or a[i]() ~= x
 assert(i == 11 and a[1]() == 1 and a[3]() == 3 and i == 4)
 
--- This next block runs afoul of the compiler, specifically the code that detects jumps into a local var's scope flags
--- this as invalid.
--- 
--- I tend to agree with it, and so does the Lua spec:
--- §3.3.4: "A goto may jump to any visible label as long as it does not enter into the scope of a local variable."
--- Jumping from 14a to 14b is illegal (local "y" comes into scope). That jump exists in the code, but is impossible due
--- to other jumps.
--- 
--- One of three things is happening here:
--- 1. luac analyzes jumps and ignores impossible code (very unlikely)
--- 2. luac does not actually follow the spec (unlikely but possible, look at the table length operator)
--- 3. There is some special case I am missing (for example since 14b is at the end of the block it may act like it is
---    out of "y"'s scope).
--- 
--- OK, it turns out that there is an undocumented special case where you can always jump to a label that is the last
--- item in it's block. For now my compiler does not support this...
-
 -- testing closures created in 'then' and 'else' parts of 'if's
---a = {}
---for i = 1, 10 do
---  if i % 3 == 0 then
---    local y = 0
---    a[i] = function (x) local t = y; y = x; return t end
---  elseif i % 3 == 1 then
---    goto L1
---    error'not here'
---  ::L1::
---    local y = 1
---    a[i] = function (x) local t = y; y = x; return t end
---  elseif i % 3 == 2 then
---    local t
---    goto l4
---    ::l4a:: a[i] = t; goto l4b
---    error("should never be here!")
---    ::l4::
---    local y = 2
---    t = function (x) local t = y; y = x; return t end
---    goto l4a
---    error("should never be here!")
---    ::l4b::
---  end
---end
---
---for i = 1, 10 do
---  assert(a[i](i * 10) == i % 3 and a[i]() == i * 10)
---end
+a = {}
+for i = 1, 10 do
+  if i % 3 == 0 then
+    local y = 0
+    a[i] = function (x) local t = y; y = x; return t end
+  elseif i % 3 == 1 then
+    goto L1
+    error'not here'
+  ::L1::
+    local y = 1
+    a[i] = function (x) local t = y; y = x; return t end
+  elseif i % 3 == 2 then
+    local t
+    goto l4
+    ::l4a:: a[i] = t; goto l4b
+    error("should never be here!")
+    ::l4::
+    local y = 2
+    t = function (x) local t = y; y = x; return t end
+    goto l4a
+    error("should never be here!")
+    ::l4b::
+  end
+end
+
+for i = 1, 10 do
+  assert(a[i](i * 10) == i % 3 and a[i]() == i * 10)
+end
 
 
 -- test for correctly closing upvalues in tail calls of vararg functions
@@ -648,8 +644,10 @@ return nil
 }
 
 // FIXME: WARNING! This gets stuck in an infinite loop!
-func TestSyntax(t *testing.T) {
-	testhelp.AssertBlock(t, testhelp.MkState(), `-- constructs.lua
+func TestSyntax(t *testing.T) { testSyntax(t, testhelp.MkState) }
+
+func testSyntax(t *testing.T, mk func() *lua.State) {
+	testhelp.AssertBlock(t, mk(), `-- constructs.lua
 
 -- testing semicollons
 do ;;; end
@@ -669,14 +667,10 @@ assert(2.0^-2 == 1/4 and -2^- -2 == - - -4);
 assert(not nil and 2 and not(2>3 or 3<2));
 assert(-3-1-5 == 0+0-9);
 assert(-2^2 == -4 and (-2)^2 == 4 and 2*2-3-1 == 0);
---assert(-3%5 == 2 and -3+5 == 2) -- See next comment.
+assert(-3%5 == 2 and -3+5 == 2)
 assert(2*1+3/3 == 3 and 1+2 .. 3*1 == "33");
 assert(not(2+1 > 3*1) and "a".."b" > "a");
 
--- According to my programmer's calculator and Go:
---	5 % -3 == 2, -3 % 5 == -3
--- Apparently the authors of Lua failed basic math...
-
 assert("7" .. 3 << 1 == 146)
 assert(10 >> 1 .. "9" == 0)
 assert(10 | 1 .. "9" == 27)
@@ -722,15 +716,16 @@ function f (i)
   if i > 0 then return i, f(i-1); end;
 end
 
+local B = next{true} -- The index base, these tests run with both 0 and 1 based tables.
 x = {f(3), f(5), f(10);};
-assert(x[1] == 3 and x[2] == 5 and x[3] == 10 and x[4] == 9 and x[12] == 1);
+assert(x[B] == 3 and x[B+1] == 5 and x[B+2] == 10 and x[B+3] == 9 and x[B+11] == 1);
 assert(x[nil] == nil)
 x = {f'alo', f'xixi', nil};
-assert(x[1] == 'alo' and x[2] == 'xixi' and x[3] == nil);
+assert(x[B] == 'alo' and x[B+1] == 'xixi' and x[B+2] == nil);
 x = {f'alo'..'xixi'};
-assert(x[1] == 'aloxixi')
+assert(x[B] == 'aloxixi')
 x = {f{}}
-assert(x[2] == 'jojo' and type(x[1]) == 'table')
+assert(x[B+1] == 'jojo' and type(x[B]) == 'table')
 
 
 local f = function (i)
@@ -781,13 +776,13 @@ assert(f(3) == 'a' and f(12) == 'b' and f(26) == 'c' and f(100) == 8)
 
 local a, b = nil, 23
 x = {f(100)*2+3 or a, a or b+2}
-assert(x[1] == 19 and x[2] == 25)
+assert(x[B] == 19 and x[B+1] == 25)
 x = {f=2+3 or a, a = b+2}
 assert(x.f == 5 and x.a == 25)
 
 a={y=1}
 x = {a.y}
-assert(x[1] == 1)
+assert(x[B] == 1)
 
 function f(i)
   while 1 do
@@ -869,6 +864,999 @@ end
 `, nil)
 }
 
+func TestStrings(t *testing.T) { testStrings(t, testhelp.MkState) }
+
+func testStrings(t *testing.T, mk func() *lua.State) {
+	testhelp.AssertBlock(t, mk(), `-- strings.lua (parts)
+local B = next{true} -- The index base, these tests run with both 0 and 1 based tables.
+
+assert(string.sub("123456789",B+1,B+3) == "234")
+assert(string.sub("123456789",B+6) == "789")
+assert(string.sub("123456789",B+6,B+5) == "")
+assert(string.sub("123456789",B+6,B+6) == "7")
+assert(string.sub("123456789",-10,B+9) == "123456789")
+assert(string.sub("123456789",B+9,-20) == "")
+assert(string.sub("", B, B-1) == "")
+
+assert(string.byte("a") == 97)
+assert(string.byte("hi", B+1, B) == nil)
+local a, b, c = string.byte("abc", B, -1)
+assert(a == 97 and b == 98 and c == 99)
+local a, b = string.byte("abc", B+1, B+2)
+assert(a == 98 and b == 99)
+
+assert(string.find("123456789", "345") == B+2)
+assert(string.find("", "", B) == B)
+assert(string.find("abc", "", B+3) == B+3)
+assert(not string.find("", "", B+1))
+assert(not string.find("abc", "b", B+9))
+
+return true
+`, true)
+}
+
+func TestCoroutine(t *testing.T) { testCoroutine(t, testhelp.MkState) }
+
+func testCoroutine(t *testing.T, mk func() *lua.State) {
+	testhelp.AssertBlock(t, mk(), `-- coroutine.lua
+local B = next{true} -- The index base, these tests run with both 0 and 1 based tables.
+local f
+
+local main, ismain = coroutine.running()
+assert(type(main) == "thread" and ismain)
+assert(not coroutine.resume(main))
+assert(not coroutine.isyieldable())
+assert(not pcall(coroutine.yield))
+
+-- tests for multiple yield/resume arguments
+
+local function eqtab (t1, t2)
+  assert(#t1 == #t2)
+  for i, v in ipairs(t1) do
+    assert(t2[i] == v)
+  end
+end
+
+_G.x = nil   -- declare x
+function foo (a, ...)
+  local x, y = coroutine.running()
+  assert(x == f and y == false)
+  -- next call should not corrupt coroutine (but must fail, as it tries to resume the running coroutine)
+  assert(coroutine.resume(f) == false)
+  assert(coroutine.status(f) == "running")
+  local arg = {...}
+  assert(coroutine.isyieldable())
+  for _, v in ipairs(arg) do
+    _G.x = {coroutine.yield(table.unpack(v))}
+  end
+  return table.unpack(a)
+end
+
+f = coroutine.create(foo)
+assert(type(f) == "thread" and coroutine.status(f) == "suspended")
+assert(string.find(tostring(f), "thread"))
+local s,a,b,c,d
+s,a,b,c,d = coroutine.resume(f, {1,2,3}, {}, {1}, {'a', 'b', 'c'})
+assert(s and a == nil and coroutine.status(f) == "suspended")
+s,a,b,c,d = coroutine.resume(f)
+eqtab(_G.x, {})
+assert(s and a == 1 and b == nil)
+s,a,b,c,d = coroutine.resume(f, 1, 2, 3)
+eqtab(_G.x, {1, 2, 3})
+assert(s and a == 'a' and b == 'b' and c == 'c' and d == nil)
+s,a,b,c,d = coroutine.resume(f, "xuxu")
+eqtab(_G.x, {"xuxu"})
+assert(s and a == 1 and b == 2 and c == 3 and d == nil)
+assert(coroutine.status(f) == "dead")
+s, a = coroutine.resume(f, "xuxu")
+assert(not s and string.find(a, "dead") and coroutine.status(f) == "dead")
+
+-- yields in tail calls
+local function foo (i) return coroutine.yield(i) end
+f = coroutine.wrap(function ()
+  for i=1,10 do
+    assert(foo(i) == _G.x)
+  end
+  return 'a'
+end)
+for i=1,10 do _G.x = i; assert(f(i) == i) end
+_G.x = 'xuxu'; assert(f('xuxu') == 'a')
+
+-- recursive
+function pf (n, i)
+  coroutine.yield(n)
+  pf(n*i, i+1)
+end
+
+f = coroutine.wrap(pf)
+local s=1
+for i=1,10 do
+  assert(f(1, 1) == s)
+  s = s*i
+end
+
+-- sieve
+function gen (n)
+  return coroutine.wrap(function ()
+    for i=2,n do coroutine.yield(i) end
+  end)
+end
+
+
+function filter (p, g)
+  return coroutine.wrap(function ()
+    while 1 do
+      local n = g()
+      if n == nil then return end
+      if math.fmod(n, p) ~= 0 then coroutine.yield(n) end
+    end
+  end)
+end
+
+local x = gen(100)
+local a = {}
+while 1 do
+  local n = x()
+  if n == nil then break end
+  table.insert(a, n)
+  x = filter(n, x)
+end
+
+assert(#a == 25 and a[#a - 1 + B] == 97)
+x, a = nil
+
+-- yielding across pcall
+local co = coroutine.wrap(function ()
+  local ok, v = pcall(function ()
+    local x = coroutine.yield(1)
+    error("oops " .. x)
+  end)
+  assert(not ok and string.find(v, "oops 2"))
+  return 3
+end)
+assert(co() == 1)
+assert(co(2) == 3)
+
+-- errors in coroutines
+function foo ()
+  assert(debug == nil or debug.getinfo(1).currentline == debug.getinfo(foo).linedefined + 1)
+  assert(debug == nil or debug.getinfo(2).currentline == debug.getinfo(goo).linedefined)
+  coroutine.yield(3)
+  error(foo)
+end
+
+function goo() foo() end
+x = coroutine.wrap(goo)
+assert(x() == 3)
+local a,b = pcall(x)
+assert(not a)
+
+x = coroutine.create(goo)
+a,b = coroutine.resume(x)
+assert(a and b == 3)
+a,b = coroutine.resume(x)
+assert(not a and coroutine.status(x) == "dead")
+a,b = coroutine.resume(x)
+assert(not a and string.find(b, "dead") and coroutine.status(x) == "dead")
+
+-- co-routines x for loop
+function all (a, n, k)
+  if k == 0 then coroutine.yield(a)
+  else
+    for i=1,n do
+      a[k] = i
+      all(a, n, k-1)
+    end
+  end
+end
+
+local a = 0
+for t in coroutine.wrap(function () all({}, 5, 4) end) do
+  a = a+1
+end
+assert(a == 5^4)
+
+-- access to locals of collected corroutines
+local C = {}; setmetatable(C, {__mode = "kv"})
+local x = coroutine.wrap (function ()
+            local a = 10
+            local function f () a = a+10; return a end
+            while true do
+              a = a+1
+              coroutine.yield(f)
+            end
+          end)
+
+C[1] = x;
+
+local f = x()
+assert(f() == 21 and x()() == 32 and x() == f)
+x = nil
+assert(f() == 43 and f() == 53)
+
+-- old bug: attempt to resume itself
+
+function co_func (current_co)
+  assert(coroutine.running() == current_co)
+  assert(coroutine.resume(current_co) == false)
+  coroutine.yield(10, 20)
+  assert(coroutine.resume(current_co) == false)
+  coroutine.yield(23)
+  return 10
+end
+
+local co = coroutine.create(co_func)
+local a,b,c = coroutine.resume(co, co)
+assert(a == true and b == 10 and c == 20)
+a,b = coroutine.resume(co, co)
+assert(a == true and b == 23)
+a,b = coroutine.resume(co, co)
+assert(a == true and b == 10)
+assert(coroutine.resume(co, co) == false)
+assert(coroutine.resume(co, co) == false)
+
+-- infinite recursion of coroutines
+a = function(a) coroutine.wrap(a)(a) end
+-- (skipped, there is no C stack limit)
+
+-- access to locals of erroneous coroutines
+local x = coroutine.create (function ()
+            local a = 10
+            _G.f = function () a=a+1; return a end
+            error('x')
+          end)
+
+assert(not coroutine.resume(x))
+-- overwrite previous position of local 'a'
+assert(not coroutine.resume(x, 1, 1, 1, 1, 1, 1, 1))
+assert(_G.f() == 11)
+assert(_G.f() == 12)
+
+-- leaving a pending coroutine open
+_X = coroutine.wrap(function ()
+      local a = 10
+      local x = function () a = a+1 end
+      coroutine.yield()
+    end)
+
+_X()
+
+-- coroutine environments
+co = coroutine.create(function ()
+       coroutine.yield(getmetatable("").__index.len("abc"))
+       _Y = 10
+       return _Y
+     end)
+
+a, b = coroutine.resume(co)
+assert(a and b == 3 and _Y == nil)
+a, b = coroutine.resume(co)
+assert(a and b == 10 and _Y == 10)
+`, nil)
+}
+
+func TestErrors(t *testing.T) { testErrors(t, testhelp.MkState) }
+
+func testErrors(t *testing.T, mk func() *lua.State) {
+	testhelp.AssertBlock(t, mk(), `-- errors.lua (parts)
+-- error values are passed through unchanged
+local ok, e = pcall(error, {code = 42})
+assert(not ok and type(e) == "table" and e.code == 42)
+
+local t = {}
+local ok, e = pcall(error, t)
+assert(not ok and e == t)
+
+local ok, e = pcall(assert, false, t)
+assert(not ok and e == t)
+
+local ok, e = pcall(error, 42)
+assert(not ok and e == 42)
+
+-- position information
+local function f() error("boom") end
+local ok, e = pcall(f)
+assert(not ok and e == "error:17: boom")
+
+local function h() error("boom", 2) end
+local ok, e = pcall(function () h() end)
+assert(not ok and e == "error:22: boom")
+
+local ok, e = pcall(error, "boom", 0)
+assert(not ok and e == "boom")
+
+local function h() error({}, 2) end
+local ok, e = pcall(h)
+assert(not ok and type(e) == "table")
+
+-- errors crossing coroutine boundaries
+local co = coroutine.create(function () error(t) end)
+local ok, e = coroutine.resume(co)
+assert(not ok and e == t)
+
+local ok, e = pcall(coroutine.wrap(function () error(t) end))
+assert(not ok and e == t)
+
+-- message handlers get the original value
+local ok, e = xpcall(error, function (e) return e.code + 1 end, {code = 1})
+assert(not ok and e == 2)
+
+-- nil is an error value too
+assert(select('#', pcall(error, nil)) == 2)
+local ok, e = pcall(error, nil)
+assert(not ok and e == nil)
+
+local ok, e = pcall(error)
+assert(not ok and e == nil)
+
+local ok, e = coroutine.resume(coroutine.create(function () error(nil) end))
+assert(not ok and e == nil)
+
+local ok, e = xpcall(error, function (e) return type(e) end, nil)
+assert(not ok and e == "nil")
+
+local ok, e = xpcall(error, function (e) return nil end, 1)
+assert(not ok and e == nil)
+
+return true
+`, true)
+}
+
+func TestNext(t *testing.T) { testNext(t, testhelp.MkState) }
+
+func testNext(t *testing.T, mk func() *lua.State) {
+	testhelp.AssertBlock(t, mk(), `-- nextvar.lua (parts)
+local function count (t)
+  local n = 0
+  for _ in next, t do n = n + 1 end
+  return n
+end
+
+local B = next{true} -- The index base, these tests run with both 0 and 1 based tables.
+local t = {1, 2, 3, a = 1, b = 2, c = 3, [1.5] = 4, [100] = 5}
+assert(count(t) == 8)
+
+-- nested traversals of the same table
+local n = 0
+for k1, v1 in next, t do
+  for k2, v2 in next, t do
+    assert(t[k1] == v1 and t[k2] == v2)
+    n = n + 1
+  end
+end
+assert(n == 64)
+
+-- changing and clearing fields during a traversal
+for k, v in next, t do
+  if type(v) == "number" and v % 2 == 0 then t[k] = nil else t[k] = v * 10 end
+end
+assert(count(t) == 5 and t[B] == 10 and t[B+2] == 30 and t.a == 10 and t.c == 30 and t[100] == 50)
+
+for k in next, t do t[k] = nil end
+assert(next(t) == nil and count(t) == 0)
+
+-- tables keep working after lots of adding and removing
+for i = 1, 100 do t["x"..i] = i end
+for i = 1, 100, 2 do t["x"..i] = nil end
+for i = 101, 150 do t["x"..i] = i end
+assert(count(t) == 100 and t.x2 == 2 and t.x150 == 150 and t.x1 == nil)
+
+-- getiter iterators are independent of next
+local sum = 0
+for k, v in getiter(t) do
+  for k2 in next, t do end
+  sum = sum + v
+end
+assert(sum == 2550 + 6275)
+
+-- integral float keys are the same keys as the matching integers
+t = {}
+t[10] = "a"
+t[20] = "b"
+local k, v = next(t, 10.0)
+assert(k == 20 and v == "b")
+assert(next(t, 20.0) == nil)
+t = {1, 2}
+assert(next(t, B + 0.0) == B + 1)
+
+-- keys that are not in the table are an error
+local ok, msg = pcall(next, {}, "missing")
+assert(not ok and string.find(msg, "invalid key to 'next'"))
+ok, msg = pcall(next, {1, 2, a = 1}, 3)
+assert(not ok and string.find(msg, "invalid key to 'next'"))
+return true
+`, true)
+}
+
+func TestArgErrors(t *testing.T) { testArgErrors(t, testhelp.MkState) }
+
+func testArgErrors(t *testing.T, mk func() *lua.State) {
+	testhelp.AssertBlock(t, mk(), `-- errors.lua (parts)
+local function checkerr (msg, f, ...)
+  local ok, err = pcall(f, ...)
+  assert(not ok and err == msg, err)
+end
+
+local function checkmsg (msg, code)
+  local ok, err = pcall(load(code))
+  assert(not ok and err == msg, err)
+end
+
+local B = next{true} -- The index base, these tests run with both 0 and 1 based tables.
+
+checkmsg("bad argument #2 to 'sub' (number expected, got table)", "local x = string.sub('abc', {})")
+checkmsg("bad argument #1 to 'sub' (number expected, got table)", "local s = 'abc'; s:sub({})")
+checkmsg("bad argument #1 to 'sub' (string expected, got table)", "local x = string.sub({}, 1)")
+checkmsg("bad argument #2 to 'sub' (number has no integer representation)", "local x = string.sub('a', 1.5)")
+checkmsg("bad argument #3 to 'sub' (number expected, got table)", "local x = string.sub('abc', 1, {})")
+checkmsg("bad argument #2 to 'concat' (string expected, got table)", "local x = table.concat({}, {})")
+checkmsg("bad argument #2 to 'log' (number expected, got table)", "local x = math.log(2, {})")
+checkmsg("bad argument #1 to 'insert' (table expected, got nil)", "table.insert(nil, 1)")
+checkmsg("bad argument #2 to 'insert' (position out of bounds)", "table.insert({}, 5, 1)")
+checkmsg("wrong number of arguments to 'insert'", "table.insert({}, 1, 2, 3)")
+checkmsg("bad argument #1 to 'floor' (number expected, got no value)", "local x = math.floor()")
+checkmsg("bad argument #1 to 'type' (value expected)", "local x = math.type()")
+checkmsg("bad argument #2 to 'fmod' (zero)", "local x = math.fmod(1, 0)")
+checkmsg("bad argument #1 to 'random' (interval is empty)", "local x = math.random(0)")
+checkmsg("bad argument #2 to 'rep' (number expected, got string)", "local x = string.rep('x', 'y')")
+checkmsg("bad argument #1 to 'char' (value out of range)", "local x = string.char(256)")
+checkmsg("invalid value (at index " .. B + 1 .. ") in table for 'concat'", "local x = table.concat({1, {}, 3})")
+checkmsg("calling 'rep' on bad self (string expected, got table)", "local t = {rep = string.rep}; t:rep(2)")
+checkerr("bad argument #1 to '?' (number expected, got boolean)", math.sqrt, true)
+
+-- Things that should still work
+assert(string.sub("abc", "-2") == "bc")
+assert(string.sub(123, -2.0) == "23")
+assert(("abc"):sub(3, 2) == "")
+assert(select("#", ("abc"):byte(-3, -1)) == 3 and ("abc"):byte(-1) == 99)
+assert(string.find("abc", "c", 10) == nil)
+assert(math.floor("2.5") == 2)
+assert(table.concat({1, "b", 3.5}, ",") == "1,b,3.5")
+local t = {1, 2, 3}
+assert(table.remove(t, #t + B) == nil and #t == 3)
+assert(table.remove(t, B) == 1 and t[B] == 2 and t[B+1] == 3 and t[B+2] == nil)
+table.sort(t, nil)
+return true
+`, true)
+}
+
+func TestArith(t *testing.T) { testArith(t, testhelp.MkState) }
+
+func testArith(t *testing.T, mk func() *lua.State) {
+	testhelp.AssertBlock(t, mk(), `-- math.lua (parts)
+local minint, maxint = math.mininteger, math.maxinteger
+local function eqT (a, b) return a == b and math.type(a) == math.type(b) end
+local function isNaN (x) return x ~= x end
+
+-- integer division and modulo
+assert(eqT(-4 // 3, -2) and eqT(4 // -3, -2) and eqT(-4 // -3, 1) and eqT(4 // 3, 1))
+assert(eqT(-3 % 5, 2) and eqT(3 % -5, -2) and eqT(-3 % -5, -3) and eqT(3 % 5, 3))
+assert(eqT(-6 % 3, 0) and eqT(6 % -3, 0))
+assert(eqT(minint // -1, minint) and eqT(minint % -1, 0))
+assert(eqT(maxint // -1, -maxint) and eqT(minint // 1, minint))
+
+-- float division and modulo
+assert(eqT(-4.0 // 3, -2.0) and eqT(7.5 // 2, 3.0) and eqT(-7.5 // 2, -4.0))
+assert(eqT(-3.5 % 2, 0.5) and eqT(3.5 % -2, -0.5) and eqT(5.25 % 1, 0.25))
+assert(eqT(1 // 0.0, math.huge) and eqT(-1 // 0.0, -math.huge))
+assert(isNaN(0 // 0.0) and isNaN(1 % 0.0) and isNaN(math.huge % 1))
+assert(eqT(5 % math.huge, 5.0) and eqT(-5 % math.huge, math.huge))
+assert(eqT(5 % -math.huge, -math.huge) and eqT(-5 % -math.huge, -5.0))
+assert(eqT(1 // math.huge, 0.0) and eqT(-1 // math.huge, -0.0))
+assert(eqT("10" % 3, 1.0) and eqT(10 % "3", 1.0))
+
+local ok, err = pcall(function () return 1 // 0 end)
+assert(not ok and err:find("attempt to perform 'n//0'", nil, true), err)
+ok, err = pcall(function () return 1 % 0 end)
+assert(not ok and err:find("attempt to perform 'n%0'", nil, true), err)
+return true
+`, true)
+
+	l := mk()
+	l.TruncatedDivision = true
+	testhelp.AssertBlock(t, l, `
+assert(-3 % 5 == -3 and 3 % -5 == 3 and -4 // 3 == -1)
+assert(-3.5 % 2 == -1.5)
+local ok, err = pcall(function () return 1 % 0 end)
+assert(not ok and err:find("attempt to perform 'n%0'", nil, true), err)
+return true
+`, true)
+}
+
+func TestHexFloats(t *testing.T) { testHexFloats(t, testhelp.MkState) }
+
+func testHexFloats(t *testing.T, mk func() *lua.State) {
+	testhelp.AssertBlock(t, mk(), `-- math.lua (parts)
+assert(0x10 == 16 and 0xfp1 == 30 and 0x.1 == 0.0625 and 0x1.8p3 == 12.0)
+assert(0xA.8p0 == 10.5 and 0x.1p4 == 1.0 and 0X1P-2 == 0.25 and 0x1p+4 == 16)
+assert(math.type(0x1p4) == "float" and math.type(0x10) == "integer")
+assert(0xffffffffffffffff == -1)
+
+assert(tonumber("0x1.8p3") == 12.0 and tonumber("  -0x1p-1  ") == -0.5)
+assert(tonumber("0x10") == 16 and tonumber("0x.8") == 0.5)
+assert(tonumber("0x") == nil and tonumber("0x1p") == nil and tonumber("0x1.8q3") == nil)
+assert(tonumber("inf") == nil and tonumber("nan") == nil and tonumber("1_0") == nil)
+assert(tonumber("1e400") == math.huge and tonumber("-1e400") == -math.huge)
+
+assert(string.format("%a", 1) == "0x1p+0")
+assert(string.format("%a", 12.0) == "0x1.8p+3")
+assert(string.format("%A", -0.25) == "-0X1P-2")
+assert(string.format("%.3a", 1) == "0x1.000p+0")
+assert(string.format("%a", math.huge) == "inf" and string.format("%a", -math.huge) == "-inf")
+assert(string.format("%d%% %a %s", 5, 0.5, "x") == "5% 0x1p-1 x")
+
+-- round trips are exact
+for _, x in ipairs({math.pi, -1/3, 1e300, 2^-1074, 123456789.123}) do
+  assert(tonumber(string.format("%a", x)) == x)
+  assert(load("return " .. string.format("%a", x))() == x)
+end
+return true
+`, true)
+}
+
+// scriptTests lists the script tests for the tests that run all of them again with different settings. Each test
+// gets a function that makes the States it should run its scripts in.
+var scriptTests = []struct {
+	name string
+	f    func(*testing.T, func() *lua.State)
+}{
+	{"Assign", testAssign},
+	{"Bits", testBits},
+	{"Calls", testCalls},
+	{"Closure", testClosure},
+	{"Syntax", testSyntax},
+	{"Strings", testStrings},
+	{"Coroutine", testCoroutine},
+	{"Errors", testErrors},
+	{"Next", testNext},
+	{"ArgErrors", testArgErrors},
+	{"Arith", testArith},
+	{"HexFloats", testHexFloats},
+	{"Concat", testConcat},
+	{"AndOr", testAndOr},
+	{"Goto", testGoto},
+	{"IndexBase", testIndexBase},
+}
+
+// TestZeroBase runs the other script tests again with 0 based tables, so none of them may depend on the index base.
+func TestZeroBase(t *testing.T) {
+	mk := func() *lua.State { return testhelp.MkStateBase(0) }
+	for _, test := range scriptTests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			test.f(t, mk)
+		})
+	}
+}
+
+// TestOptimized runs the other script tests again with the peephole optimizer turned on. Since the option is set on
+// the State, code loaded by the scripts with load is optimized as well.
+func TestOptimized(t *testing.T) {
+	mk := func() *lua.State {
+		l := testhelp.MkState()
+		l.Options.Optimize = true
+		return l
+	}
+	for _, test := range scriptTests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			test.f(t, mk)
+		})
+	}
+}
+
+func TestIndexBase(t *testing.T) { testIndexBase(t, testhelp.MkState) }
+
+func testIndexBase(t *testing.T, mk func() *lua.State) {
+	l := mk()
+	if l.IndexBase() != 1 {
+		// Running under TestZeroBase, the base specific tests are below.
+		return
+	}
+	l.SetIndexBase(0)
+
+	testhelp.AssertBlock(t, l, `
+local t = {"a", "b", "c"}
+assert(t[0] == "a" and t[2] == "c" and t[3] == nil and #t == 3)
+local s = ""
+for i, v in ipairs(t) do s = s .. i .. v end
+assert(s == "0a1b2c" and table.concat(t) == "abc" and table.concat(t, ",", 1) == "b,c")
+
+table.insert(t, "d")
+assert(t[3] == "d" and #t == 4)
+table.insert(t, 0, "z")
+assert(t[0] == "z" and t[1] == "a" and #t == 5)
+assert(table.remove(t, 0) == "z" and t[0] == "a")
+assert(table.remove(t) == "d" and #t == 3)
+
+local p = table.pack("x", "y")
+assert(p.n == 2 and p[0] == "x" and p[1] == "y")
+local a, b = table.unpack(p)
+assert(a == "x" and b == "y")
+assert(select("#", table.unpack({1, 2, 3}, 1)) == 2)
+
+t = {3, 1, 2}
+table.sort(t)
+assert(t[0] == 1 and t[1] == 2 and t[2] == 3)
+t = (function(...) return {...} end)(1, 2)
+assert(t[0] == 1 and #t == 2)
+
+assert(string.byte("abc") == 97 and string.byte("abc", 2) == 99 and string.byte("abc", -1) == 99)
+assert(select("#", string.byte("abc", 0, 2)) == 3)
+assert(string.sub("hello", 1, 3) == "ell" and string.sub("hello", 0) == "hello" and ("hello"):sub(-3) == "llo")
+assert(string.find("hello", "l") == 2 and string.find("hello", "l", 3) == 3)
+local i, j = string.find("hello", "lo")
+assert(i == 3 and j == 4)
+return true
+`, true)
+}
+
+func TestConcat(t *testing.T) { testConcat(t, testhelp.MkState) }
+
+func testConcat(t *testing.T, mk func() *lua.State) {
+	testhelp.AssertBlock(t, mk(), `-- events.lua (parts)
+t = {}
+t.__concat = function (a,b,c)
+  assert(c == nil)
+  if type(a) == 'table' then a = a.val end
+  if type(b) == 'table' then b = b.val end
+  if A then return a..b
+  else return setmetatable({val=a..b}, t) end
+end
+
+c = {val="c"}; setmetatable(c, t)
+d = {val="d"}; setmetatable(d, t)
+
+A = true
+assert(c..d == 'cd')
+assert(0 .."a".."b"..c..d.."e".."f"..(5+3).."g" == "0abcdef8g")
+
+A = false
+assert((c..d..c..d).val == 'cdcd')
+x = c..d
+assert(getmetatable(x) == t and x.val == 'cd')
+x = 0 .."a".."b"..c..d.."e".."f".."g"
+assert(x.val == "0abcdefg")
+
+-- concat metamethod x numbers (bug in 5.1.1)
+c = {}
+local x
+setmetatable(c, {__concat = function (a,b)
+  assert(type(a) == "number" and b == c or type(b) == "number" and a == c)
+  return c
+end})
+assert(c..5 == c and 5 .. c == c)
+assert(4 .. c .. 5 == c and 4 .. 5 .. 6 .. 7 .. c == c)
+
+-- pairs are handled from right to left
+local log = ""
+local mt = {__concat = function (a, b)
+  local function s(v) return type(v) == "table" and v.name or v end
+  log = log .. "(" .. s(a) .. "," .. s(b) .. ")"
+  return s(a) .. s(b)
+end}
+local p, q = setmetatable({name = "p"}, mt), setmetatable({name = "q"}, mt)
+assert(p .. "x" .. q .. "y" == "pxqy")
+assert(log == "(q,y)(p,xqy)", log)
+
+assert(not pcall(function () return {} .. "x" end))
+assert(not pcall(function () return "x" .. nil end))
+return true
+`, true)
+}
+
+func TestAndOr(t *testing.T) { testAndOr(t, testhelp.MkState) }
+
+func testAndOr(t *testing.T, mk func() *lua.State) {
+	testhelp.AssertBlock(t, mk(), `
+local B = next{true} -- The index base, these tests run with both 0 and 1 based tables.
+local function id(...) return ... end
+local n = 0
+local function inc(v) n = n + 1 return v end
+local t, f = true, false
+
+assert((nil or false) == false and (false and nil) == false)
+assert((1 and 2 or 3) == 2 and (nil and 2 or 3) == 3 and (1 or 2 and 3) == 1)
+
+-- the right side is only evaluated when needed
+local a = inc(nil) and inc(1)
+assert(a == nil and n == 1)
+a = inc(false) or inc(2)
+assert(a == 2 and n == 3)
+a = inc(1) or inc(2)
+assert(a == 1 and n == 4)
+
+-- comparisons with NaN are false both ways around
+local x = 0/0
+assert(not (x > x) and not (x >= x) and not (x < x) and not (x <= x) and x ~= x)
+assert(not (x > 1.0) and not (x >= 1.0) and not (1.0 > x) and not (1.0 >= x))
+assert(((x < 2.0) and "yes" or "no") == "no")
+
+-- not
+local y = not (t and f)
+assert(y == true)
+y = not (t and 1)
+assert(y == false)
+y = not (1 < 2) or "x"
+assert(y == "x")
+assert((not a or 5) == 5 and (not nil or 5) == true and (not a and 5) == false and (not nil and 5) == 5)
+assert(not x == false and (x == x) == false and not (x == x) == true)
+
+-- conditions
+local c = 0
+for i = 1, 10 do
+  if i % 2 == 0 and i > 4 or i == 1 then c = c + 1 end
+end
+assert(c == 4)
+local i = 0
+while i < 10 and not (i == 5) do i = i + 1 end
+assert(i == 5)
+repeat i = i + 1 until i >= 8 or i == 100
+assert(i == 8)
+
+-- values in other places
+local tt = {t and 1 or 2, f and 1 or 2, nil or id(1, 2)}
+assert(tt[B] == 1 and tt[B+1] == 2 and tt[B+2] == 1 and tt[B+3] == nil)
+local p, q = id(1 and 2, nil or 3)
+assert(p == 2 and q == 3)
+local r = {}
+r.a = f or "z"
+assert(r.a == "z")
+local function g(a, b) return a or b end
+assert(g(nil, 5) == 5 and g(4, 5) == 4 and g(false, nil) == nil)
+local function h(a, b) return a and b end
+assert(h(nil, 5) == nil and h(4, 5) == 5 and h(false, nil) == false)
+assert(((t or f) and (f or "ok")) == "ok")
+local z = 3
+z = z > 2 and z or 0
+assert(z == 3)
+`, nil)
+}
+
+func TestGoto(t *testing.T) { testGoto(t, testhelp.MkState) }
+
+func testGoto(t *testing.T, mk func() *lua.State) {
+	testhelp.AssertBlock(t, mk(), `-- goto.lua (error messages and things that need the debug library changed)
+local function errmsg (code, m)
+  local st, msg = load(code)
+  assert(not st and string.find(msg, m, 1, true), msg)
+end
+
+-- cannot see label inside block
+errmsg([[ goto l1; do ::l1:: end ]], "\"l1\"")
+errmsg([[ do ::l1:: end goto l1; ]], "\"l1\"")
+
+-- repeated label
+errmsg([[ ::l1:: ::l1:: ]], "\"l1\"")
+
+-- undefined label
+errmsg([[ goto l1; local aa ::l1:: ::l2:: print(3) ]], "\"l1\"")
+
+-- jumping over local definition
+errmsg([[
+do local bb, cc; goto l1; end
+local aa
+::l1:: print(3)
+]], "\"l1\"")
+
+-- jumping into a block
+errmsg([[ do ::l1:: end goto l1 ]], "\"l1\"")
+errmsg([[ goto l1 do ::l1:: end ]], "\"l1\"")
+
+-- cannot continue a repeat-until with variables
+errmsg([[
+  repeat
+    if x then goto cont end
+    local xuxu = 10
+    ::cont::
+  until xuxu < x
+]], "\"cont\"")
+
+-- labels are not visible in nested functions
+errmsg([[ ::l1:: local function f() goto l1 end ]], "\"l1\"")
+
+-- simple gotos
+local x
+do
+  local y = 12
+  goto l1
+  ::l2:: x = x + 1; goto l3
+  ::l1:: x = y; goto l2
+end
+::l3:: ::l3_1:: assert(x == 13)
+
+-- long labels
+do
+  local prog = [[
+  do
+    local a = 1
+    goto l%sa; a = a + 1
+   ::l%sa:: a = a + 10
+    goto l%sb; a = a + 2
+   ::l%sb:: a = a + 20
+    return a
+  end
+  ]]
+  local label = string.rep("0123456789", 40)
+  prog = string.format(prog, label, label, label, label)
+  assert(assert(load(prog))() == 31)
+end
+
+-- goto to correct label when nested
+do goto l3; ::l3:: end   -- does not loop jumping to previous label 'l3'
+
+-- ok to jump over local dec. to end of block
+do
+  goto l5
+  local a = 23
+  x = a
+  ::l5::;;
+end
+
+while true do
+  goto l4
+  goto l1  -- ok to jump over local dec. to end of block
+  goto l1  -- multiple uses of same label
+  local x = 45
+  ::l1:: ;;;
+end
+::l4:: assert(x == 13)
+
+if print then
+  goto l1   -- ok to jump over local dec. to end of block
+  error("should not be here")
+  goto l2   -- ok to jump over local dec. to end of block
+  local x
+  ::l1:: ; ::l2:: ;;
+else end
+
+-- to repeat a label in a different function is OK
+local function foo ()
+  local a, done = "", false
+  goto l3
+  ::l1:: a = a .. 1; goto l2;
+  ::l2:: a = a .. 2; goto l5;
+  ::l3::
+  ::l3a:: a = a .. 3; goto l1;
+  ::l4:: a = a .. 4; goto l6;
+  ::l5:: a = a .. 5; goto l4;
+  ::l6:: assert(a == string.rep("31254", #a // 5))
+  if not done then done = true; goto l3a end   -- do it twice
+  assert(a == "3125431254")
+end
+
+::l6:: foo()
+
+do   -- bug in 5.2 -> 5.3.2
+  local x
+  ::L1::
+  local y             -- cannot join this SETNIL with previous one
+  assert(y == nil)
+  y = true
+  if x == nil then
+    x = 1
+    goto L1
+  else
+    x = x + 1
+  end
+  assert(x == 2 and y == true)
+end
+
+-- goto as continue
+local s = 0
+for i = 1, 10 do
+  if i % 2 == 0 then goto continue end
+  local v = i * 10
+  s = s + v
+  ::continue::
+end
+assert(s == 250)
+local n = 0
+while n < 10 do
+  n = n + 1
+  if n < 5 then goto continue end
+  local m = n
+  ::continue::
+end
+assert(n == 10)
+
+-- closing of upvalues on backward gotos
+local fs = {}
+do
+  local i = 1
+  ::top::
+  local x = i
+  fs[i] = function () return x end
+  i = i + 1
+  if i <= 3 then goto top end
+end
+assert(fs[1]() == 1 and fs[2]() == 2 and fs[3]() == 3)
+
+local function foo ()
+  local t, n = {}, 1
+  do
+  local i = 1
+  local a, b, c, d
+  t[1] = function () return a, b, c, d end
+  ::l1::
+  local b
+  do
+    local c
+    n = n + 1
+    t[n] = function (v) if v then b, c = v, v end return a, b, c, d end    -- t[2], t[4], t[6]
+    if i > 2 then goto l2 end
+    do
+      local d
+      n = n + 1
+      t[n] = function (v) if v then d = v end return a, b, c, d end   -- t[3], t[5]
+      i = i + 1
+      local a
+      goto l1
+    end
+  end
+  end
+  ::l2:: return t
+end
+
+local a = foo()
+assert(a[6] and not a[7])
+a[2]("x")
+a[3]("y")
+local _, b, c, d = a[3]()
+assert(b == "x" and c == "x" and d == "y")
+_, b, c, d = a[4]()
+assert(b == nil and c == nil and d == nil)
+_, b, c, d = a[5]()
+assert(b == nil and c == nil and d == nil)
+_, b, c, d = a[1]()
+assert(b == nil and c == nil and d == nil)
+
+-- jumping out of a block closes its upvalues
+local gs = {}
+for i = 1, 3 do
+  do
+    local y = i
+    gs[i] = function () return y end
+    goto next
+  end
+  ::next::
+end
+assert(gs[1]() == 1 and gs[2]() == 2 and gs[3]() == 3)
+
+local function testG (a)
+  if a == 1 then
+    goto l1
+    error("should never be here!")
+  elseif a == 2 then goto l2
+  elseif a == 3 then goto l3
+  elseif a == 4 then
+    goto l1  -- go to inside the block
+    error("should never be here!")
+    ::l1:: a = a + 1   -- must go to 'if' end
+  else
+    goto l4
+    ::l4a:: a = a * 2; goto l4b
+    error("should never be here!")
+    ::l4:: goto l4a
+    error("should never be here!")
+    ::l4b::
+  end
+  do return a end
+  ::l2:: do return "2" end
+  ::l3:: do return "3" end
+  ::l1:: return "1"
+end
+
+assert(testG(1) == "1")
+assert(testG(2) == "2")
+assert(testG(3) == "3")
+assert(testG(4) == 5)
+assert(testG(5) == 10)
+`, nil)
+}
+
 //func TestX(t *testing.T) {
 //	testhelp.AssertBlock(t, testhelp.MkState(), `-- .lua
 //
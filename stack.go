@@ -28,18 +28,23 @@ import "github.com/milochristiansen/lua/luautil"
 // isolated "segment". Once you add a new callFrame you cannot push and pop values in the previous
 // callFrame(s) segments, but you can modify them by index.
 type stack struct {
-	data   []value
+	data   []tvalue
 	frames []*callFrame
 
 	// List of all unclosed upvalues (which by definition are on the stack somewhere).
 	// This list is ordered higher indexes to lower indexes by requirement and construction.
 	unclosed *upValue
+
+	// The size limits, shared by all the threads of a State. See limits.go.
+	limits *stackLimits
+	extra  bool // Allow some extra room so error handlers can run after a stack overflow.
 }
 
-func newStack() *stack {
+func newStack(limits *stackLimits) *stack {
 	stk := &stack{
-		data:   make([]value, 0, 1024),
+		data:   make([]tvalue, 0, 1024),
 		frames: make([]*callFrame, 1, 64),
+		limits: limits,
 	}
 
 	stk.frames[0] = &callFrame{
@@ -50,6 +55,25 @@ func newStack() *stack {
 	return stk
 }
 
+// reset closes all open upvalues and removes everything from the stack, leaving it just like newStack did.
+func (stk *stack) reset() {
+	stk.frames[0].closeUpAbs(0)
+
+	for i := range stk.data {
+		stk.data[i] = tvalue{}
+	}
+	stk.data = stk.data[:0]
+
+	for i := range stk.frames {
+		stk.frames[i] = nil
+	}
+	stk.frames = stk.frames[:1]
+	stk.frames[0] = &callFrame{
+		stk:  stk,
+		base: -1,
+	}
+}
+
 // bounds returns the boundary values for the given frame.
 // Negative indexes are relative to TOS, positive indexes are absolute.
 // "segC" is the index of the last item of the previous frame.
@@ -117,17 +141,40 @@ func (stk *stack) topBounds() (segC int, segN int) {
 	return segC, segN
 }
 
+// checkDepth raises a stack overflow error if adding another frame would exceed the call depth limit.
+func (stk *stack) checkDepth() {
+	max := stk.limits.depth
+	if stk.extra {
+		max += extraFrames
+	}
+	if len(stk.frames) >= max {
+		luautil.Raise("stack overflow", luautil.ErrTypGenRuntime)
+	}
+}
+
+// checkSlots raises a stack overflow error if the stack may not hold n items.
+func (stk *stack) checkSlots(n int) {
+	max := stk.limits.slots
+	if stk.extra {
+		max += extraSlots
+	}
+	if n > max {
+		luautil.Raise("stack overflow", luautil.ErrTypGenRuntime)
+	}
+}
+
 // ensure makes sure that the index i is valid and is writable. The index is global, not an index into a particular frame.
 func (stk *stack) ensure(i int) {
 	ssize := len(stk.data)
 	if i < ssize {
 		return
 	}
+	stk.checkSlots(i + 1)
 	needed := i - ssize
-	if ssize+needed <= cap(stk.data) {
+	if i < cap(stk.data) {
 		stk.data = stk.data[:ssize+needed+1]
 	} else {
-		stk.data = append(stk.data, make([]value, needed)...)
+		stk.data = append(stk.data, make([]tvalue, needed+1)...)
 	}
 }
 
@@ -184,17 +231,22 @@ func (stk *stack) SetTop(t int) {
 // frame boundary (positive indexes).
 // If the index is out of the current frame's bounds then nil will be returned.
 func (stk *stack) Get(index int) value {
+	return stk.GetT(index).value()
+}
+
+// GetT is Get without converting the result to a plain value.
+func (stk *stack) GetT(index int) tvalue {
 	segC, segN := stk.topBounds()
 
 	if index >= 0 {
 		if segC+index+1 > segN {
-			return nil
+			return tvalue{}
 		}
 		return stk.data[segC+index+1]
 	}
 
 	if segN+index+1 <= segC {
-		return nil
+		return tvalue{}
 	}
 	return stk.data[segN+index+1]
 }
@@ -203,11 +255,16 @@ func (stk *stack) Get(index int) value {
 // Reading items beyond the protected range returns nil.
 // Positive indexes only!
 func (stk *stack) GetArgs(index int) value {
+	return stk.GetArgsT(index).value()
+}
+
+// GetArgsT is GetArgs without converting the result to a plain value.
+func (stk *stack) GetArgsT(index int) tvalue {
 	segC, _ := stk.topBounds()
 
 	frame := stk.cFrame()
 	if !frame.holdArgs || index >= frame.nArgs {
-		return nil
+		return tvalue{}
 	}
 
 	return stk.data[segC-frame.nArgs+index+1]
@@ -222,20 +279,25 @@ func (stk *stack) GetInFrame(frame, index int) value {
 		if segC+index+1 > segN {
 			return nil
 		}
-		return stk.data[segC+index+1]
+		return stk.data[segC+index+1].value()
 	}
 
 	if segN+index+1 <= segC {
 		return nil
 	}
-	return stk.data[segN+index+1]
+	return stk.data[segN+index+1].value()
 }
 
 // GetAbs acts like Get, except it looks an absolute index up.
 // Used for handling upvalues.
 func (stk *stack) GetAbs(index int) value {
+	return stk.GetAbsT(index).value()
+}
+
+// GetAbsT is GetAbs without converting the result to a plain value.
+func (stk *stack) GetAbsT(index int) tvalue {
 	if index < 0 || index >= len(stk.data) {
-		return nil
+		return tvalue{}
 	}
 	return stk.data[index]
 }
@@ -244,6 +306,11 @@ func (stk *stack) GetAbs(index int) value {
 // frame boundary (positive indexes).
 // If the given index is absolute and outside of the frame bounds then the frame is extended.
 func (stk *stack) Set(index int, val value) {
+	stk.SetT(index, tv(val))
+}
+
+// SetT is Set for tvalues.
+func (stk *stack) SetT(index int, val tvalue) {
 	segC, segN := stk.topBounds()
 
 	if index >= 0 {
@@ -266,19 +333,24 @@ func (stk *stack) SetInFrame(frame, index int, val value) {
 
 	if index >= 0 {
 		stk.ensure(segC + index + 1)
-		stk.data[segC+index+1] = val
+		stk.data[segC+index+1] = tv(val)
 		return
 	}
 
 	if segN+index+1 <= segC {
 		return
 	}
-	stk.data[segN+index+1] = val
+	stk.data[segN+index+1] = tv(val)
 }
 
 // SetAbs modifies the value at the given absolute index.
 // If the given index is outside of the frame bounds then the frame is extended.
 func (stk *stack) SetAbs(index int, val value) {
+	stk.SetAbsT(index, tv(val))
+}
+
+// SetAbsT is SetAbs for tvalues.
+func (stk *stack) SetAbsT(index int, val tvalue) {
 	if index >= 0 {
 		stk.ensure(index)
 		stk.data[index] = val
@@ -299,7 +371,7 @@ func (stk *stack) Pop(n int) {
 		if segN-i <= segC {
 			break
 		}
-		stk.data[segN-i] = nil
+		stk.data[segN-i] = tvalue{}
 	}
 
 	if (segN+1)-n <= segC {
@@ -312,9 +384,17 @@ func (stk *stack) Pop(n int) {
 // Push adds a new value to the stack.
 // If there are no frames on the stack nothing is done.
 func (stk *stack) Push(val value) {
+	stk.PushT(tv(val))
+}
+
+// PushT is Push for tvalues.
+func (stk *stack) PushT(val tvalue) {
 	if len(stk.frames) == 0 {
 		luautil.Raise("No frames on the stack.", luautil.ErrTypMajorInternal)
 	}
+	if len(stk.data) >= stk.limits.slots {
+		stk.checkSlots(len(stk.data) + 1)
+	}
 
 	stk.data = append(stk.data, val)
 }
@@ -333,13 +413,14 @@ func (stk *stack) Insert(i int, v value) {
 		luautil.Raise("Index out of range for Insert.", luautil.ErrTypGenRuntime)
 	}
 
-	stk.data = append(stk.data, nil)
+	stk.checkSlots(len(stk.data) + 1)
+	stk.data = append(stk.data, tvalue{})
 	segN++
 
 	for k := segN; k > i; k-- {
 		stk.data[k] = stk.data[k-1]
 	}
-	stk.data[i] = v
+	stk.data[i] = tv(v)
 }
 
 // FrameIndex returns the current frame index or -1 if there are no frames on the stack.
@@ -350,6 +431,8 @@ func (stk *stack) FrameIndex() int {
 // AddFrame adds a new callFrame to the stack.
 // args must be the real argument count, and there must be at least that many items between fi and the TOS.
 func (stk *stack) AddFrame(fn *function, fi, args, rtns int) {
+	stk.checkDepth()
+
 	pbase := -1
 	if len(stk.frames) > 0 {
 		pbase = stk.cFrame().base
@@ -384,6 +467,22 @@ func (stk *stack) AddFrame(fn *function, fi, args, rtns int) {
 	//}
 
 	stk.frames = append(stk.frames, frame)
+
+	if frame.holdArgs {
+		stk.copyParams(frame)
+	}
+}
+
+// copyParams copies the fixed parameters of a frame with protected arguments to the bottom of its segment,
+// so they end up in the registers the function expects them in. Missing parameters are set to nil.
+func (stk *stack) copyParams(frame *callFrame) {
+	for i := 0; i < frame.fn.proto.parameterCount; i++ {
+		if i < frame.nArgs {
+			stk.data = append(stk.data, stk.data[frame.base+1+i])
+			continue
+		}
+		stk.data = append(stk.data, tvalue{})
+	}
 }
 
 // TailFrame prepares the frame on TOS for use in a tail call.
@@ -401,7 +500,9 @@ func (stk *stack) TailFrame(fn *function, fi, args int) {
 	}
 
 	frame.pc = 0
+	frame.oldpc = 0
 	frame.fn = fn
+	frame.tailCall = true
 
 	frame.holdArgs = fn.native == nil && fn.proto.isVarArg == 1
 
@@ -413,9 +514,13 @@ func (stk *stack) TailFrame(fn *function, fi, args int) {
 	// shortcut
 	if args <= 0 {
 		for i := rsegC + 1; i <= segN; i++ {
-			stk.data[i] = nil
+			stk.data[i] = tvalue{}
 		}
 		stk.data = stk.data[:rsegC+1]
+
+		if frame.holdArgs {
+			stk.copyParams(frame)
+		}
 		return
 	}
 
@@ -424,9 +529,13 @@ func (stk *stack) TailFrame(fn *function, fi, args int) {
 		stk.data[rsegC+1+i] = stk.data[segC+1+fi+1+i]
 	}
 	for i := rsegC + 1 + args; i < len(stk.data); i++ {
-		stk.data[i] = nil
+		stk.data[i] = tvalue{}
 	}
 	stk.data = stk.data[:rsegC+args+1]
+
+	if frame.holdArgs {
+		stk.copyParams(frame)
+	}
 }
 
 // ReturnFrame drops the current frame, saving the return values by adding them to the top of the previous frame.
@@ -465,13 +574,13 @@ func (stk *stack) ReturnFrame() {
 
 	// Wipe everything but the return values
 	for i := psegC + 1 + frame.retTo + retC; i <= segN; i++ {
-		stk.data[i] = nil
+		stk.data[i] = tvalue{}
 	}
 	stk.data = stk.data[:psegC+1+frame.retTo+retC]
 
 	// Now correct for retC < retE
 	for retC < retE {
-		stk.data = append(stk.data, nil)
+		stk.data = append(stk.data, tvalue{})
 		retC++
 	}
 
@@ -486,7 +595,7 @@ func (stk *stack) DropFrame() {
 	}
 
 	for i := segC + 1; i <= segN; i++ {
-		stk.data[i] = nil
+		stk.data[i] = tvalue{}
 	}
 
 	stk.data = stk.data[:segC+1]
@@ -25,11 +25,10 @@ misrepresented as being the original software.
 // The compiler generates correct code in every case I have tested, but the code quality is sometimes poor. If
 // you want better code quality it is possible to compile scripts with luac and load the binaries...
 //
-// Currently the compiler does not support constant folding, and some special instructions are not used at all
-// (instead preferring simpler sequences of other instructions). For example TESTSET is never generated, TEST
-// is used in all cases (largely because It would greatly complicate the compiler if I tried to use TESTSET
-// where possible). Expressions use a simple "recursive" code generation style, meaning that it wastes registers
-// like crazy in some (rare) cases.
+// The compiler folds constant expressions (and propagates locals that always hold a constant) and compiles `and`
+// and `or` with jump lists (using TESTSET where the value is needed) much like the reference compiler, but some
+// special instructions are not used at all (instead preferring simpler sequences of other instructions). Expressions
+// use a simple "recursive" code generation style, meaning that it wastes registers like crazy in some (rare) cases.
 //
 // Most (if not all) of the API functions may cause a panic, but only if things go REALLY wrong. If a function
 // does not state that it can panic or "raise an error" it will only do so if a critical internal assumption
@@ -53,6 +52,8 @@ package lua
 import "fmt"
 import "os"
 import "io"
+import "context"
+import "reflect"
 
 const (
 	// If you have more than 1000000 items in a single stack frame you probably should think about refactoring...
@@ -71,17 +72,74 @@ type State struct {
 	// Add a native stack trace to errors that have attached stack traces.
 	NativeTrace bool
 
+	// Use Go's % and / operators for the Lua % and // operators (the results are truncated towards zero). Older
+	// versions of this VM always did this, Lua 5.3 requires results that are rounded towards negative infinity.
+	// Only set this if you have scripts that depend on the old behavior!
+	TruncatedDivision bool
+
+	// The compiler options used by LoadText (and so by the base library's load and anything else that loads source
+	// code through LoadText). LoadTextOptions ignores this.
+	Options Options
+
+	// Everything shared by all threads created from this State.
+	*globalState
+
+	stack *stack
+
+	// Coroutine support, see coroutine.go.
+	status ThreadStatus
+	co     *coroutine // nil for the main thread
+
+	// Debug hooks, see debug.go. Hooks are per-thread.
+	hook      HookFunc
+	hookMask  HookMask
+	hookCount int
+	hookLeft  int
+	inHook    bool
+}
+
+// globalState holds the parts of a State that are shared between all of its threads.
+type globalState struct {
 	registry *table
 	global   *table // _G
 	metaTbls [typeCount]*table
 
-	stack *stack
+	// Execution limits, see limits.go
+	ctx       context.Context
+	limited   bool
+	instLimit int64 // Remaining instructions, only valid if limited is set.
+	countdown int64 // Instructions left until the next checkpoint.
+	lastCount int64 // The value countdown was last set to.
+
+	// Stack size limits, see limits.go
+	stackLimits stackLimits
+
+	// Memory accounting, see memory.go
+	memAlloc int64
+	memLimit int64
+
+	// Threads that have been started and have not finished, see coroutine.go
+	threads map[*State]bool
+
+	// Objects waiting to have their __gc meta method called, see gc.go
+	finalizers gcQueue
+
+	// Go types registered with RegisterType, see usertype.go
+	userTypes map[reflect.Type]*userType
+
+	// The index of the first item in a sequence, see SetIndexBase.
+	indexBase int
 }
 
 // NewState creates a new State, ready to use.
 func NewState() *State {
+	g := &globalState{
+		stackLimits: stackLimits{depth: DefaultCallDepth, slots: DefaultStackSlots},
+		indexBase:   TableIndexOffset,
+	}
 	l := &State{
-		stack: newStack(),
+		globalState: g,
+		stack:       newStack(&g.stackLimits),
 	}
 
 	l.global = newTable(l, 0, 64)
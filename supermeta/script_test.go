@@ -158,6 +158,32 @@ x.Y = {"a", "b", "c"}
 	testhelp.Assert(t, len(x.Y) == 3 && x.Y[0] == "a" && x.Y[1] == "b" && x.Y[2] == "c", "Set failed")
 }
 
+// Slices use the State's index base, whatever it is.
+func TestSliceIndexBase(t *testing.T) {
+	l := testhelp.MkState()
+	l.SetIndexBase(0)
+
+	l.Push("x")
+	x := &struct{ Y []string }{Y: []string{"a", "B"}}
+	supermeta.New(l, x)
+	l.SetTableRaw(lua.GlobalsIndex)
+
+	testhelp.AssertBlock(t, l, `
+assert(x.Y[0] == "a" and x.Y[1] == "B" and x.Y[2] == nil and #x.Y == 2)
+x.Y[#x.Y] = "c"
+
+local rtn = ""
+for k, v in pairs(x.Y) do
+	rtn = rtn..k..v
+end
+assert(rtn == "0a1B2c")
+
+x.Y = {"d", "e"}
+	`, nil)
+
+	testhelp.Assert(t, len(x.Y) == 3 && x.Y[0] == "d" && x.Y[1] == "e" && x.Y[2] == "c", "Set failed")
+}
+
 func TestMapBasics(t *testing.T) {
 	l := testhelp.MkState()
 
@@ -47,9 +47,10 @@ the data from the table is used to fill as many keys in the object as possible.
 lengthened as needed, arrays will simply ignore extra items. If any key or value in the table
 cannot be converted to the required type conversion will halt with an error.
 
-Slices an arrays are indexed from 1. Basically I just subtract one from all incoming indexes.
-This is done to better fit with the rest of Lua, not because I like 1-based indexing (I actually
-think it is a really stupid idea, and Lua's biggest problem).
+Slices an arrays are indexed from the State's index base (1 unless you changed it with SetIndexBase).
+Basically I just subtract the base from all incoming indexes. This is done to better fit with the
+rest of Lua, not because I like 1-based indexing (I actually think it is a really stupid idea, and
+Lua's biggest problem).
 
 I make a fairly good effort at auto-vivification, any assignment to a nil pointer should result
 in a new object being created. Sadly this cannot be done for nil interfaces (for obvious reasons).
@@ -252,10 +253,11 @@ func fromSlice(l *lua.State, dest reflect.Value, src int) (err error) {
 		i = dest.Len()
 	}
 
-	for j := 1; j <= i; j++ {
-		d := dest.Index(j - 1)
+	base := l.IndexBase()
+	for j := 0; j < i; j++ {
+		d := dest.Index(j)
 
-		l.Push(j)
+		l.Push(j + base)
 		l.GetTable(src)
 		err := from(d.Kind())(l, d, -1)
 		l.Pop(1)
@@ -41,7 +41,7 @@ func sliceTable(l *lua.State, obj reflect.Value) {
 		if !ok {
 			return 0
 		}
-		k--
+		k -= int64(l.IndexBase())
 
 		if k >= int64(o.Len()) || k < 0 {
 			return 0
@@ -60,7 +60,7 @@ func sliceTable(l *lua.State, obj reflect.Value) {
 		if !ok {
 			return 0
 		}
-		k--
+		k -= int64(l.IndexBase())
 
 		ln := int64(o.Len())
 		if k > ln || k < 0 {
@@ -96,18 +96,18 @@ func sliceTable(l *lua.State, obj reflect.Value) {
 		l.Push(func(l *lua.State) int {
 			o := l.ToUser(1).(reflect.Value)
 
-			i := int(l.ToInt(2))
-			i++
-			if i <= o.Len() {
-				l.Push(int64(i))
-				to(vk)(l, o.Index(i-1))
+			base := l.IndexBase()
+			i := int(l.ToInt(2)) - base + 1
+			if i < o.Len() {
+				l.Push(int64(i + base))
+				to(vk)(l, o.Index(i))
 				return 2
 			}
 			l.Push(nil)
 			return 1
 		})
 		l.PushIndex(1)
-		l.Push(int64(0))
+		l.Push(int64(l.IndexBase() - 1))
 		return 3
 	})
 	l.SetTableRaw(-3)
@@ -27,37 +27,68 @@ misrepresented as being the original software.
 package lua
 
 import "math"
-import "runtime"
 
-// Set to 0 for zero based table indexing. This is only partly tested!
+import "github.com/milochristiansen/lua/luautil"
+
+// TableIndexOffset is the index base new States start with.
+//
+// Deprecated: Changing this affects every State created afterwards, use SetIndexBase instead.
 var TableIndexOffset = 1
 
+// SetIndexBase sets the index of the first item of a sequence, set to 0 for zero based table indexing. The default
+// is 1, like the reference implementation.
+//
+// The base affects how tables decide which keys go in the array part and how long a sequence is, and the standard
+// library uses it everywhere it creates or reads sequences (table, ipairs, string positions, etc). The base is shared
+// by all threads created from a State. Set the base right after creating the State: tables that already have items
+// in their array part will not be converted!
+func (l *State) SetIndexBase(base int) {
+	l.indexBase = base
+}
+
+// IndexBase returns the index of the first item of a sequence, see SetIndexBase.
+func (l *State) IndexBase() int {
+	return l.indexBase
+}
+
 // table is the VM's table type.
 type table struct {
 	meta *table
 	l    *State
 
-	array  []value
+	array  []tvalue
 	length int // The stored sequence length, negative values signify that the length needs to be recalculated.
 
-	hash map[value]value
-
-	// For use with next
-	iorder []value
-	ikeys  map[value]int
+	// The hash part. The map holds the index of each key's entry in hkeys/hvals, which store the entries in the
+	// order they were added. Removing a key only clears its value (the key is kept as a "tombstone"), that way
+	// next can still find the successor of a key that was cleared during a traversal. Tombstones are removed
+	// when new keys are added and there are too many of them.
+	hash  map[value]int
+	hkeys []value
+	hvals []value
+	dead  int // The number of tombstones.
+
+	finalize bool // Has this table been marked for finalization? See gc.go
+
+	// Weak table support, see weak.go
+	weakK bool
+	weakV bool
+	added int // Number of keys added since the last sweep.
 }
 
 func newTable(l *State, as, hs int) *table {
+	l.TrackMemory(int64(memTable + as*memValue + hs*memHashEntry))
+
 	t := new(table)
 	t.l = l
 
 	if as > 0 {
-		t.array = make([]value, as)
+		t.array = make([]tvalue, as)
 	}
+	t.hash = make(map[value]int, hs)
 	if hs > 0 {
-		t.hash = make(map[value]value, hs)
-	} else {
-		t.hash = make(map[value]value)
+		t.hkeys = make([]value, 0, hs)
+		t.hvals = make([]value, 0, hs)
 	}
 
 	return t
@@ -66,21 +97,28 @@ func newTable(l *State, as, hs int) *table {
 // extend grows the table's underlying array part until it is last elements long, then tries to move as many
 // items from the hash part to the array part as possible.
 func (tbl *table) extend(last int) {
-	tbl.array = append(tbl.array, make([]value, last-len(tbl.array))...)
-	for k, v := range tbl.hash {
+	tbl.l.TrackMemory(int64((last - len(tbl.array)) * memValue))
+
+	tbl.array = append(tbl.array, make([]tvalue, last-len(tbl.array))...)
+	for i, k := range tbl.hkeys {
+		v := tbl.hvals[i]
+		if v == nil {
+			continue
+		}
+
 		switch idx := k.(type) {
 		case float64:
 			if i := int(idx); float64(i) == idx {
-				i2 := i - TableIndexOffset
+				i2 := i - tbl.l.indexBase
 				if 0 <= i2 && i2 < len(tbl.array) {
-					tbl.array[i2] = v
-					delete(tbl.hash, k)
+					tbl.array[i2] = tv(v)
+					tbl.delHash(k)
 				}
 			}
 		case int64:
-			if i2 := int(idx) - TableIndexOffset; 0 <= i2 && i2 < len(tbl.array) {
-				tbl.array[i2] = v
-				delete(tbl.hash, k)
+			if i2 := int(idx) - tbl.l.indexBase; 0 <= i2 && i2 < len(tbl.array) {
+				tbl.array[i2] = tv(v)
+				tbl.delHash(k)
 			}
 		}
 	}
@@ -100,12 +138,16 @@ func (tbl *table) maybeExtend(key int) bool {
 
 	occupancy := 0
 	for _, v := range tbl.array {
-		if v != nil {
+		if !v.isNil() {
 			occupancy++
 		}
 	}
 
-	for k, _ := range tbl.hash {
+	for i, k := range tbl.hkeys {
+		if tbl.hvals[i] == nil {
+			continue
+		}
+
 		switch idx := k.(type) {
 		case float64:
 			if i := int(idx); float64(i) == idx {
@@ -121,7 +163,8 @@ func (tbl *table) maybeExtend(key int) bool {
 	}
 
 	if occupancy == 0 && key == 0 {
-		tbl.array = make([]value, 1, 32)
+		tbl.l.TrackMemory(32 * memValue)
+		tbl.array = make([]tvalue, 1, 32)
 		return true
 	}
 	if occupancy > key/2 {
@@ -135,7 +178,7 @@ func (tbl *table) maybeExtend(key int) bool {
 		k := key
 		n := 0
 		for ; o > k/2; k++ {
-			if tbl.hash[int64(k)] != nil {
+			if tbl.getHash(int64(k)) != nil {
 				o++
 				n++
 			}
@@ -161,30 +204,39 @@ func (tbl *table) maybeExtend(key int) bool {
 // Internal helper
 func (tbl *table) setInt(k int, v value) {
 	// Store the value or clear the key.
-	hash := false
-	k2 := k - TableIndexOffset
-	if k2 >= 0 && k2 < len(tbl.array) {
-		tbl.array[k2] = v
-	} else if k2 >= 0 && v != nil && tbl.maybeExtend(k2) {
-		tbl.array[k2] = v
+	k2 := k - tbl.l.indexBase
+	if tbl.weakV {
+		// Tables with weak values only use the hash part.
+		if v == nil {
+			tbl.delHash(int64(k))
+		} else {
+			tbl.setHash(int64(k), v)
+		}
+	} else if k2 >= 0 && k2 < len(tbl.array) {
+		tbl.setArray(k2, tv(v))
 	} else if v == nil {
-		hash = true
-		delete(tbl.hash, int64(k))
+		tbl.delHash(int64(k))
+	} else if _, ok := tbl.hash[int64(k)]; ok {
+		// Existing keys are never moved to the array part, as that could mess up a traversal.
+		tbl.setHash(int64(k), v)
+	} else if k2 >= 0 && tbl.maybeExtend(k2) {
+		tbl.setArray(k2, tv(v))
 	} else {
-		hash = true
-		tbl.hash[int64(k)] = v
+		tbl.setHash(int64(k), v)
 	}
+}
 
-	// Decide if the stored length was invalidated and fix it if possible.
-
-	// No need to do anything if the value was stored/removed from the hash part.
-	// We don't need to worry about values added to the hash when the array portion is full, as this is impossible.
-	if hash {
-		return
-	}
+// setArray stores v at index k2 (from 0) of the array part, then decides if the stored length was invalidated and
+// fixes it if possible.
+//
+// No need to do anything with the length if the value was stored/removed from the hash part, so setInt only calls
+// this for the array part. We don't need to worry about values added to the hash when the array portion is full,
+// as this is impossible.
+func (tbl *table) setArray(k2 int, v tvalue) {
+	tbl.array[k2] = v
 
 	// If we removed a key, check to see if it is inside the old sequence, then shorten the sequence as needed.
-	if v == nil {
+	if v.isNil() {
 		if k2 < tbl.length {
 			// All items before the one we just removed are known valid.
 			tbl.length = k2
@@ -214,23 +266,20 @@ func (tbl *table) Exists(k value) bool {
 		if i := int(idx); float64(i) == idx {
 			return tbl.existsInt(i)
 		}
-		v, ok := tbl.hash[k]
-		return ok && v != nil
+		return tbl.getHash(k) != nil
 	case int64:
 		return tbl.existsInt(int(idx))
 	default:
-		v, ok := tbl.hash[k]
-		return ok && v != nil
+		return tbl.getHash(k) != nil
 	}
 }
 
 func (tbl *table) existsInt(k int) bool {
-	k2 := k - TableIndexOffset
+	k2 := k - tbl.l.indexBase
 	if 0 <= k2 && k2 < len(tbl.array) {
-		return tbl.array[k2] != nil
+		return !tbl.array[k2].isNil()
 	}
-	v, ok := tbl.hash[int64(k)]
-	return ok && v != nil
+	return tbl.getHash(int64(k)) != nil
 }
 
 // SetRaw sets a key k in the table to the value v without using any meta methods.
@@ -246,28 +295,107 @@ func (tbl *table) SetRaw(k, v value) {
 		if i := int(idx); float64(i) == idx {
 			tbl.setInt(i, v)
 		} else if v == nil {
-			delete(tbl.hash, k)
+			tbl.delHash(k)
 		} else {
-			tbl.hash[k] = v
+			tbl.setHash(k, v)
 		}
 	case int64:
 		tbl.setInt(int(idx), v)
 	default:
 		if v == nil {
-			delete(tbl.hash, k)
+			tbl.delHash(k)
 		} else {
-			tbl.hash[k] = v
+			tbl.setHash(k, v)
+		}
+	}
+}
+
+// Internal helper, v must not be nil.
+func (tbl *table) setHash(k, v value) {
+	if tbl.weakK || tbl.weakV {
+		k, v = tbl.hashKey(k), tbl.hashVal(v)
+	}
+
+	if i, ok := tbl.hash[k]; ok {
+		if tbl.hvals[i] == nil {
+			tbl.dead--
+		}
+		tbl.hvals[i] = v
+		return
+	}
+
+	tbl.l.TrackMemory(memHashEntry)
+
+	// Clear out dead entries in weak tables every so often.
+	if tbl.weakK || tbl.weakV {
+		tbl.added++
+		if tbl.added > len(tbl.hkeys) {
+			tbl.sweep()
+		}
+	}
+
+	// Adding a key during a traversal is not allowed, so this is a good time to get rid of tombstones.
+	if tbl.dead > 0 && tbl.dead >= len(tbl.hkeys)/2 {
+		tbl.compact()
+	}
+
+	tbl.addHash(k, v)
+}
+
+// addHash adds a new entry to the hash part. k must not already exist, and both k and v must already be converted
+// to weak references if needed.
+func (tbl *table) addHash(k, v value) {
+	tbl.hash[k] = len(tbl.hkeys)
+	tbl.hkeys = append(tbl.hkeys, k)
+	tbl.hvals = append(tbl.hvals, v)
+}
+
+// Internal helper
+func (tbl *table) getHash(k value) value {
+	if tbl.weakK || tbl.weakV {
+		k = tbl.hashKey(k)
+	}
+
+	if i, ok := tbl.hash[k]; ok {
+		return strong(tbl.hvals[i])
+	}
+	return nil
+}
+
+// Internal helper, clears a key from the hash part (leaving a tombstone).
+func (tbl *table) delHash(k value) {
+	if tbl.weakK || tbl.weakV {
+		k = tbl.hashKey(k)
+	}
+
+	if i, ok := tbl.hash[k]; ok && tbl.hvals[i] != nil {
+		tbl.hvals[i] = nil
+		tbl.dead++
+	}
+}
+
+// compact removes all tombstones from the hash part.
+func (tbl *table) compact() {
+	keys, vals := tbl.hkeys, tbl.hvals
+	tbl.hash = make(map[value]int, len(keys)-tbl.dead)
+	tbl.hkeys = make([]value, 0, len(keys)-tbl.dead)
+	tbl.hvals = make([]value, 0, len(keys)-tbl.dead)
+	tbl.dead = 0
+
+	for i, k := range keys {
+		if vals[i] != nil {
+			tbl.addHash(k, vals[i])
 		}
 	}
 }
 
 // Internal helper
 func (tbl *table) getInt(k int) value {
-	k2 := k - TableIndexOffset
+	k2 := k - tbl.l.indexBase
 	if 0 <= k2 && k2 < len(tbl.array) {
-		return tbl.array[k2]
+		return tbl.array[k2].value()
 	}
-	return tbl.hash[int64(k)]
+	return tbl.getHash(int64(k))
 }
 
 // GetRaw reads the value at index k from the table without using any meta methods.
@@ -287,7 +415,7 @@ func (tbl *table) GetRaw(k value) value {
 		return tbl.getInt(int(idx))
 	}
 	// Non-number or non-integral float.
-	return tbl.hash[k]
+	return tbl.getHash(k)
 }
 
 // length returns the raw table length as would be returned by the length operator.
@@ -321,6 +449,15 @@ func (tbl *table) GetRaw(k value) value {
 // where there are no nil (aka missing) values between them. Technically the spec makes it sound like ANY holes
 // in the array should keep it from being a sequence AT ALL, but this seems like overkill and too hard to implement.
 func (tbl *table) Length() int {
+	// Tables with weak values keep everything in the hash part, and values may disappear at any time.
+	if tbl.weakV {
+		length := 0
+		for tbl.getInt(length+tbl.l.indexBase) != nil {
+			length++
+		}
+		return length
+	}
+
 	// If possible use the stored length.
 	if tbl.length >= 0 {
 		return tbl.length
@@ -331,7 +468,7 @@ func (tbl *table) Length() int {
 	// (adding an item to the end of a non-sparse array will always extend it).
 	length := 0
 	for _, v := range tbl.array {
-		if v == nil {
+		if v.isNil() {
 			break
 		}
 		length++
@@ -341,123 +478,81 @@ func (tbl *table) Length() int {
 }
 
 // Next allows you to iterate over all keys in a table.
-// This function is NOT reentrant! You cannot iterate over a table while another iteration (of the same table) is
-// ongoing, trying to do so will mess up the iteration order causing some keys to not be visited or to be visited twice.
-// To start (or restart) an iteration pass nil as the key, subsequent passes should pass the key
-// gotten from the previous call. Once there are no more items this function returns nil for both key and value.
-// Passing in a key that does not exist will also make this return nil, nil.
+// To start an iteration pass nil as the key, subsequent passes should pass the key gotten from the previous call.
+// Once there are no more items this function returns nil for both key and value. Passing in a key that is not in
+// the table raises an error.
+//
+// Next does not keep any iteration state, so any number of traversals of the same table may be in progress at
+// once. Like with the reference implementation you may clear fields during a traversal, but adding new keys is not
+// allowed (if you do some keys may be skipped or visited twice).
+//
+// The array part is visited first (in order), then the hash part (in the order keys were added).
 func (tbl *table) Next(key value) (value, value) {
-	if key == nil || tbl.ikeys == nil {
-		tbl.ikeys = make(map[value]int, len(tbl.hash))
-		tbl.iorder = make([]value, 0, len(tbl.hash))
-		var last value
-		for i := range tbl.hash {
-			last = i
-			tbl.iorder = append(tbl.iorder, i)
-			tbl.ikeys[i] = len(tbl.iorder)
+	// Find out where to start looking. Indexes past the end of the array refer to the hash part.
+	start := 0
+	if key != nil {
+		// Integral floats are stored as integers, same as with GetRaw.
+		if f, ok := key.(float64); ok {
+			if i := int64(f); float64(i) == f {
+				key = i
+			}
 		}
-		if last != nil {
-			tbl.ikeys[last] = -1
+
+		k2 := -1
+		if idx, ok := key.(int64); ok {
+			k2 = int(idx) - tbl.l.indexBase
 		}
-	}
 
-	// Try the key as a hash index.
-	// We need a loop here to handle the case where a key was removed while iterating.
-	idx, ok := 0, true
-	if key != nil {
-		idx, ok = tbl.ikeys[key]
-	}
-	for ok && idx >= 0 && idx < len(tbl.iorder) {
-		k := tbl.iorder[idx]
-		v := tbl.hash[k]
-		if v == nil {
-			idx, ok = tbl.ikeys[k]
-			continue
+		if k2 >= 0 && k2 < len(tbl.array) {
+			start = k2 + 1
+		} else {
+			i, ok := tbl.hash[tbl.hashKey(key)]
+			if !ok {
+				luautil.Raise("invalid key to 'next'", luautil.ErrTypGenRuntime)
+			}
+			start = len(tbl.array) + i + 1
 		}
-		return k, v
-	}
-	if idx == -1 || key == nil {
-		key = int64(0)
 	}
 
-	// Not in hash or all hash keys used, try to use the key as an array index.
-	i, ok := tryInt(key)
-	if ok {
-		// Find the next valid key after i
-		i++
-		for i <= int64(len(tbl.array)) {
-			v := tbl.array[i-int64(TableIndexOffset)]
-			if v != nil {
-				return i, v
-			}
-			i++
+	for i := start; i < len(tbl.array); i++ {
+		if v := tbl.array[i]; !v.isNil() {
+			return int64(i + tbl.l.indexBase), v.value()
 		}
 	}
 
-	// Key did not exist when iteration started or is the last key.
-	tbl.ikeys = nil
-	tbl.iorder = nil
+	start -= len(tbl.array)
+	if start < 0 {
+		start = 0
+	}
+	for i := start; i < len(tbl.hkeys); i++ {
+		k, v := strong(tbl.hkeys[i]), strong(tbl.hvals[i])
+		if k != nil && v != nil {
+			return k, v
+		}
+	}
 	return nil, nil
 }
 
-// The real table iterator
-// This one is reentrant.
+// tableIter is a table iterator for use with GetIter. It simply keeps track of the last key returned by Next.
 type tableIter struct {
-	kill   chan bool
-	result chan []value
-
 	data *table
+	key  value
+	done bool
 }
 
 func newTableIter(d *table) *tableIter {
-	kill := make(chan bool)
-	result := make(chan []value)
-
-	i := &tableIter{
-		kill:   kill,
-		result: result,
-		data:   d,
-	}
-
-	// So long as this function contains no references to i it will die when i is finalized (references here
-	// will keep i from ever being finalized unless you visit every key).
-	// d is not a problem, as i will always be collected first.
-	go func() {
-		for k, v := range d.array {
-			if v == nil {
-				continue
-			}
-
-			select {
-			case <-kill:
-				close(result) // Just in case...
-				return
-			case result <- []value{k + TableIndexOffset, v}:
-			}
-		}
-
-		for k, v := range d.hash {
-			select {
-			case <-kill:
-				close(result) // Just in case...
-				return
-			case result <- []value{k, v}:
-			}
-		}
-		close(result) // Needed so Next will not block after the last key is visited.
-	}()
-
-	runtime.SetFinalizer(i, func(i *tableIter) {
-		i.kill <- true
-	})
-
-	return i
+	return &tableIter{data: d}
 }
 
 func (i *tableIter) Next() (value, value) {
-	k, ok := <-i.result
-	if !ok {
+	if i.done {
 		return nil, nil
 	}
-	return k[0], k[1]
+
+	k, v := i.data.Next(i.key)
+	if k == nil {
+		i.done = true
+	}
+	i.key = k
+	return k, v
 }
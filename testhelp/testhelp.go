@@ -32,14 +32,27 @@ import "github.com/milochristiansen/lua/lmodpackage"
 import "github.com/milochristiansen/lua/lmodstring"
 import "github.com/milochristiansen/lua/lmodtable"
 import "github.com/milochristiansen/lua/lmodmath"
+import "github.com/milochristiansen/lua/lmodcoroutine"
 
 // MkState creates a basic script state and populates it with most of the Lua standard library.
 // The custom "string" module extensions are not installed.
 func MkState() *lua.State {
+	return MkStateBase(1)
+}
+
+// MkStateBase is MkState for a State with the given table index base.
+func MkStateBase(base int) *lua.State {
 	l := lua.NewState()
+	l.SetIndexBase(base)
 
 	//l.NativeTrace = true
 
+	OpenLibs(l)
+	return l
+}
+
+// OpenLibs populates an existing State with the same parts of the standard library MkState uses.
+func OpenLibs(l *lua.State) {
 	// Don't include the string extensions.
 	l.Push("_NO_STRING_EXTS")
 	l.Push(true)
@@ -56,8 +69,8 @@ func MkState() *lua.State {
 	l.Call(0, 0)
 	l.Push(lmodmath.Open)
 	l.Call(0, 0)
-
-	return l
+	l.Push(lmodcoroutine.Open)
+	l.Call(0, 0)
 }
 
 // AssertBlock runs a block of Lua code. The test fails if there is an error or if "v"
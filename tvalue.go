@@ -0,0 +1,186 @@
+/*
+Copyright 2016-2017 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua
+
+import "math"
+
+// tvalue is a tagged value, used where values are stored in bulk: stack slots, function constants, the array part
+// of tables, and closed upvalues. Storing a number in a plain value (an interface) boxes it, and boxing allocates
+// for most numbers. Scripts do lots of math, so this used to be where most of the VM's garbage came from.
+//
+// Numbers and bools are stored directly in n, everything else (strings, tables, functions, userdata, threads) is
+// stored in ref. The zero tvalue is nil.
+type tvalue struct {
+	tag tvalueTag
+	n   uint64 // The bits of an int64 or a float64, or 1 for true.
+	ref value
+}
+
+type tvalueTag uint8
+
+const (
+	tagNil tvalueTag = iota
+	tagBool
+	tagInt
+	tagFloat
+	tagRef
+)
+
+// tv converts a value to a tvalue. This never allocates.
+func tv(v value) tvalue {
+	switch v2 := v.(type) {
+	case nil:
+		return tvalue{}
+	case int64:
+		return tvInt(v2)
+	case float64:
+		return tvFloat(v2)
+	case bool:
+		return tvBool(v2)
+	default:
+		return tvalue{tag: tagRef, ref: v}
+	}
+}
+
+func tvInt(i int64) tvalue {
+	return tvalue{tag: tagInt, n: uint64(i)}
+}
+
+func tvFloat(f float64) tvalue {
+	return tvalue{tag: tagFloat, n: math.Float64bits(f)}
+}
+
+func tvBool(b bool) tvalue {
+	if b {
+		return tvalue{tag: tagBool, n: 1}
+	}
+	return tvalue{tag: tagBool}
+}
+
+// value converts a tvalue back to a plain value. This allocates for most numbers, so the VM tries to avoid it in
+// common code paths.
+func (v tvalue) value() value {
+	switch v.tag {
+	case tagNil:
+		return nil
+	case tagBool:
+		return v.n != 0
+	case tagInt:
+		return int64(v.n)
+	case tagFloat:
+		return math.Float64frombits(v.n)
+	default:
+		return v.ref
+	}
+}
+
+func (v tvalue) isNil() bool {
+	return v.tag == tagNil
+}
+
+// int returns the integer stored in v, v must be tagged as an integer.
+func (v tvalue) int() int64 {
+	return int64(v.n)
+}
+
+// float returns the float stored in v, v must be tagged as a float.
+func (v tvalue) float() float64 {
+	return math.Float64frombits(v.n)
+}
+
+func (v tvalue) typeOf() TypeID {
+	switch v.tag {
+	case tagNil:
+		return TypNil
+	case tagBool:
+		return TypBool
+	case tagInt, tagFloat:
+		return TypNumber
+	default:
+		return typeOf(v.ref)
+	}
+}
+
+// truthy is toBool for tvalues.
+func (v tvalue) truthy() bool {
+	switch v.tag {
+	case tagNil:
+		return false
+	case tagBool:
+		return v.n != 0
+	default:
+		return true
+	}
+}
+
+// tryFloat is tryFloat for tvalues.
+func (v tvalue) tryFloat() (float64, bool) {
+	switch v.tag {
+	case tagInt:
+		return float64(int64(v.n)), true
+	case tagFloat:
+		return v.float(), true
+	case tagRef:
+		return tryFloat(v.ref)
+	default:
+		return 0, false
+	}
+}
+
+// tryInt is tryInt for tvalues.
+func (v tvalue) tryInt() (int64, bool) {
+	switch v.tag {
+	case tagInt:
+		return int64(v.n), true
+	case tagFloat:
+		return tryInt(v.float())
+	case tagRef:
+		return tryInt(v.ref)
+	default:
+		return 0, false
+	}
+}
+
+// toInt is toInt for tvalues.
+func (v tvalue) toInt() int64 {
+	switch v.tag {
+	case tagInt:
+		return int64(v.n)
+	case tagFloat, tagRef:
+		return toInt(v.value())
+	default:
+		return 0
+	}
+}
+
+// toFloat is toFloat for tvalues.
+func (v tvalue) toFloat() float64 {
+	switch v.tag {
+	case tagInt:
+		return float64(int64(v.n))
+	case tagFloat:
+		return v.float()
+	default:
+		return toFloat(v.value())
+	}
+}
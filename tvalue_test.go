@@ -0,0 +1,74 @@
+/*
+Copyright 2016-2017 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua
+
+import "testing"
+import "math"
+import "strings"
+
+// Make sure every kind of value survives a trip through a tvalue.
+func TestTValue(t *testing.T) {
+	l := NewState()
+	tbl := newTable(l, 0, 0)
+
+	for _, v := range []value{nil, true, false, int64(0), int64(-5), int64(math.MaxInt64), 0.0, -2.5, math.Inf(-1), "", "x", tbl} {
+		tval := tv(v)
+		assertf(t, tval.value() == v, "%#v did not survive conversion: %#v\n", v, tval.value())
+		assertf(t, tval.typeOf() == typeOf(v), "Type of %#v changed: %v\n", v, tval.typeOf())
+		assertf(t, tval.truthy() == toBool(v), "Truth of %#v changed\n", v)
+	}
+
+	nan := tv(math.NaN()).value().(float64)
+	assert(t, math.IsNaN(nan), "NaN did not survive conversion")
+
+	// Zero and negative zero are different values, but they are still equal.
+	assert(t, tv(0.0) != tv(math.Copysign(0, -1)), "0.0 and -0.0 have the same representation")
+	assert(t, l.compareT(OpEqual, tv(0.0), tv(math.Copysign(0, -1)), true), "0.0 ~= -0.0")
+}
+
+// Numbers are stored in tvalues so they don't need to be boxed. Arithmetic and array accesses should not need to
+// allocate anything, so the amount of garbage a loop makes should not depend on how many times it runs.
+func TestNumbersDoNotAllocate(t *testing.T) {
+	l := NewState()
+	err := l.LoadText(strings.NewReader(`
+local t = {0, 0, 0, 0}
+local x, y = 0, 0.5
+for i = 1, 1000 do
+	x = (x + i * 3) % 1000003 // 1
+	y = y * 1.0001 + i / 7 - x
+	t[i % 4 + 1] = t[i % 4 + 1] + y
+end
+`), "test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allocs := testing.AllocsPerRun(10, func() {
+		l.PushIndex(-1)
+		err := l.PCall(0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	assertf(t, allocs < 100, "Running a 1000 iteration loop made %v allocations\n", allocs)
+}
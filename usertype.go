@@ -0,0 +1,125 @@
+/*
+Copyright 2016-2017 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua
+
+import "reflect"
+
+import "github.com/milochristiansen/lua/luautil"
+
+// Typed userdata support.
+//
+// Any Go value that Push does not know how to convert becomes a userdata value. Normally such values don't
+// have a metatable, but if the value's Go type was registered with RegisterType Push automatically gives it the
+// metatable made for that type. This is the equivalent of luaL_newmetatable and friends, except the Go type is
+// used to find the metatable instead of the metatable being used to identify the type.
+
+// userType is a Go type registered with RegisterType.
+type userType struct {
+	name string
+	meta *table
+}
+
+// RegisterType creates a metatable for the Go type T and stores it in the registry under the given name.
+// From then on any T passed to Push gets this metatable. T should be a concrete type, values are matched
+// by their exact dynamic type.
+//
+// Functions in methods whose names start with "__" are stored directly in the metatable (so you can set meta
+// methods like __tostring or __eq), everything else goes in a table that is used as the metatable's __index
+// (unless methods has an __index entry of its own). The metatable's __name field is set to name, this is used
+// in error messages about values of this type.
+//
+// Registering a name or type that was already registered will raise an error.
+func RegisterType[T any](l *State, name string, methods map[string]NativeFunction) {
+	typ := reflect.TypeFor[T]()
+	if _, ok := l.userTypes[typ]; ok {
+		luautil.Raise("Type "+typ.String()+" is already registered.", luautil.ErrTypGenRuntime)
+	}
+	if l.registry.GetRaw(name) != nil {
+		luautil.Raise("Registry key \""+name+"\" is already in use.", luautil.ErrTypGenRuntime)
+	}
+
+	meta := newTable(l, 0, 4)
+	var index *table
+	for k, f := range methods {
+		fn := l.nativeFunc(f)
+		if len(k) > 2 && k[:2] == "__" {
+			meta.SetRaw(k, fn)
+			continue
+		}
+		if index == nil {
+			index = newTable(l, 0, len(methods))
+		}
+		index.SetRaw(k, fn)
+	}
+	if index != nil && meta.GetRaw("__index") == nil {
+		meta.SetRaw("__index", index)
+	}
+	meta.SetRaw("__name", name)
+
+	if l.userTypes == nil {
+		l.userTypes = map[reflect.Type]*userType{}
+	}
+	l.userTypes[typ] = &userType{name: name, meta: meta}
+	l.registry.SetRaw(name, meta)
+}
+
+// CheckUser returns the value of the n'th argument of the running native function as a T. If the argument is not a
+// userdata value holding a T this raises an error like:
+//
+//	bad argument #1 to 'f' (Vec3 expected, got string)
+//
+// The expected type name is the name T was registered with, or the Go name of T if it was never registered.
+func CheckUser[T any](l *State, n int) T {
+	v, ok := TestUser[T](l, n)
+	if !ok {
+		name := reflect.TypeFor[T]().String()
+		if ut, ok := l.userTypes[reflect.TypeFor[T]()]; ok {
+			name = ut.name
+		}
+		l.typeError(n, name)
+	}
+	return v
+}
+
+// TestUser is like CheckUser, except it returns false instead of raising an error if the value at the given index
+// is not a userdata value holding a T.
+func TestUser[T any](l *State, i int) (T, bool) {
+	if ud, ok := l.get(i).(*userData); ok {
+		v, ok := ud.data.(T)
+		return v, ok
+	}
+	var zero T
+	return zero, false
+}
+
+// newUserData wraps a Go value in a userdata value, setting its metatable if the value's type was registered.
+func (l *State) newUserData(v interface{}) *userData {
+	ud := &userData{data: v}
+	if l.userTypes != nil {
+		if ut, ok := l.userTypes[reflect.TypeOf(v)]; ok {
+			ud.meta = ut.meta
+			l.markForFinalize(ud, ut.meta)
+		}
+	}
+	return ud
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2016-2017 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua_test
+
+import "testing"
+import "fmt"
+import "math"
+
+import "github.com/milochristiansen/lua"
+import "github.com/milochristiansen/lua/testhelp"
+
+type vec3 struct {
+	X, Y, Z float64
+}
+
+func TestUserTypes(t *testing.T) {
+	l := testhelp.MkState()
+
+	lua.RegisterType[*vec3](l, "Vec3", map[string]lua.NativeFunction{
+		"len": func(l *lua.State) int {
+			v := lua.CheckUser[*vec3](l, 1)
+			l.Push(math.Sqrt(v.X*v.X + v.Y*v.Y + v.Z*v.Z))
+			return 1
+		},
+		"__add": func(l *lua.State) int {
+			a, b := lua.CheckUser[*vec3](l, 1), lua.CheckUser[*vec3](l, 2)
+			l.Push(&vec3{a.X + b.X, a.Y + b.Y, a.Z + b.Z})
+			return 1
+		},
+		"__tostring": func(l *lua.State) int {
+			v := lua.CheckUser[*vec3](l, 1)
+			l.Push(fmt.Sprintf("(%v, %v, %v)", v.X, v.Y, v.Z))
+			return 1
+		},
+	})
+	l.Push(func(l *lua.State) int {
+		l.Push(&vec3{l.ToFloat(1), l.ToFloat(2), l.ToFloat(3)})
+		return 1
+	})
+	l.SetGlobal("vec3")
+
+	testhelp.AssertBlock(t, l, `
+		local a, b = vec3(1, 2, 2), vec3(0, 1, 0)
+		assert(a:len() == 3)
+		assert(tostring(a + b) == "(1, 3, 2)")
+		assert(getmetatable(a) == getmetatable(b) and getmetatable(a).__name == "Vec3")
+
+		local len = getmetatable(a).__index.len
+		local ok, err = pcall(len, "x")
+		assert(not ok and err == "bad argument #1 to '?' (Vec3 expected, got string)", err)
+		ok, err = pcall(function() len() end)
+		assert(not ok and err == "bad argument #1 to 'len' (Vec3 expected, got no value)", err)
+		ok, err = pcall(function() return a + 1 end)
+		assert(not ok and err:find("bad argument #2 to '__add' (Vec3 expected, got number)", nil, true), err)
+
+		local t = setmetatable({}, {__index = {len = len}, __name = "Thing"})
+		ok, err = pcall(function() t:len() end)
+		assert(not ok and err == "calling 'len' on bad self (Vec3 expected, got Thing)", err)
+		return true
+	`, true)
+
+	l.Push("Vec3")
+	l.GetTableRaw(lua.RegistryIndex)
+	testhelp.Assertf(t, l.TypeOf(-1) == lua.TypTable, "Metatable not in registry.")
+	l.Pop(1)
+
+	err := l.Protect(func() {
+		lua.RegisterType[*vec3](l, "Vec3Again", nil)
+	})
+	testhelp.Assertf(t, err != nil, "Registering a type twice was allowed.")
+
+	// Unregistered types have no metatable, and use their Go name.
+	l.Push(vec3{})
+	testhelp.Assertf(t, !l.GetMetaTable(-1), "Unregistered type has a metatable.")
+	_, ok := lua.TestUser[*vec3](l, -1)
+	testhelp.Assertf(t, !ok, "TestUser matched the wrong type.")
+	v, ok := lua.TestUser[vec3](l, -1)
+	testhelp.Assertf(t, ok && v == vec3{}, "TestUser failed.")
+}
@@ -24,6 +24,7 @@ package lua
 
 import "math"
 import "fmt"
+import "strings"
 
 import "github.com/milochristiansen/lua/luautil"
 
@@ -38,6 +39,7 @@ const (
 	TypTable
 	TypFunction
 	TypUserData
+	TypThread
 
 	typeCount int = iota
 )
@@ -48,7 +50,7 @@ const (
 	STypFloat
 )
 
-var typeNames = [...]string{"nil", "number", "string", "boolean", "table", "function", "userdata"}
+var typeNames = [...]string{"nil", "number", "string", "boolean", "table", "function", "userdata", "thread"}
 
 func (typ TypeID) String() string {
 	return typeNames[typ]
@@ -69,6 +71,8 @@ type value interface{}
 type userData struct {
 	meta *table
 	data interface{}
+
+	finalize bool // Has this value been marked for finalization? See gc.go
 }
 
 // Utility functions
@@ -91,6 +95,8 @@ func typeOf(v value) TypeID {
 		return TypFunction
 	case *userData:
 		return TypUserData
+	case *State:
+		return TypThread
 	default:
 		return TypUserData // Should be an error?
 	}
@@ -114,6 +120,8 @@ func sTypeOf(v value) STypeID {
 		return STypNone
 	case *userData:
 		return STypNone
+	case *State:
+		return STypNone
 	default:
 		return STypNone // Should be an error?
 	}
@@ -137,6 +145,8 @@ func (l *State) getMetaTable(v value) *table {
 		return l.metaTbls[TypFunction]
 	case *userData:
 		return v2.meta
+	case *State:
+		return l.metaTbls[TypThread]
 	default:
 		luautil.Raise("Invalid type passed to getMetaTable.", luautil.ErrTypMajorInternal)
 		panic("UNREACHABLE")
@@ -174,12 +184,80 @@ func toStringConcat(v value) string {
 	case *userData:
 		luautil.Raise("Attempt to concatenate a userdata value.", luautil.ErrTypGenRuntime)
 		panic("UNREACHABLE")
+	case *State:
+		luautil.Raise("Attempt to concatenate a thread value.", luautil.ErrTypGenRuntime)
+		panic("UNREACHABLE")
 	default:
 		luautil.Raise("Invalid type passed to toStringConcat.", luautil.ErrTypMajorInternal)
 		panic("UNREACHABLE")
 	}
 }
 
+// concat joins vals the way the reference implementation does: the values are handled in pairs from right to
+// left, and any pair with a value that is not a string or number is handed to a __concat meta method. Runs of
+// strings and numbers are joined in one step. The contents of vals are overwritten.
+func (l *State) concat(vals []value) value {
+	top := len(vals)
+	if top == 0 {
+		return ""
+	}
+
+	for top > 1 {
+		v1, v2 := vals[top-2], vals[top-1]
+		if !concatable(v1) || !concatable(v2) {
+			vals[top-2] = l.concatMeta(v1, v2)
+			top--
+			continue
+		}
+
+		n := 2
+		for n < top && concatable(vals[top-n-1]) {
+			n++
+		}
+
+		strs := make([]string, n)
+		size := 0
+		for k := range strs {
+			strs[k] = toStringConcat(vals[top-n+k])
+			size += len(strs[k])
+		}
+		l.TrackMemory(int64(size))
+		vals[top-n] = strings.Join(strs, "")
+		top -= n - 1
+	}
+	return vals[0]
+}
+
+// concatMeta concatenates two values using a __concat meta method from either one.
+func (l *State) concatMeta(v1, v2 value) value {
+	meth := l.hasMetaMethod(v1, "__concat")
+	if meth == nil {
+		meth = l.hasMetaMethod(v2, "__concat")
+		if meth == nil {
+			toStringConcat(v1) // For the error message
+			toStringConcat(v2)
+			panic("UNREACHABLE")
+		}
+	}
+
+	l.Push(meth)
+	l.Push(v1)
+	l.Push(v2)
+	l.Call(2, 1)
+	rtn := l.stack.Get(-1)
+	l.Pop(1)
+	return rtn
+}
+
+// concatable returns true if the value is a string or number.
+func concatable(v value) bool {
+	switch v.(type) {
+	case string, int64, float64:
+		return true
+	}
+	return false
+}
+
 func toString(v value) string {
 	switch v2 := v.(type) {
 	case nil:
@@ -201,6 +279,8 @@ func toString(v value) string {
 		return fmt.Sprintf("function %p", v2)
 	case *userData:
 		return fmt.Sprintf("userdata %p", v2)
+	case *State:
+		return fmt.Sprintf("thread %p", v2)
 	default:
 		return fmt.Sprintf("unknown %p", v2)
 	}
@@ -297,36 +377,44 @@ func tryInt(v value) (int64, bool) {
 	}
 }
 
-func (l *State) getTable(t, k value) value {
-	tbl, ok := t.(*table)
-	if ok && tbl.Exists(k) {
-		return tbl.GetRaw(k)
-	}
+// maxIndexChain is the maximum number of tables getTable will follow through __index meta methods before it
+// decides there must be a loop.
+const maxIndexChain = 2000
 
-	meth := l.hasMetaMethod(t, "__index")
-	if meth != nil {
-		if tbl, ok := meth.(*table); ok {
-			return l.getTable(tbl, k)
+func (l *State) getTable(t, k value) value {
+	for i := 0; i < maxIndexChain; i++ {
+		tbl, ok := t.(*table)
+		if ok && tbl.Exists(k) {
+			return tbl.GetRaw(k)
 		}
 
-		f, ok := meth.(*function)
-		if !ok {
-			luautil.Raise("Meta method __index is not a table or function.", luautil.ErrTypGenRuntime)
-		}
+		meth := l.hasMetaMethod(t, "__index")
+		if meth != nil {
+			if tbl, ok := meth.(*table); ok {
+				t = tbl
+				continue
+			}
 
-		l.Push(f)
-		l.Push(t)
-		l.Push(k)
-		l.Call(2, 1)
-		rtn := l.stack.Get(-1)
-		l.Pop(1)
-		return rtn
-	}
+			f, ok := meth.(*function)
+			if !ok {
+				luautil.Raise("Meta method __index is not a table or function.", luautil.ErrTypGenRuntime)
+			}
 
-	if ok {
-		return tbl.GetRaw(k)
+			l.Push(f)
+			l.Push(t)
+			l.Push(k)
+			l.Call(2, 1)
+			rtn := l.stack.Get(-1)
+			l.Pop(1)
+			return rtn
+		}
+
+		if ok {
+			return tbl.GetRaw(k)
+		}
+		luautil.Raise("Value is not a table and has no __index meta method.", luautil.ErrTypGenRuntime)
 	}
-	luautil.Raise("Value is not a table and has no __index meta method.", luautil.ErrTypGenRuntime)
+	luautil.Raise("'__index' chain too long; possible loop", luautil.ErrTypGenRuntime)
 	panic("UNREACHABLE")
 }
 
@@ -364,6 +452,31 @@ func (l *State) setTable(t, k, v value) {
 	panic("UNREACHABLE")
 }
 
+// getTableT is getTable for tvalues, with a fast path for reading the array part of a table.
+func (l *State) getTableT(t, k tvalue) tvalue {
+	if tbl, ok := t.ref.(*table); ok && k.tag == tagInt {
+		k2 := k.int() - int64(l.indexBase)
+		if k2 >= 0 && k2 < int64(len(tbl.array)) {
+			if v := tbl.array[k2]; !v.isNil() || tbl.meta == nil {
+				return v
+			}
+		}
+	}
+	return tv(l.getTable(t.value(), k.value()))
+}
+
+// setTableT is setTable for tvalues, with a fast path for writing to the array part of a table.
+func (l *State) setTableT(t, k, v tvalue) {
+	if tbl, ok := t.ref.(*table); ok && k.tag == tagInt {
+		k2 := k.int() - int64(l.indexBase)
+		if k2 >= 0 && k2 < int64(len(tbl.array)) && (tbl.meta == nil || !tbl.array[k2].isNil()) {
+			tbl.setArray(int(k2), v)
+			return
+		}
+	}
+	l.setTable(t.value(), k.value(), v.value())
+}
+
 var mathMeta = [...]string{
 	"__add",
 	"__sub",
@@ -410,158 +523,281 @@ func (l *State) tryMathMeta(op opCode, a, b value) value {
 }
 
 func (l *State) arith(op opCode, a, b value) value {
+	if l.TruncatedDivision && (op == OpMod || op == OpIDiv) {
+		return l.legacyArith(op, a, b)
+	}
+
+	if v, ok := arithRaw(op, a, b); ok {
+		return v
+	}
+	return l.tryMathMeta(op, a, b)
+}
+
+// arithRaw is arith without meta methods or State.TruncatedDivision, so it does not need a State (the constant
+// folder uses it to evaluate expressions at compile time). If the operands are not numbers (or strings that can be
+// converted to numbers) false is returned.
+func arithRaw(op opCode, a, b value) (value, bool) {
 	switch op {
 	case OpAdd:
 		ia, oka := a.(int64)
 		ib, okb := b.(int64)
 		if oka && okb {
-			return ia + ib
+			return ia + ib, true
 		}
 
 		fa, oka := tryFloat(a)
 		fb, okb := tryFloat(b)
 		if oka && okb {
-			return fa + fb
+			return fa + fb, true
 		}
-
-		return l.tryMathMeta(op, a, b)
 	case OpSub:
 		ia, oka := a.(int64)
 		ib, okb := b.(int64)
 		if oka && okb {
-			return ia - ib
+			return ia - ib, true
 		}
 
 		fa, oka := tryFloat(a)
 		fb, okb := tryFloat(b)
 		if oka && okb {
-			return fa - fb
+			return fa - fb, true
 		}
-
-		return l.tryMathMeta(op, a, b)
 	case OpMul:
 		ia, oka := a.(int64)
 		ib, okb := b.(int64)
 		if oka && okb {
-			return ia * ib
+			return ia * ib, true
 		}
 
 		fa, oka := tryFloat(a)
 		fb, okb := tryFloat(b)
 		if oka && okb {
-			return fa * fb
+			return fa * fb, true
 		}
-
-		return l.tryMathMeta(op, a, b)
 	case OpMod:
 		ia, oka := a.(int64)
 		ib, okb := b.(int64)
 		if oka && okb {
-			return ia % ib
+			return modInt(ia, ib), true
 		}
 
 		fa, oka := tryFloat(a)
 		fb, okb := tryFloat(b)
 		if oka && okb {
-			return math.Mod(fa, fb)
+			return modFloat(fa, fb), true
 		}
-
-		return l.tryMathMeta(op, a, b)
 	case OpPow:
 		fa, oka := tryFloat(a)
 		fb, okb := tryFloat(b)
 		if oka && okb {
-			return math.Pow(fa, fb)
+			return math.Pow(fa, fb), true
 		}
-
-		return l.tryMathMeta(op, a, b)
 	case OpDiv:
 		fa, oka := tryFloat(a)
 		fb, okb := tryFloat(b)
 		if oka && okb {
-			return fa / fb
+			return fa / fb, true
 		}
-
-		return l.tryMathMeta(op, a, b)
 	case OpIDiv:
-		ia, oka := tryInt(a)
-		ib, okb := tryInt(b)
+		ia, oka := a.(int64)
+		ib, okb := b.(int64)
 		if oka && okb {
-			return ia / ib
+			return idivInt(ia, ib), true
 		}
 
-		return l.tryMathMeta(op, a, b)
+		fa, oka := tryFloat(a)
+		fb, okb := tryFloat(b)
+		if oka && okb {
+			return math.Floor(fa / fb), true
+		}
 	case OpBinAND:
 		ia, oka := tryInt(a)
 		ib, okb := tryInt(b)
 		if oka && okb {
-			return ia & ib
+			return ia & ib, true
 		}
-
-		return l.tryMathMeta(op, a, b)
 	case OpBinOR:
 		ia, oka := tryInt(a)
 		ib, okb := tryInt(b)
 		if oka && okb {
-			return ia | ib
+			return ia | ib, true
 		}
-
-		return l.tryMathMeta(op, a, b)
 	case OpBinXOR:
 		ia, oka := tryInt(a)
 		ib, okb := tryInt(b)
 		if oka && okb {
-			return ia ^ ib
+			return ia ^ ib, true
 		}
-
-		return l.tryMathMeta(op, a, b)
 	case OpBinShiftL:
 		ia, oka := tryInt(a)
 		ib, okb := tryInt(b)
 		if oka && okb {
-			if ib < 0 {
-				return int64(uint64(ia) >> uint64(-ib))
-			} else {
-				return int64(uint64(ia) << uint64(ib))
-			}
+			return shiftLeft(ia, ib), true
 		}
-
-		return l.tryMathMeta(op, a, b)
 	case OpBinShiftR:
 		ia, oka := tryInt(a)
 		ib, okb := tryInt(b)
 		if oka && okb {
-			if ib < 0 {
-				return int64(uint64(ia) << uint64(-ib))
-			} else {
-				return int64(uint64(ia) >> uint64(ib))
-			}
+			return shiftLeft(ia, -ib), true
 		}
-
-		return l.tryMathMeta(op, a, b)
 	case OpUMinus:
 		ia, oka := a.(int64)
 		if oka {
-			return -ia
+			return -ia, true
 		}
 
 		fa, oka := tryFloat(a)
 		if oka {
-			return -fa
+			return -fa, true
 		}
-
-		return l.tryMathMeta(op, a, b)
 	case OpBinNot:
 		ia, oka := tryInt(a)
 		if oka {
-			return ^ia
+			return ^ia, true
 		}
-
-		return l.tryMathMeta(op, a, b)
 	default:
 		luautil.Raise("Invalid opCode passed to arith", luautil.ErrTypMajorInternal)
-		panic("UNREACHABLE")
 	}
+	return nil, false
+}
+
+// modInt is integer % for Lua 5.3, the result has the same sign as the divisor.
+func modInt(a, b int64) int64 {
+	if b == 0 {
+		luautil.Raise("attempt to perform 'n%0'", luautil.ErrTypGenRuntime)
+	}
+	m := a % b
+	if m != 0 && (m^b) < 0 {
+		m += b
+	}
+	return m
+}
+
+// modFloat is float % for Lua 5.3. This is exactly what the reference implementation does, including the odd
+// results for infinite divisors (-5 % math.huge is math.huge).
+func modFloat(a, b float64) float64 {
+	m := math.Mod(a, b)
+	if m*b < 0 {
+		m += b
+	}
+	return m
+}
+
+// idivInt is integer // for Lua 5.3, rounding towards negative infinity.
+func idivInt(a, b int64) int64 {
+	if b == 0 {
+		luautil.Raise("attempt to perform 'n//0'", luautil.ErrTypGenRuntime)
+	}
+	d := a / b
+	if (a%b != 0) && ((a < 0) != (b < 0)) {
+		d--
+	}
+	return d
+}
+
+// shiftLeft is <<, negative shifts go the other way.
+func shiftLeft(a, b int64) int64 {
+	if b < 0 {
+		return int64(uint64(a) >> uint64(-b))
+	}
+	return int64(uint64(a) << uint64(b))
+}
+
+// arithT is arith for tvalues. The common cases (two numbers) are handled here without boxing anything, everything
+// else is passed on to arith.
+func (l *State) arithT(op opCode, a, b tvalue) tvalue {
+	if a.tag == tagInt && b.tag == tagInt {
+		ia, ib := a.int(), b.int()
+		switch op {
+		case OpAdd:
+			return tvInt(ia + ib)
+		case OpSub:
+			return tvInt(ia - ib)
+		case OpMul:
+			return tvInt(ia * ib)
+		case OpMod:
+			if !l.TruncatedDivision {
+				return tvInt(modInt(ia, ib))
+			}
+		case OpIDiv:
+			if !l.TruncatedDivision {
+				return tvInt(idivInt(ia, ib))
+			}
+		case OpBinAND:
+			return tvInt(ia & ib)
+		case OpBinOR:
+			return tvInt(ia | ib)
+		case OpBinXOR:
+			return tvInt(ia ^ ib)
+		case OpBinShiftL:
+			return tvInt(shiftLeft(ia, ib))
+		case OpBinShiftR:
+			return tvInt(shiftLeft(ia, -ib))
+		case OpUMinus:
+			return tvInt(-ia)
+		case OpBinNot:
+			return tvInt(^ia)
+		}
+	}
+	if (a.tag == tagInt || a.tag == tagFloat) && (b.tag == tagInt || b.tag == tagFloat) {
+		fa, _ := a.tryFloat()
+		fb, _ := b.tryFloat()
+		switch op {
+		case OpAdd:
+			return tvFloat(fa + fb)
+		case OpSub:
+			return tvFloat(fa - fb)
+		case OpMul:
+			return tvFloat(fa * fb)
+		case OpMod:
+			if !l.TruncatedDivision {
+				return tvFloat(modFloat(fa, fb))
+			}
+		case OpPow:
+			return tvFloat(math.Pow(fa, fb))
+		case OpDiv:
+			return tvFloat(fa / fb)
+		case OpIDiv:
+			if !l.TruncatedDivision {
+				return tvFloat(math.Floor(fa / fb))
+			}
+		case OpUMinus:
+			return tvFloat(-fa)
+		}
+	}
+	return tv(l.arith(op, a.value(), b.value()))
+}
+
+// legacyArith implements % and // the way older versions of this VM did, using Go's (truncating) operators.
+// See State.TruncatedDivision.
+func (l *State) legacyArith(op opCode, a, b value) value {
+	switch op {
+	case OpMod:
+		ia, oka := a.(int64)
+		ib, okb := b.(int64)
+		if oka && okb {
+			if ib == 0 {
+				luautil.Raise("attempt to perform 'n%0'", luautil.ErrTypGenRuntime)
+			}
+			return ia % ib
+		}
+
+		fa, oka := tryFloat(a)
+		fb, okb := tryFloat(b)
+		if oka && okb {
+			return math.Mod(fa, fb)
+		}
+	case OpIDiv:
+		ia, oka := tryInt(a)
+		ib, okb := tryInt(b)
+		if oka && okb {
+			if ib == 0 {
+				luautil.Raise("attempt to perform 'n//0'", luautil.ErrTypGenRuntime)
+			}
+			return ia / ib
+		}
+	}
+	return l.tryMathMeta(op, a, b)
 }
 
 var cmpMeta = [...]string{
@@ -613,99 +849,120 @@ try:
 	return rtn
 }
 
+// compareT is compare for tvalues. Like arithT it handles numbers itself and passes everything else on.
+func (l *State) compareT(op opCode, a, b tvalue, raw bool) bool {
+	if a.tag == tagInt && b.tag == tagInt {
+		switch op {
+		case OpEqual:
+			return a.n == b.n
+		case OpLessThan:
+			return a.int() < b.int()
+		case OpLessOrEqual:
+			return a.int() <= b.int()
+		}
+	} else if a.tag == tagFloat && b.tag == tagFloat {
+		switch op {
+		case OpEqual:
+			return a.float() == b.float()
+		case OpLessThan:
+			return a.float() < b.float()
+		case OpLessOrEqual:
+			return a.float() <= b.float()
+		}
+	}
+	return l.compare(op, a.value(), b.value(), raw)
+}
+
 func (l *State) compare(op opCode, a, b value, raw bool) bool {
+	if rtn, ok := compareRaw(op, a, b); ok {
+		return rtn
+	}
+
+	if raw {
+		return op == OpEqual && a == b
+	}
+	return l.tryCmpMeta(op, a, b)
+}
+
+// compareRaw is compare for values that don't need meta methods (so it does not need a State): values of different
+// types, nil, booleans, numbers, and strings. For anything else (including ordering nil or booleans, which may have
+// meta methods) ok is false.
+func compareRaw(op opCode, a, b value) (rtn, ok bool) {
 	t := typeOf(a)
 	if t != typeOf(b) {
-		return false
+		return false, true
 	}
 
 	switch op {
 	case OpEqual:
 		switch t {
 		case TypNil:
-			return true // Obviously.
+			return true, true // Obviously.
 		case TypNumber:
 			ia, oka := a.(int64)
 			ib, okb := b.(int64)
 			if oka && okb {
-				return ia == ib
+				return ia == ib, true
 			}
 
 			fa, oka := a.(float64)
 			fb, okb := b.(float64)
 			if oka && okb {
-				return fa == fb
+				return fa == fb, true
 			}
 
 			// Weird, but this is what the reference implementation does.
-			return toInt(a) == toInt(b)
+			return toInt(a) == toInt(b), true
 
 		case TypString:
-			return a.(string) == b.(string)
+			return a.(string) == b.(string), true
 		case TypBool:
-			return a.(bool) == b.(bool)
-		}
-
-		if raw {
-			return a == b
+			return a.(bool) == b.(bool), true
 		}
-		return l.tryCmpMeta(op, a, b)
-
 	case OpLessThan:
 		switch t {
 		case TypNumber:
 			ia, oka := a.(int64)
 			ib, okb := b.(int64)
 			if oka && okb {
-				return ia < ib
+				return ia < ib, true
 			}
 
 			fa, oka := a.(float64)
 			fb, okb := b.(float64)
 			if oka && okb {
-				return fa < fb
+				return fa < fb, true
 			}
 
 			// Weird, but this is what the reference implementation does.
-			return toInt(a) < toInt(b)
+			return toInt(a) < toInt(b), true
 
 		case TypString:
-			return a.(string) < b.(string) // Fix me, should be locale sensitive, not lexical
+			return a.(string) < b.(string), true // Fix me, should be locale sensitive, not lexical
 		}
-
-		if raw {
-			return false
-		}
-		return l.tryCmpMeta(op, a, b)
-
 	case OpLessOrEqual:
 		switch t {
 		case TypNumber:
 			ia, oka := a.(int64)
 			ib, okb := b.(int64)
 			if oka && okb {
-				return ia <= ib
+				return ia <= ib, true
 			}
 
 			fa, oka := a.(float64)
 			fb, okb := b.(float64)
 			if oka && okb {
-				return fa <= fb
+				return fa <= fb, true
 			}
 
 			// Weird, but this is what the reference implementation does.
-			return toInt(a) <= toInt(b)
+			return toInt(a) <= toInt(b), true
 
 		case TypString:
-			return a.(string) <= b.(string) // Fix me, should be locale sensitive, not lexical
+			return a.(string) <= b.(string), true // Fix me, should be locale sensitive, not lexical
 		}
-
-		if raw {
-			return false
-		}
-		return l.tryCmpMeta(op, a, b)
 	default:
 		luautil.Raise("Invalid comparison operator.", luautil.ErrTypGenRuntime)
-		panic("UNREACHABLE")
 	}
+	return false, false
 }
@@ -22,8 +22,6 @@ misrepresented as being the original software.
 
 package lua
 
-import "bytes"
-
 import "github.com/milochristiansen/lua/luautil"
 
 // call handles all function calls. "fi" *must* be a valid stack index!
@@ -51,7 +49,7 @@ func (l *State) call(fi, args, rtns int, tail bool) {
 			}
 			l.stack.AddFrame(f, fi, args+1, rtns)
 			l.exec()
-			l.stack.ReturnFrame()
+			l.returnFrame()
 			return
 		}
 		luautil.Raise("Value is not a function and has no __call meta method.", luautil.ErrTypGenRuntime)
@@ -64,11 +62,27 @@ func (l *State) call(fi, args, rtns int, tail bool) {
 	}
 	l.stack.AddFrame(f, fi, args, rtns)
 	l.exec()
-	l.stack.ReturnFrame()
+	l.returnFrame()
 	return
 }
 
+// returnFrame calls the return hook (if any) and then drops the current frame.
+func (l *State) returnFrame() {
+	if l.hookMask&MaskReturn != 0 {
+		l.callHook(HookReturn, -1)
+	}
+	l.stack.ReturnFrame()
+}
+
 func (l *State) exec() {
+	if l.hookMask&MaskCall != 0 {
+		if l.stack.cFrame().tailCall {
+			l.callHook(HookTailCall, -1)
+		} else {
+			l.callHook(HookCall, -1)
+		}
+	}
+
 	if l.stack.cFrame().fn.native != nil {
 		fr := l.stack.cFrame()
 		fr.retC = fr.fn.native(l)
@@ -76,7 +90,14 @@ func (l *State) exec() {
 	} else {
 		i, ok := l.stack.cFrame().nxtOp()
 		for ok {
-			//l.Printf("[%v]\t%v\n", l.stack.cFrame().pc-1, i)
+			if l.countdown <= 0 {
+				l.checkpoint()
+			}
+			l.countdown--
+			if l.hookMask&(MaskLine|MaskCount) != 0 {
+				l.traceExec()
+			}
+
 			_ = "breakpoint"                           // Next Instruction
 			if instructionTable[i.getOpCode()](l, i) { // RETURN and TAILCALL return true
 				return
@@ -113,11 +134,15 @@ func intFromFloat8(x float8) int {
 }
 
 func rk(l *State, f int) value {
+	return rkT(l, f).value()
+}
+
+// rkT is rk for code that can work with tvalues.
+func rkT(l *State, f int) tvalue {
 	if (f & bitRK) != 0 {
 		return l.stack.cFrame().fn.proto.constants[f & ^bitRK]
-	} else {
-		return l.stack.Get(f)
 	}
+	return l.stack.GetT(f)
 }
 
 var instructionTable [opCodeCount]func(l *State, i instruction) bool
@@ -126,17 +151,17 @@ func init() {
 	instructionTable = [opCodeCount]func(l *State, i instruction) bool{
 		// MOVE
 		func(l *State, i instruction) bool {
-			l.stack.Set(i.a(), l.stack.Get(i.b()))
+			l.stack.SetT(i.a(), l.stack.GetT(i.b()))
 			return false
 		},
 		// LOADK
 		func(l *State, i instruction) bool {
-			l.stack.Set(i.a(), l.stack.cFrame().fn.proto.constants[i.bx()])
+			l.stack.SetT(i.a(), l.stack.cFrame().fn.proto.constants[i.bx()])
 			return false
 		},
 		// LOADKX
 		func(l *State, i instruction) bool {
-			l.stack.Set(i.a(), l.stack.cFrame().fn.proto.constants[l.stack.cFrame().reqNxtOp(opExtraArg).ax()])
+			l.stack.SetT(i.a(), l.stack.cFrame().fn.proto.constants[l.stack.cFrame().reqNxtOp(opExtraArg).ax()])
 			return false
 		},
 		// LOADBOOL
@@ -145,7 +170,7 @@ func init() {
 				l.stack.cFrame().pc++
 			}
 
-			l.stack.Set(i.a(), i.b() != 0)
+			l.stack.SetT(i.a(), tvBool(i.b() != 0))
 			return false
 		},
 		// LOADNIL
@@ -153,14 +178,14 @@ func init() {
 			a, b := i.a(), i.b()
 
 			for k := a; k <= a+b; k++ {
-				l.stack.Set(k, nil)
+				l.stack.SetT(k, tvalue{})
 			}
 			return false
 		},
 
 		// GETUPVAL
 		func(l *State, i instruction) bool {
-			l.stack.Set(i.a(), l.stack.cFrame().getUp(i.b()))
+			l.stack.SetT(i.a(), l.stack.cFrame().getUpT(i.b()))
 			return false
 		},
 		// GETTABUP
@@ -171,8 +196,7 @@ func init() {
 		},
 		// GETTABLE
 		func(l *State, i instruction) bool {
-			tbl := l.stack.Get(i.b())
-			l.stack.Set(i.a(), l.getTable(tbl, rk(l, i.c())))
+			l.stack.SetT(i.a(), l.getTableT(l.stack.GetT(i.b()), rkT(l, i.c())))
 			return false
 		},
 
@@ -184,13 +208,12 @@ func init() {
 		},
 		// SETUPVAL
 		func(l *State, i instruction) bool {
-			l.stack.cFrame().setUp(i.b(), l.stack.Get(i.a())) // Yes, this really is the reverse of everything else...
+			l.stack.cFrame().setUpT(i.b(), l.stack.GetT(i.a())) // Yes, this really is the reverse of everything else...
 			return false
 		},
 		// SETTABLE
 		func(l *State, i instruction) bool {
-			tbl := l.stack.Get(i.a())
-			l.setTable(tbl, rk(l, i.b()), rk(l, i.c()))
+			l.setTableT(l.stack.GetT(i.a()), rkT(l, i.b()), rkT(l, i.c()))
 			return false
 		},
 
@@ -241,19 +264,19 @@ func init() {
 		opMath,
 		// UNM
 		func(l *State, i instruction) bool {
-			b := rk(l, i.b())
-			l.stack.Set(i.a(), l.arith(i.getOpCode(), b, b))
+			b := rkT(l, i.b())
+			l.stack.SetT(i.a(), l.arithT(i.getOpCode(), b, b))
 			return false
 		},
 		// BNOT
 		func(l *State, i instruction) bool {
-			b := rk(l, i.b())
-			l.stack.Set(i.a(), l.arith(i.getOpCode(), b, b))
+			b := rkT(l, i.b())
+			l.stack.SetT(i.a(), l.arithT(i.getOpCode(), b, b))
 			return false
 		},
 		// NOT
 		func(l *State, i instruction) bool {
-			l.stack.Set(i.a(), !toBool(rk(l, i.b())))
+			l.stack.SetT(i.a(), tvBool(!rkT(l, i.b()).truthy()))
 			return false
 		},
 		// LEN
@@ -261,7 +284,7 @@ func init() {
 			v := l.stack.Get(i.b())
 
 			if s, ok := v.(string); ok {
-				l.stack.Set(i.a(), int64(len(s)))
+				l.stack.SetT(i.a(), tvInt(int64(len(s))))
 				return false
 			}
 
@@ -280,59 +303,22 @@ func init() {
 			if !ok {
 				luautil.Raise("Value is not a string or table and has no __len meta method.", luautil.ErrTypGenRuntime)
 			}
-			l.stack.Set(i.a(), int64(tbl.Length()))
+			l.stack.SetT(i.a(), tvInt(int64(tbl.Length())))
 			return false
 		},
 
 		// CONCAT
 		func(l *State, i instruction) bool {
 			b, c := i.b(), i.c()
-
-			var buff *bytes.Buffer
-			concat := func(v1, v2 value) {
-				meth := l.hasMetaMethod(v1, "__concat")
-				if meth == nil {
-					meth = l.hasMetaMethod(v2, "__concat")
-					if meth == nil {
-						toStringConcat(v1) // For the error message
-						toStringConcat(v2)
-						panic("UNREACHABLE")
-					}
-				}
-
-				l.Push(meth)
-				l.Push(v1)
-				l.Push(v2)
-				l.Call(2, 1)
-				rtn := l.stack.Get(-1)
-				l.Pop(1)
-				buff = bytes.NewBufferString(toStringConcat(rtn))
-			}
-
-			k := b
-			v := l.stack.Get(k)
-			if t := typeOf(v); t == TypString || t == TypNumber {
-				buff = bytes.NewBufferString(toStringConcat(v))
-			} else {
-				k++
-				if k > c {
-					luautil.Raise("CONCAT called with a range of less than 2 registers.", luautil.ErrTypMajorInternal)
-				}
-				v2 := l.stack.Get(k)
-
-				concat(v, v2)
+			if c <= b {
+				luautil.Raise("CONCAT called with a range of less than 2 registers.", luautil.ErrTypMajorInternal)
 			}
-			k++
 
-			for ; k <= c; k++ {
-				v := l.stack.Get(k)
-				if t := typeOf(v); t == TypString || t == TypNumber {
-					buff.WriteString(toStringConcat(v))
-					continue
-				}
-				concat(buff.String(), v)
+			vals := make([]value, 0, c-b+1)
+			for k := b; k <= c; k++ {
+				vals = append(vals, l.stack.Get(k))
 			}
-			l.stack.Set(i.a(), buff.String())
+			l.stack.Set(i.a(), l.concat(vals))
 			return false
 		},
 
@@ -356,7 +342,7 @@ func init() {
 
 		// TEST
 		func(l *State, i instruction) bool {
-			if toBool(l.stack.Get(i.a())) == (i.c() == 0) {
+			if l.stack.GetT(i.a()).truthy() == (i.c() == 0) {
 				l.stack.cFrame().pc++
 			}
 			// I don't require a following JMP instruction.
@@ -364,11 +350,11 @@ func init() {
 		},
 		// TESTSET
 		func(l *State, i instruction) bool {
-			b := l.stack.Get(i.b())
-			if toBool(b) == (i.c() == 0) {
+			b := l.stack.GetT(i.b())
+			if b.truthy() == (i.c() == 0) {
 				l.stack.cFrame().pc++
 			} else {
-				l.stack.Set(i.a(), b)
+				l.stack.SetT(i.a(), b)
 				// I don't require a following JMP instruction.
 			}
 			return false
@@ -439,51 +425,60 @@ func init() {
 		// FORLOOP
 		func(l *State, i instruction) bool {
 			a := i.a()
-			step := l.stack.Get(a + 2)
-			av := l.arith(OpAdd, l.stack.Get(a), step) // Probably bad for performance...
+			step := l.stack.GetT(a + 2)
+			av := l.arithT(OpAdd, l.stack.GetT(a), step)
 
+			// FORPREP made sure all three values are numbers of the same type.
 			cmp := false
-			if toFloat(step) < 0 {
-				cmp = l.compare(OpLessOrEqual, l.stack.Get(a+1), av, true) // I should probably do a raw check here too
+			if step.tag == tagInt {
+				if step.int() < 0 {
+					cmp = l.stack.GetT(a+1).int() <= av.int()
+				} else {
+					cmp = av.int() <= l.stack.GetT(a+1).int()
+				}
 			} else {
-				cmp = l.compare(OpLessOrEqual, av, l.stack.Get(a+1), true)
+				if step.float() < 0 {
+					cmp = l.stack.GetT(a+1).float() <= av.float()
+				} else {
+					cmp = av.float() <= l.stack.GetT(a+1).float()
+				}
 			}
 			if !cmp {
 				return false
 			}
 
-			l.stack.Set(a, av)
-			l.stack.Set(a+3, av)
+			l.stack.SetT(a, av)
+			l.stack.SetT(a+3, av)
 			l.stack.cFrame().pc += int32(i.sbx())
 			return false
 		},
 		// FORPREP
 		func(l *State, i instruction) bool {
 			a := i.a()
-			init, limit, step := l.stack.Get(a), l.stack.Get(a+1), l.stack.Get(a+2)
+			init, limit, step := l.stack.GetT(a), l.stack.GetT(a+1), l.stack.GetT(a+2)
 
 			// Make sure all three values are numbers, preferably integers.
-			iinit, oka := tryInt(init)
-			ilimit, okb := tryInt(limit)
-			istep, okc := tryInt(step)
+			iinit, oka := init.tryInt()
+			ilimit, okb := limit.tryInt()
+			istep, okc := step.tryInt()
 			if oka && okb && okc {
-				l.stack.Set(a, iinit-istep)
-				l.stack.Set(a+1, ilimit)
-				l.stack.Set(a+2, istep)
+				l.stack.SetT(a, tvInt(iinit-istep))
+				l.stack.SetT(a+1, tvInt(ilimit))
+				l.stack.SetT(a+2, tvInt(istep))
 				l.stack.cFrame().pc += int32(i.sbx())
 				return false
 			}
 
-			finit, oka := tryFloat(init)
-			flimit, okb := tryFloat(limit)
-			fstep, okc := tryFloat(step)
+			finit, oka := init.tryFloat()
+			flimit, okb := limit.tryFloat()
+			fstep, okc := step.tryFloat()
 			if !(oka && okb && okc) {
 				luautil.Raise("All values passed to a numeric for loop must be numeric!", luautil.ErrTypGenRuntime)
 			}
 
-			l.stack.Set(a, finit-fstep)
-			l.stack.Set(a+1, flimit)
-			l.stack.Set(a+2, fstep)
+			l.stack.SetT(a, tvFloat(finit-fstep))
+			l.stack.SetT(a+1, tvFloat(flimit))
+			l.stack.SetT(a+2, tvFloat(fstep))
 			l.stack.cFrame().pc += int32(i.sbx())
 			return false
 		},
@@ -497,9 +492,9 @@ func init() {
 			segC, _ := l.stack.bounds(-1)
 			l.stack.data = l.stack.data[:segC+a+4]
 
-			l.stack.Push(l.stack.Get(a))
-			l.stack.Push(l.stack.Get(a + 1))
-			l.stack.Push(l.stack.Get(a + 2))
+			l.stack.PushT(l.stack.GetT(a))
+			l.stack.PushT(l.stack.GetT(a + 1))
+			l.stack.PushT(l.stack.GetT(a + 2))
 			l.Call(2, c)
 
 			// C Lua asserts that this is followed by a TFORLOOP, then jumps directly there, but why bother.
@@ -511,11 +506,12 @@ func init() {
 		// TFORLOOP
 		func(l *State, i instruction) bool {
 			a := i.a()
-			if l.stack.Get(a+1) == nil {
+			v := l.stack.GetT(a + 1)
+			if v.isNil() {
 				return false
 			}
 
-			l.stack.Set(a, l.stack.Get(a+1))
+			l.stack.SetT(a, v)
 			l.stack.cFrame().pc += int32(i.sbx())
 			return false
 		},
@@ -537,7 +533,7 @@ func init() {
 				c = l.stack.cFrame().reqNxtOp(opExtraArg).ax()
 			}
 
-			first := (c-1)*fieldsPerFlush + TableIndexOffset
+			first := (c-1)*fieldsPerFlush + l.indexBase
 			for i := 0; i < b; i++ {
 				t.SetRaw(int64(first+i), l.stack.Get(a+1+i))
 			}
@@ -553,6 +549,7 @@ func init() {
 			me := l.stack.cFrame()
 			p := me.fn.proto.prototypes[i.bx()]
 
+			l.TrackMemory(int64(memClosure + len(p.upVals)*memUpValue))
 			f := &function{
 				proto: p,
 				up:    make([]*upValue, len(p.upVals)),
@@ -581,17 +578,23 @@ func init() {
 		func(l *State, i instruction) bool {
 			a, b := i.a(), i.b()-1
 
-			argc := l.stack.cFrame().nArgs
+			// The fixed parameters are not part of the variadic arguments.
+			fr := l.stack.cFrame()
+			np := fr.fn.proto.parameterCount
+			argc := fr.nArgs - np
+			if argc < 0 {
+				argc = 0
+			}
 			if b == -1 {
 				b = argc
 			}
 
 			for k := b - 1; k >= 0; k-- {
 				if k >= argc {
-					l.stack.Set(a+k, nil)
+					l.stack.SetT(a+k, tvalue{})
 					continue
 				}
-				l.stack.Set(a+k, l.stack.GetArgs(k))
+				l.stack.SetT(a+k, l.stack.GetArgsT(np+k))
 			}
 			return false
 		},
@@ -605,7 +608,7 @@ func init() {
 }
 
 func opMath(l *State, i instruction) bool {
-	l.stack.Set(i.a(), l.arith(i.getOpCode(), rk(l, i.b()), rk(l, i.c())))
+	l.stack.SetT(i.a(), l.arithT(i.getOpCode(), rkT(l, i.b()), rkT(l, i.c())))
 	return false
 }
 
@@ -614,7 +617,7 @@ func opCmp(l *State, i instruction) bool {
 	// This adds flexibility at the (arguable) cost of performance.
 	// Lua does not use this flexibility, but I want to use this VM
 	// (with minor changes) for my own languages.
-	if !l.compare(i.getOpCode(), rk(l, i.b()), rk(l, i.c()), false) == (i.a() != 0) {
+	if !l.compareT(i.getOpCode(), rkT(l, i.b()), rkT(l, i.c()), false) == (i.a() != 0) {
 		l.stack.cFrame().pc++
 	}
 
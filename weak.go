@@ -0,0 +1,154 @@
+/*
+Copyright 2016-2017 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua
+
+import "strings"
+import "weak"
+
+// Weak table support.
+//
+// If a table's metatable has a __mode field when the metatable is set, any collectable values (tables, functions,
+// userdata, and threads) stored in the weak part(s) of the table are stored as weak references. Weak references do
+// not keep the object they point to alive, so once nothing else refers to an object Go is free to collect it.
+// Entries with a collected key or value are treated as if they don't exist, and are removed from the table now
+// and then as new keys are added.
+//
+// Weak references do not change identity, a weak reference to an object is equal to any other weak reference to
+// the same object, so they work fine as map keys.
+//
+// Tables with weak values do not use the array part, everything is stored in the hash part so that there is only
+// one place that needs to deal with weak references. Go does not support ephemerons, so a value in a table with
+// weak keys that refers to its own key will keep the key (and so the entry) alive.
+
+type weakRef[T any] struct {
+	p weak.Pointer[T]
+}
+
+// makeWeak converts collectable values to weak references. Other values are returned unchanged.
+func makeWeak(v value) value {
+	switch v2 := v.(type) {
+	case *table:
+		return weakRef[table]{weak.Make(v2)}
+	case *function:
+		return weakRef[function]{weak.Make(v2)}
+	case *userData:
+		return weakRef[userData]{weak.Make(v2)}
+	case *State:
+		return weakRef[State]{weak.Make(v2)}
+	}
+	return v
+}
+
+// strong converts weak references back into normal values. If the object the reference pointed to was collected
+// nil is returned. Other values are returned unchanged.
+func strong(v value) value {
+	switch v2 := v.(type) {
+	case weakRef[table]:
+		if p := v2.p.Value(); p != nil {
+			return p
+		}
+		return nil
+	case weakRef[function]:
+		if p := v2.p.Value(); p != nil {
+			return p
+		}
+		return nil
+	case weakRef[userData]:
+		if p := v2.p.Value(); p != nil {
+			return p
+		}
+		return nil
+	case weakRef[State]:
+		if p := v2.p.Value(); p != nil {
+			return p
+		}
+		return nil
+	}
+	return v
+}
+
+// setMode reads the __mode field from the given metatable and converts the table to match.
+func (tbl *table) setMode(meta *table) {
+	weakK, weakV := false, false
+	if meta != nil {
+		if mode, ok := meta.GetRaw("__mode").(string); ok {
+			weakK = strings.ContainsRune(mode, 'k')
+			weakV = strings.ContainsRune(mode, 'v')
+		}
+	}
+	if weakK == tbl.weakK && weakV == tbl.weakV {
+		return
+	}
+
+	keys, vals := tbl.hkeys, tbl.hvals
+	tbl.weakK, tbl.weakV = weakK, weakV
+	tbl.hash = make(map[value]int, len(keys))
+	tbl.hkeys = make([]value, 0, len(keys))
+	tbl.hvals = make([]value, 0, len(keys))
+	tbl.dead = 0
+	for i, k := range keys {
+		k, v := strong(k), strong(vals[i])
+		if k != nil && v != nil {
+			tbl.addHash(tbl.hashKey(k), tbl.hashVal(v))
+		}
+	}
+
+	// Move the array part into the hash part.
+	if weakV {
+		tbl.l.TrackMemory(int64(len(tbl.array) * memHashEntry))
+		for i, v := range tbl.array {
+			if !v.isNil() {
+				tbl.addHash(int64(i+tbl.l.indexBase), tbl.hashVal(v.value()))
+			}
+		}
+		tbl.array = nil
+		tbl.length = -1
+	}
+}
+
+// hashKey returns the value that should be used as the hash key for k.
+func (tbl *table) hashKey(k value) value {
+	if tbl.weakK {
+		return makeWeak(k)
+	}
+	return k
+}
+
+// hashVal returns the value that should be stored in the hash part for v.
+func (tbl *table) hashVal(v value) value {
+	if tbl.weakV {
+		return makeWeak(v)
+	}
+	return v
+}
+
+// sweep turns all entries with collected keys or values into tombstones.
+func (tbl *table) sweep() {
+	tbl.added = 0
+	for i, k := range tbl.hkeys {
+		if tbl.hvals[i] != nil && (strong(k) == nil || strong(tbl.hvals[i]) == nil) {
+			tbl.hvals[i] = nil
+			tbl.dead++
+		}
+	}
+}